@@ -0,0 +1,135 @@
+package billyfs
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+// AtomicOptions configures CreateAtomic and AtomicWriteFile.
+type AtomicOptions struct {
+	// SyncDir syncs the directory containing the destination after the
+	// rename, so that the new directory entry survives a crash.
+	SyncDir bool
+}
+
+// AtomicFile is a billy.File that replaces its destination atomically when
+// closed. Data is written to a temporary file next to the destination;
+// Close syncs it, renames it over the destination and, if requested, syncs
+// the parent directory. Readers of the destination see either its previous
+// contents or all the data written, never a partial file.
+type AtomicFile struct {
+	*File
+
+	fs   *Filesystem
+	dest string
+	temp string
+	opts AtomicOptions
+
+	once sync.Once
+	err  error
+}
+
+// CreateAtomic creates a temporary file in the directory of filename and
+// returns an AtomicFile that renames it to filename when closed. The file
+// is created with mode perm (before umask). Call Abort to discard the data
+// instead; Abort after a successful Close does nothing, so it can be
+// deferred.
+func (f *Filesystem) CreateAtomic(filename string, perm os.FileMode, opts AtomicOptions) (*AtomicFile, error) {
+	initRNG()
+	dir, base := path.Split(filename)
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	for {
+		temp := path.Join(dir, "."+base+".tmp-"+randSeq(8))
+		file, err := f.fs.OpenFile(temp, flag, f.mode(perm))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.invalidate(temp, false)
+		f.notify(OpCreate, temp)
+		return &AtomicFile{
+			File: f.newFile(file, temp, flag),
+			fs:   f,
+			dest: filename,
+			temp: temp,
+			opts: opts,
+		}, nil
+	}
+}
+
+// AtomicWriteFile atomically replaces the contents of filename with data,
+// creating it with mode perm (before umask) if it does not exist.
+func (f *Filesystem) AtomicWriteFile(filename string, data []byte, perm os.FileMode, opts AtomicOptions) error {
+	af, err := f.CreateAtomic(filename, perm, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := af.Write(data); err != nil {
+		af.Abort()
+		return err
+	}
+	return af.Close()
+}
+
+// Close syncs the temporary file and renames it over the destination. If
+// any step fails the temporary file is removed and the destination is left
+// unchanged. Later calls return the result of the first.
+func (a *AtomicFile) Close() error {
+	a.once.Do(func() {
+		a.err = a.commit()
+	})
+	return a.err
+}
+
+// Abort closes and removes the temporary file, leaving the destination
+// unchanged. It does nothing if the file was already closed.
+func (a *AtomicFile) Abort() error {
+	var err error
+	a.once.Do(func() {
+		a.File.Close()
+		err = a.fs.Remove(a.temp)
+		a.err = os.ErrClosed
+	})
+	return err
+}
+
+func (a *AtomicFile) commit() error {
+	if err := a.File.Sync(); err != nil {
+		a.File.Close()
+		a.fs.Remove(a.temp)
+		return err
+	}
+	if err := a.File.Close(); err != nil {
+		a.fs.Remove(a.temp)
+		return err
+	}
+	if err := a.fs.Rename(a.temp, a.dest); err != nil {
+		a.fs.Remove(a.temp)
+		return err
+	}
+	if a.opts.SyncDir {
+		return a.fs.syncDir(path.Dir(a.dest))
+	}
+	return nil
+}
+
+// Name returns the name of the destination.
+func (a *AtomicFile) Name() string {
+	return a.dest
+}
+
+// syncDir commits the entries of the directory name to stable storage.
+func (f *Filesystem) syncDir(name string) error {
+	dir, err := f.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
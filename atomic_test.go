@@ -0,0 +1,267 @@
+package billyfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// faultFS wraps an absfs filesystem, logs the mutating operations issued
+// through it and simulates a crash: once limit operations have been issued,
+// every further operation fails and has no effect. A negative limit never
+// crashes
+type faultFS struct {
+	absfs.SymlinkFileSystem
+
+	mu    sync.Mutex
+	log   []string
+	limit int
+}
+
+var errCrash = errors.New("simulated crash")
+
+// op records a mutating operation and reports errCrash if the simulated
+// crash has happened.
+func (c *faultFS) op(format string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limit >= 0 && len(c.log) >= c.limit {
+		return errCrash
+	}
+	c.log = append(c.log, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (c *faultFS) Open(name string) (absfs.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c *faultFS) Create(name string) (absfs.File, error) {
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (c *faultFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := c.op("create %s", filepath.Base(name)); err != nil {
+			return nil, err
+		}
+	}
+	f, err := c.SymlinkFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: c}, nil
+}
+
+func (c *faultFS) Rename(oldpath, newpath string) error {
+	if err := c.op("rename %s %s", filepath.Base(oldpath), filepath.Base(newpath)); err != nil {
+		return err
+	}
+	return c.SymlinkFileSystem.Rename(oldpath, newpath)
+}
+
+func (c *faultFS) Remove(name string) error {
+	if err := c.op("remove %s", filepath.Base(name)); err != nil {
+		return err
+	}
+	return c.SymlinkFileSystem.Remove(name)
+}
+
+func (c *faultFS) Mkdir(name string, perm os.FileMode) error {
+	if err := c.op("mkdir %s", filepath.Base(name)); err != nil {
+		return err
+	}
+	return c.SymlinkFileSystem.Mkdir(name, perm)
+}
+
+func (c *faultFS) RemoveAll(name string) error {
+	if err := c.op("removeall %s", filepath.Base(name)); err != nil {
+		return err
+	}
+	return c.SymlinkFileSystem.RemoveAll(name)
+}
+
+func (c *faultFS) Symlink(target, link string) error {
+	if err := c.op("symlink %s", filepath.Base(link)); err != nil {
+		return err
+	}
+	return c.SymlinkFileSystem.Symlink(target, link)
+}
+
+type faultFile struct {
+	absfs.File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.op("write %s", filepath.Base(f.Name())); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.op("write %s", filepath.Base(f.Name())); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.op("sync %s", filepath.Base(f.Name())); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+// newFaultTestFS creates a billyfs filesystem over a fault-injecting
+// backend
+func newFaultTestFS(t *testing.T, dir string, limit int) (*billyfs.Filesystem, *faultFS) {
+	t.Helper()
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	faults := &faultFS{SymlinkFileSystem: fs, limit: limit}
+	bfs, err := billyfs.NewFS(faults, dir)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	return bfs, faults
+}
+
+// TestAtomicWriteFile tests the sequence of operations of an atomic write
+func TestAtomicWriteFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	bfs, faults := newFaultTestFS(t, tmpDir, -1)
+	if err := bfs.MkdirAll("refs/heads", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	faults.log = nil
+
+	err := bfs.AtomicWriteFile("refs/heads/main", []byte("abc123\n"), 0644, billyfs.AtomicOptions{SyncDir: true})
+	if err != nil {
+		t.Fatalf("AtomicWriteFile failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, "refs/heads/main"))
+	if err != nil || string(data) != "abc123\n" {
+		t.Errorf("unexpected content %q, %v", data, err)
+	}
+
+	var ops []string
+	for _, entry := range faults.log {
+		ops = append(ops, strings.Fields(entry)[0])
+	}
+	if got := strings.Join(ops, ","); got != "create,write,sync,rename,sync" {
+		t.Errorf("unexpected operation sequence %s", got)
+	}
+	if last := faults.log[len(faults.log)-1]; last != "sync heads" {
+		t.Errorf("expected the parent directory to be synced, got %q", last)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, "refs/heads"))
+	if len(entries) != 1 {
+		t.Errorf("expected only the destination, got %v", entries)
+	}
+}
+
+// TestAtomicAbort tests that aborted and failed writes leave the
+// destination unchanged and remove the temporary file
+func TestAtomicAbort(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	writeBillyFile(t, bfs, "config", []byte("old"))
+
+	af, err := bfs.CreateAtomic("config", 0644, billyfs.AtomicOptions{})
+	if err != nil {
+		t.Fatalf("CreateAtomic failed: %v", err)
+	}
+	var file billy.File = af
+	file.Write([]byte("new"))
+	if af.Name() != "config" {
+		t.Errorf("expected destination name, got %q", af.Name())
+	}
+	if err := af.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if err := af.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected Close after Abort to fail, got %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "config"))
+	if string(data) != "old" {
+		t.Errorf("expected destination to be unchanged, got %q", data)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 1 {
+		t.Errorf("expected temporary file to be removed, got %v", entries)
+	}
+
+	// A deferred Abort after a successful Close does nothing.
+	af, err = bfs.CreateAtomic("config", 0644, billyfs.AtomicOptions{})
+	if err != nil {
+		t.Fatalf("CreateAtomic failed: %v", err)
+	}
+	af.Write([]byte("new"))
+	if err := af.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := af.Abort(); err != nil {
+		t.Errorf("expected Abort after Close to succeed, got %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(tmpDir, "config"))
+	if string(data) != "new" {
+		t.Errorf("expected new content, got %q", data)
+	}
+}
+
+// TestAtomicCrash simulates a crash after every operation of an atomic
+// write and checks that the destination always holds either the old or
+// the new contents
+func TestAtomicCrash(t *testing.T) {
+	const steps = 5 // create, write, sync, rename, sync
+	for limit := 0; limit <= steps; limit++ {
+		t.Run(fmt.Sprintf("after_%d", limit), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmpDir, "index"), []byte("old index"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			bfs, _ := newFaultTestFS(t, tmpDir, limit)
+
+			err := bfs.AtomicWriteFile("index", []byte("new index"), 0644, billyfs.AtomicOptions{SyncDir: true})
+
+			// Restart: inspect the disk directly.
+			data, rerr := os.ReadFile(filepath.Join(tmpDir, "index"))
+			if rerr != nil {
+				t.Fatalf("destination lost: %v", rerr)
+			}
+			switch string(data) {
+			case "new index":
+			case "old index":
+				if err == nil {
+					t.Error("write reported success but destination is unchanged")
+				}
+			default:
+				t.Errorf("destination holds partial contents %q", data)
+			}
+			if limit == steps && err != nil {
+				t.Errorf("expected success without crash, got %v", err)
+			}
+			if limit < steps && !isCrash(err) {
+				t.Errorf("expected crash error, got %v", err)
+			}
+		})
+	}
+}
+
+// isCrash reports whether err is errCrash. The prefixing backend rewrites
+// error values, so the message is compared.
+func isCrash(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errCrash.Error())
+}
@@ -0,0 +1,354 @@
+package billyfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// ErrAuditLog is returned, wrapped with the position of the first bad
+// entry, when an audit log fails verification.
+var ErrAuditLog = errors.New("billyfs: audit log verification failed")
+
+// AuditEntry records a mutating operation in an AuditLog.
+type AuditEntry struct {
+	// Seq numbers the entries of a log from 1.
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	// Op is the name of the method, such as "create" or "rename".
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// NewPath is the new path of Rename or the target of Symlink.
+	NewPath string `json:"new_path,omitempty"`
+
+	// The arguments of the operation, when it has them.
+	Flag  int         `json:"flag,omitempty"`
+	Mode  os.FileMode `json:"mode,omitempty"`
+	UID   *int        `json:"uid,omitempty"`
+	GID   *int        `json:"gid,omitempty"`
+	Size  *int64      `json:"size,omitempty"`
+	Atime *time.Time  `json:"atime,omitempty"`
+	Mtime *time.Time  `json:"mtime,omitempty"`
+
+	// Err is the error returned by the operation, if it failed.
+	Err string `json:"error,omitempty"`
+
+	// Prev is the Hash of the previous entry, empty for the first one.
+	Prev string `json:"prev"`
+	// Hash is the hex SHA-256 hash of the JSON encoding of the entry with
+	// an empty Hash. Since it covers Prev, changing, removing or
+	// reordering entries breaks the chain of hashes after them.
+	Hash string `json:"hash"`
+}
+
+// hash returns the Hash of e.
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends hash-chained entries to a file, one JSON object per
+// line. It is safe for concurrent use. Use VerifyAuditLog to check that a
+// log has not been tampered with; truncating it after its last entry can
+// only be detected by keeping the Hash of that entry elsewhere.
+type AuditLog struct {
+	mu   sync.Mutex
+	file absfs.File
+	seq  uint64
+	last string
+}
+
+// NewAuditLog opens the audit log name on fs, creating it if needed, and
+// continues its chain of entries. It fails if the existing entries do not
+// pass verification.
+func NewAuditLog(fs absfs.Filer, name string) (*AuditLog, error) {
+	file, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := verifyAudit(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l := &AuditLog{file: file}
+	if n := len(entries); n > 0 {
+		l.seq, l.last = entries[n-1].Seq, entries[n-1].Hash
+	}
+	return l, nil
+}
+
+// Close closes the file of the log.
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
+
+// Record completes e with its position in the chain and appends it to
+// the log, syncing the file.
+func (l *AuditLog) Record(e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq, e.Prev = l.seq+1, l.last
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq, l.last = e.Seq, e.Hash
+	return nil
+}
+
+// VerifyAuditLog reads the audit log name on fs and checks the sequence
+// numbers and hashes of its entries, returning them if they are intact.
+func VerifyAuditLog(fs absfs.Filer, name string) ([]AuditEntry, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return verifyAudit(file)
+}
+
+func verifyAudit(r io.Reader) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	prev := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		n := uint64(len(entries) + 1)
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrAuditLog, n, err)
+		}
+		hash, err := e.hash()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case e.Seq != n:
+			return nil, fmt.Errorf("%w: entry %d: sequence number %d", ErrAuditLog, n, e.Seq)
+		case e.Prev != prev:
+			return nil, fmt.Errorf("%w: entry %d: broken chain", ErrAuditLog, n)
+		case e.Hash != hash:
+			return nil, fmt.Errorf("%w: entry %d: hash mismatch", ErrAuditLog, n)
+		}
+		entries = append(entries, e)
+		prev = e.Hash
+	}
+	return entries, scanner.Err()
+}
+
+// WithAudit returns a view of f on behalf of principal that records every
+// mutating operation in log after performing it: Create, OpenFile with a
+// flag that allows writing or creating, Rename, Remove, MkdirAll, Symlink,
+// Chmod, Chown, Lchown, Chtimes, TempFile and the Truncate method of the
+// Files it opens. Failed operations are recorded with their error. If an
+// operation succeeds but cannot be recorded, the view returns the error of
+// the log.
+func (f *Filesystem) WithAudit(log *AuditLog, principal string) billy.Filesystem {
+	return &auditFS{fs: f, log: log, principal: principal, prefix: "/"}
+}
+
+// auditFS is the billy.Filesystem returned by Filesystem.WithAudit. prefix
+// is the path of its root relative to the root of the view it was created
+// on.
+type auditFS struct {
+	fs        *Filesystem
+	log       *AuditLog
+	principal string
+	prefix    string
+}
+
+// rel returns the path of name relative to the root of the audited view.
+func (c *auditFS) rel(name string) string {
+	return strings.TrimPrefix(path.Join(c.prefix, path.Clean("/"+name)), "/")
+}
+
+// record records the operation e on name, which returned err, and returns
+// the error of the operation or else of the log.
+func (c *auditFS) record(e AuditEntry, name string, err error) error {
+	e.Time = time.Now().UTC()
+	e.Principal = c.principal
+	e.Path = c.rel(name)
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if lerr := c.log.Record(e); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// open records the opening of name and wraps the resulting file.
+func (c *auditFS) open(e AuditEntry, name string, file billy.File, err error) (billy.File, error) {
+	if err = c.record(e, name, err); err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	if f, ok := file.(*File); ok {
+		return &auditFile{File: f, fs: c, name: name}, nil
+	}
+	return file, nil
+}
+
+// auditFile records Truncate calls on a File opened for writing through an
+// audited view.
+type auditFile struct {
+	*File
+	fs   *auditFS
+	name string
+}
+
+func (f *auditFile) Truncate(size int64) error {
+	return f.fs.record(AuditEntry{Op: "truncate", Size: &size}, f.name, f.File.Truncate(size))
+}
+
+// go-billy Basic interface functions
+
+func (c *auditFS) Create(filename string) (billy.File, error) {
+	file, err := c.fs.Create(filename)
+	return c.open(AuditEntry{Op: "create"}, filename, file, err)
+}
+
+func (c *auditFS) Open(filename string) (billy.File, error) {
+	return c.fs.Open(filename)
+}
+
+func (c *auditFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	file, err := c.fs.OpenFile(filename, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC|os.O_CREATE) == 0 {
+		return file, err
+	}
+	return c.open(AuditEntry{Op: "open", Flag: flag, Mode: perm}, filename, file, err)
+}
+
+func (c *auditFS) Stat(filename string) (os.FileInfo, error) {
+	return c.fs.Stat(filename)
+}
+
+func (c *auditFS) Rename(oldpath, newpath string) error {
+	err := c.fs.Rename(oldpath, newpath)
+	return c.record(AuditEntry{Op: "rename", NewPath: c.rel(newpath)}, oldpath, err)
+}
+
+func (c *auditFS) Remove(filename string) error {
+	return c.record(AuditEntry{Op: "remove"}, filename, c.fs.Remove(filename))
+}
+
+func (c *auditFS) Join(elem ...string) string {
+	return c.fs.Join(elem...)
+}
+
+// go-billy TempFile interface functions
+
+func (c *auditFS) TempFile(dir, prefix string) (billy.File, error) {
+	file, err := c.fs.TempFile(dir, prefix)
+	name := dir
+	if file != nil {
+		name = file.Name()
+	}
+	return c.open(AuditEntry{Op: "tempfile"}, name, file, err)
+}
+
+// go-billy Dir interface functions
+
+func (c *auditFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return c.fs.ReadDir(path)
+}
+
+func (c *auditFS) MkdirAll(filename string, perm os.FileMode) error {
+	err := c.fs.MkdirAll(filename, perm)
+	return c.record(AuditEntry{Op: "mkdir", Mode: perm}, filename, err)
+}
+
+// go-billy Symlink interface functions
+
+func (c *auditFS) Lstat(filename string) (os.FileInfo, error) {
+	return c.fs.Lstat(filename)
+}
+
+func (c *auditFS) Symlink(target, link string) error {
+	err := c.fs.Symlink(target, link)
+	return c.record(AuditEntry{Op: "symlink", NewPath: target}, link, err)
+}
+
+func (c *auditFS) Readlink(link string) (string, error) {
+	return c.fs.Readlink(link)
+}
+
+// go-billy Chroot interface functions
+
+// Chroot returns an audited view of the chrooted filesystem for the same
+// principal, recording paths relative to the root of the original view.
+func (c *auditFS) Chroot(path string) (billy.Filesystem, error) {
+	sub, err := c.fs.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFS{
+		fs:        sub.(*Filesystem),
+		log:       c.log,
+		principal: c.principal,
+		prefix:    "/" + c.rel(path),
+	}, nil
+}
+
+func (c *auditFS) Root() string {
+	return c.fs.Root()
+}
+
+// go-billy Capabilities interface
+
+func (c *auditFS) Capabilities() billy.Capability {
+	return c.fs.Capabilities()
+}
+
+// go-billy Change interface functions
+
+func (c *auditFS) Chmod(name string, mode os.FileMode) error {
+	return c.record(AuditEntry{Op: "chmod", Mode: mode}, name, c.fs.Chmod(name, mode))
+}
+
+func (c *auditFS) Lchown(name string, uid, gid int) error {
+	return c.record(AuditEntry{Op: "lchown", UID: &uid, GID: &gid}, name, c.fs.Lchown(name, uid, gid))
+}
+
+func (c *auditFS) Chown(name string, uid, gid int) error {
+	return c.record(AuditEntry{Op: "chown", UID: &uid, GID: &gid}, name, c.fs.Chown(name, uid, gid))
+}
+
+func (c *auditFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	atime, mtime = atime.UTC(), mtime.UTC()
+	err := c.fs.Chtimes(name, atime, mtime)
+	return c.record(AuditEntry{Op: "chtimes", Atime: &atime, Mtime: &mtime}, name, err)
+}
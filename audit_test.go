@@ -0,0 +1,156 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// newAuditTestLog returns the path of an audit log in its own directory
+// and the backend storing it
+func newAuditTestLog(t *testing.T) (*osfs.FileSystem, string) {
+	t.Helper()
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	return fs, osfs.FromNative(filepath.Join(t.TempDir(), "audit.log"))
+}
+
+// TestAudit tests recording mutating operations
+func TestAudit(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	logFS, logName := newAuditTestLog(t)
+	log, err := billyfs.NewAuditLog(logFS, logName)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %v", err)
+	}
+	view := bfs.WithAudit(log, "alice")
+
+	file, err := view.Create("HEAD")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("ref: refs/heads/main\n"))
+	if err := file.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	file.Close()
+	if file, err = view.Open("HEAD"); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	file.Close()
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	view.MkdirAll("refs/heads", 0755)
+	view.Symlink("../../HEAD", "refs/heads/link")
+	view.Rename("HEAD", "ORIG_HEAD")
+	change := view.(billy.Change)
+	change.Chmod("ORIG_HEAD", 0600)
+	change.Chtimes("ORIG_HEAD", mtime, mtime)
+	refs, _ := view.Chroot("refs")
+	refs.Remove("heads/link")
+	if err := view.Remove("missing"); err == nil {
+		t.Fatal("expected Remove of a missing file to fail")
+	}
+	log.Close()
+
+	entries, err := billyfs.VerifyAuditLog(logFS, logName)
+	if err != nil {
+		t.Fatalf("VerifyAuditLog failed: %v", err)
+	}
+	want := []struct{ op, path string }{
+		{"create", "HEAD"},
+		{"truncate", "HEAD"},
+		{"mkdir", "refs/heads"},
+		{"symlink", "refs/heads/link"},
+		{"rename", "HEAD"},
+		{"chmod", "ORIG_HEAD"},
+		{"chtimes", "ORIG_HEAD"},
+		{"remove", "refs/heads/link"},
+		{"remove", "missing"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+	for i, w := range want {
+		if e := entries[i]; e.Op != w.op || e.Path != w.path || e.Principal != "alice" {
+			t.Errorf("entry %d: expected %s %s, got %+v", i+1, w.op, w.path, e)
+		}
+	}
+	if e := entries[1]; e.Size == nil || *e.Size != 5 {
+		t.Errorf("expected truncate size to be recorded, got %+v", e)
+	}
+	if e := entries[4]; e.NewPath != "ORIG_HEAD" {
+		t.Errorf("expected new path to be recorded, got %+v", e)
+	}
+	if e := entries[6]; e.Mtime == nil || !e.Mtime.Equal(mtime) {
+		t.Errorf("expected mtime to be recorded, got %+v", e)
+	}
+	if e := entries[8]; e.Err == "" {
+		t.Errorf("expected error to be recorded, got %+v", e)
+	}
+
+	// Reopening the log continues the chain.
+	if log, err = billyfs.NewAuditLog(logFS, logName); err != nil {
+		t.Fatalf("NewAuditLog failed: %v", err)
+	}
+	if err := bfs.WithAudit(log, "bob").MkdirAll("objects", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	log.Close()
+	entries, err = billyfs.VerifyAuditLog(logFS, logName)
+	if err != nil || len(entries) != 10 || entries[9].Prev != entries[8].Hash {
+		t.Errorf("expected chain to continue, got %d entries, %v", len(entries), err)
+	}
+}
+
+// TestAuditTampering tests detecting changed and removed entries
+func TestAuditTampering(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	logFS, logName := newAuditTestLog(t)
+	log, err := billyfs.NewAuditLog(logFS, logName)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %v", err)
+	}
+	view := bfs.WithAudit(log, "alice")
+	for _, dir := range []string{"a", "b", "c"} {
+		view.MkdirAll(dir, 0755)
+	}
+	log.Close()
+	native := osfs.ToNative(logName)
+	data, err := os.ReadFile(native)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"changed", bytes.Replace(data, []byte(`"path":"b"`), []byte(`"path":"x"`), 1)},
+		{"removed", append(append([]byte{}, lines[0]...), lines[2]...)},
+		{"reordered", append(append(append([]byte{}, lines[1]...), lines[0]...), lines[2]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(native, tt.data, 0600); err != nil {
+				t.Fatalf("failed to write log: %v", err)
+			}
+			if _, err := billyfs.VerifyAuditLog(logFS, logName); !errors.Is(err, billyfs.ErrAuditLog) {
+				t.Errorf("expected verification to fail, got %v", err)
+			}
+			if _, err := billyfs.NewAuditLog(logFS, logName); !errors.Is(err, billyfs.ErrAuditLog) {
+				t.Errorf("expected NewAuditLog to fail, got %v", err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/absfs/billyfs"
 	"github.com/absfs/osfs"
@@ -28,6 +29,27 @@ func newBenchFS(b *testing.B) *billyfs.Filesystem {
 	return bfs
 }
 
+// newCachedBenchFS creates a filesystem with the metadata cache enabled for
+// benchmarking
+func newCachedBenchFS(b *testing.B) *billyfs.Filesystem {
+	b.Helper()
+	tmpDir := b.TempDir()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		b.Fatalf("failed to create osfs: %v", err)
+	}
+
+	bfs, err := billyfs.NewFSWithOptions(fs, tmpDir, billyfs.Options{
+		MetadataCache: billyfs.MetadataCacheOptions{TTL: time.Minute},
+	})
+	if err != nil {
+		b.Fatalf("failed to create billyfs: %v", err)
+	}
+
+	return bfs
+}
+
 // BenchmarkCreate measures file creation performance
 func BenchmarkCreate(b *testing.B) {
 	bfs := newBenchFS(b)
@@ -157,6 +179,57 @@ func BenchmarkReadDir(b *testing.B) {
 	}
 }
 
+// BenchmarkStatCached measures Stat performance with the metadata cache
+// enabled, for comparison with BenchmarkStat
+func BenchmarkStatCached(b *testing.B) {
+	bfs := newCachedBenchFS(b)
+
+	f, _ := bfs.Create("bench_stat.txt")
+	f.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bfs.Stat("bench_stat.txt")
+	}
+	b.StopTimer()
+	b.ReportMetric(bfs.MetadataCacheStats().HitRate(), "hit-rate")
+	bfs.Remove("bench_stat.txt")
+}
+
+// BenchmarkReadDirCached measures ReadDir performance with the metadata
+// cache enabled, for comparison with BenchmarkReadDir
+func BenchmarkReadDirCached(b *testing.B) {
+	sizes := []struct {
+		name  string
+		files int
+	}{
+		{"10_files", 10},
+		{"100_files", 100},
+		{"1000_files", 1000},
+	}
+
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			bfs := newCachedBenchFS(b)
+
+			bfs.MkdirAll("bench_dir", 0755)
+			for i := 0; i < size.files; i++ {
+				f, _ := bfs.Create(fmt.Sprintf("bench_dir/file%04d.txt", i))
+				f.Close()
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bfs.ReadDir("bench_dir")
+			}
+			b.StopTimer()
+			b.ReportMetric(bfs.MetadataCacheStats().HitRate(), "hit-rate")
+		})
+	}
+}
+
 // BenchmarkMkdirAll measures directory creation performance
 func BenchmarkMkdirAll(b *testing.B) {
 	bfs := newBenchFS(b)
@@ -305,3 +378,69 @@ func BenchmarkAdapterOverhead(b *testing.B) {
 		})
 	})
 }
+
+// benchPackObjects returns the offsets of the objects read by the packfile
+// benchmarks
+func benchPackObjects(size, objSize int) []int64 {
+	offsets := make([]int64, 0, 1024)
+	for i := 0; i < cap(offsets); i++ {
+		offsets = append(offsets, int64(i*7919%(size-objSize)))
+	}
+	return offsets
+}
+
+// setupBenchPack creates a packfile-sized file and opens it
+func setupBenchPack(b *testing.B, size int) *billyfs.File {
+	b.Helper()
+	bfs := newBenchFS(b)
+	f, err := bfs.Create("pack.bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Write(make([]byte, size))
+	f.Close()
+
+	bf, err := bfs.Open("pack.bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { bf.Close() })
+	return bf.(*billyfs.File)
+}
+
+// BenchmarkPackReadAt measures small object reads through ReadAt
+func BenchmarkPackReadAt(b *testing.B) {
+	const size, objSize = 4 << 20, 256
+	f := setupBenchPack(b, size)
+	offsets := benchPackObjects(size, objSize)
+	p := make([]byte, objSize)
+
+	b.SetBytes(objSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.ReadAt(p, offsets[i%len(offsets)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPackMmap measures small object reads from a memory mapping
+func BenchmarkPackMmap(b *testing.B) {
+	const size, objSize = 4 << 20, 256
+	f := setupBenchPack(b, size)
+	offsets := benchPackObjects(size, objSize)
+	p := make([]byte, objSize)
+	data, err := f.Mmap()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(objSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := offsets[i%len(offsets)]
+		copy(p, data[off:off+objSize])
+	}
+}
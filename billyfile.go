@@ -1,6 +1,7 @@
 package billyfs
 
 import (
+	"os"
 	"sync"
 
 	"github.com/absfs/absfs"
@@ -10,6 +11,62 @@ import (
 type File struct {
 	f  absfs.File
 	mu sync.Mutex
+
+	fs   *Filesystem
+	name string
+	flag int
+
+	// target is the path name resolved to when the file was opened. It is
+	// only set when fs caches metadata or blocks, which are keyed by it.
+	target string
+	// cache is set when reads go through the block cache of fs.
+	cache *blockReader
+	// wb is set when writes go through a write buffer.
+	wb *writeBuffer
+	// written is set once the file was changed through the handle.
+	written bool
+	// mapping holds the slice returned by Mmap.
+	mapping mapping
+}
+
+// newFile wraps an absfs.File opened as name with flag on f.
+func (f *Filesystem) newFile(file absfs.File, name string, flag int) *File {
+	bf := &File{f: file, fs: f, name: name, flag: flag}
+	if f.meta != nil || f.blocks != nil {
+		bf.target = f.resolveName(name)
+	}
+	if f.blocks != nil {
+		bf.cache = &blockReader{path: f.absPath(bf.target)}
+	}
+	if f.writeBufferSize > 0 && bufferable(flag) {
+		bf.wb = &writeBuffer{size: f.writeBufferSize}
+	}
+	return bf
+}
+
+// wrote records a change of the file made through the handle.
+func (f *File) wrote() {
+	f.written = true
+	f.invalidate()
+	f.fs.notify(OpWrite, f.name)
+}
+
+// invalidate drops cached data of the file under its name and the path it
+// resolved to.
+func (f *File) invalidate() {
+	f.fs.invalidate(f.name, false)
+	if f.target != "" && f.fs.absPath(f.target) != f.fs.absPath(f.name) {
+		f.fs.invalidate(f.target, false)
+	}
+}
+
+// readAt reads from the underlying file, through the block cache if
+// enabled.
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.cache != nil {
+		return f.cachedReadAt(p, off)
+	}
+	return f.f.ReadAt(p, off)
 }
 
 func (f *File) Name() string {
@@ -18,37 +75,105 @@ func (f *File) Name() string {
 
 // io.Writer interface
 func (f *File) Write(p []byte) (n int, err error) {
-	return f.f.Write(p)
+	if f.wb != nil {
+		return f.bufferedWrite(p, -1)
+	}
+	n, err = f.f.Write(p)
+	if n > 0 {
+		f.wroteAt(-1, n)
+	}
+	return n, err
 }
 
 // io.Reader interface
 func (f *File) Read(p []byte) (n int, err error) {
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	if f.cache != nil {
+		return f.cachedRead(p)
+	}
 	return f.f.Read(p)
 }
 
 // io.ReaderAt interface
 func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
-	return f.f.ReadAt(p, off)
+	if f.wb != nil {
+		return f.bufferedReadAt(p, off)
+	}
+	return f.readAt(p, off)
 }
 
 // io.WriterAt interface
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
-	return f.f.WriteAt(p, off)
+	if f.wb != nil {
+		if off < 0 {
+			return 0, &os.PathError{Op: "writeat", Path: f.f.Name(), Err: os.ErrInvalid}
+		}
+		return f.bufferedWrite(p, off)
+	}
+	n, err = f.f.WriteAt(p, off)
+	if n > 0 {
+		f.wroteAt(off, n)
+	}
+	return n, err
 }
 
-// io.Seeker interface
+// io.Seeker interface. Seek also accepts SeekData and SeekHole.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if whence == SeekData || whence == SeekHole {
+		return f.seekSparse(offset, whence)
+	}
+	if f.wb != nil {
+		return f.bufferedSeek(offset, whence)
+	}
 	return f.f.Seek(offset, whence)
 }
 
-// io.Closer interface
+// io.Closer interface. Close releases the slice returned by Mmap and
+// flushes buffered writes first, and returns the first error met while
+// flushing them, even if it was already returned by an earlier call.
 func (f *File) Close() error {
-	return f.f.Close()
+	merr := f.Munmap()
+	ferr := f.flush()
+	err := f.f.Close()
+	if f.written {
+		f.invalidate()
+	}
+	if f.written || f.flag&os.O_CREATE != 0 {
+		if serr := f.fs.stamp(f.name); err == nil {
+			err = serr
+		}
+	}
+	if ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return err
+	}
+	return merr
+}
+
+// Sync flushes buffered writes and commits the contents of the file to
+// stable storage.
+func (f *File) Sync() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.f.Sync()
 }
 
 // Truncate the file.
 func (f *File) Truncate(size int64) error {
-	return f.f.Truncate(size)
+	if err := f.flush(); err != nil {
+		return err
+	}
+	if err := f.f.Truncate(size); err != nil {
+		return err
+	}
+	f.fs.sparse.truncate(f.fs.absPath(f.name), size)
+	f.wrote()
+	return nil
 }
 
 func (f *File) Lock() error {
@@ -27,19 +27,110 @@ func initRNG() {
 // Filesystem implements all functions of the go-billy Filesystem interface
 // by using the absfs.FileSystem interface.
 type Filesystem struct {
-	fs absfs.SymlinkFileSystem
+	fs     absfs.SymlinkFileSystem
+	hub    *watchHub
+	meta   *metaCache
+	blocks *blockCache
+	xattrs *xattrStore
+	sparse *sparseStore
+
+	writeBufferSize int
+	umask           os.FileMode
+	idmap           *IDMap
+	precision       time.Duration
+	epoch           time.Time
+	maxSymlinks     int
+}
+
+// Options configures optional features of a Filesystem created with
+// NewFSWithOptions. The zero value matches NewFS.
+type Options struct {
+	// MetadataCache caches the results of Stat, Lstat and ReadDir.
+	MetadataCache MetadataCacheOptions
+
+	// BlockCache caches file contents read through Files.
+	BlockCache BlockCacheOptions
+
+	// WriteBufferSize enables write-back buffering of up to the given
+	// number of bytes in Files opened for writing without O_APPEND.
+	// Buffered writes are coalesced and reach the backend when the buffer
+	// fills or the File is closed, synced, truncated, read sequentially or
+	// seeked relative to its end. Errors writing them are returned by the
+	// call that flushes them and by Close. Zero disables buffering.
+	WriteBufferSize int
+
+	// Umask clears permission bits from the modes of the files and
+	// directories created by Create, OpenFile, MkdirAll, TempFile,
+	// CreateAtomic and transactions, and of the parent directories created
+	// by Symlink, as the umask of a process does. Backends on the local
+	// filesystem apply the umask of the process as well; in-memory
+	// backends apply none, so their files are world-writable without it.
+	Umask os.FileMode
+
+	// IDMap, if not nil, translates the ids passed to Chown and Lchown to
+	// host ids, and the owners reported by Stat, Lstat and ReadDir back to
+	// container ids, for use inside user namespaces.
+	IDMap *IDMap
+
+	// TimePrecision truncates the times passed to Chtimes and the
+	// modification times reported by Stat, Lstat and ReadDir to a multiple
+	// of it, so that times set on backends storing them with a coarser
+	// precision read back unchanged. Zero keeps times as they are.
+	TimePrecision time.Duration
+
+	// Reproducible sets the access and modification times of the files
+	// created or written through the Filesystem, when they are closed, and
+	// of the directories created by MkdirAll to the time given by the
+	// SOURCE_DATE_EPOCH environment variable, read by NewFSWithOptions.
+	//
+	// Warning: since the times no longer change, stat caches such as the
+	// Git index miss rewrites that keep the size of a file and report it
+	// unmodified. Only enable it for trees whose readers compare contents.
+	Reproducible bool
+
+	// MaxSymlinks bounds the number of symbolic links EvalSymlinks follows
+	// before failing with ELOOP. Zero means DefaultMaxSymlinks.
+	MaxSymlinks int
 }
 
 // NewFS wraps a absfs.FileSystem go-billy  from a `absfs.FileSystem` compatible object
 // and a path. The path must be an absolute path and must already exist in the
-// fs provided otherwise an error is returned.
+// fs provided otherwise an error is returned. Transactions interrupted in
+// the directory are recovered before NewFS returns (see Tx).
 func NewFS(fs absfs.SymlinkFileSystem, dir string) (*Filesystem, error) {
 	fs, err := basefs.NewFS(fs, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Filesystem{fs: fs}, nil
+	f := &Filesystem{fs: fs, hub: newWatchHub(), xattrs: newXattrStore(), sparse: newSparseStore()}
+	if err := f.recoverTransactions(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewFSWithOptions is like NewFS but enables the optional features
+// configured by opts. The features are shared with the Filesystems derived
+// from the result with Chroot.
+func NewFSWithOptions(fs absfs.SymlinkFileSystem, dir string, opts Options) (*Filesystem, error) {
+	f, err := NewFS(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	f.meta = newMetaCache(opts.MetadataCache)
+	f.blocks = newBlockCache(opts.BlockCache)
+	f.writeBufferSize = max(opts.WriteBufferSize, 0)
+	f.umask = opts.Umask.Perm()
+	f.idmap = opts.IDMap
+	f.precision = max(opts.TimePrecision, 0)
+	f.maxSymlinks = max(opts.MaxSymlinks, 0)
+	if opts.Reproducible {
+		if f.epoch, err = sourceDateEpoch(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
 // go-billy Basic interface functions
@@ -48,11 +139,14 @@ func NewFS(fs absfs.SymlinkFileSystem, dir string) (*Filesystem, error) {
 // it if it already exists. If successful, methods on the returned File can
 // be used for I/O; the associated file descriptor has mode O_RDWR.
 func (f *Filesystem) Create(filename string) (billy.File, error) {
-	file, err := f.fs.Create(filename)
+	file, err := f.fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.mode(0666))
 	if err != nil {
 		return nil, err
 	}
-	return &File{f: file}, nil
+	f.invalidateTarget(filename)
+	f.sparse.drop(f.absPath(filename))
+	f.notify(OpCreate, filename)
+	return f.newFile(file, filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC), nil
 }
 
 // Open opens the named file for reading. If successful, methods on the
@@ -63,7 +157,7 @@ func (f *Filesystem) Open(filename string) (billy.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &File{f: file}, nil
+	return f.newFile(file, filename, os.O_RDONLY), nil
 }
 
 // OpenFile is the generalized open call; most users will use Open or Create
@@ -71,28 +165,66 @@ func (f *Filesystem) Open(filename string) (billy.File, error) {
 // perm, (0666 etc.) if applicable. If successful, methods on the returned
 // File can be used for I/O.
 func (f *Filesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
-	file, err := f.fs.OpenFile(filename, flag, perm)
+	file, err := f.fs.OpenFile(filename, flag, f.mode(perm))
 	if err != nil {
 		return nil, err
 	}
-	return &File{f: file}, nil
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		f.invalidateTarget(filename)
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.sparse.drop(f.absPath(filename))
+	}
+	switch {
+	case flag&os.O_CREATE != 0:
+		f.notify(OpCreate, filename)
+	case flag&os.O_TRUNC != 0:
+		f.notify(OpWrite, filename)
+	}
+	return f.newFile(file, filename, flag), nil
 }
 
 // Stat returns a FileInfo describing the named file.
 func (f *Filesystem) Stat(filename string) (os.FileInfo, error) {
-	return f.fs.Stat(filename)
+	var info os.FileInfo
+	var err error
+	if f.meta != nil {
+		info, err = f.cachedStat(filename, true)
+	} else {
+		info, err = f.fs.Stat(filename)
+	}
+	return f.statInfo(f.sparseInfo(filename, info)), err
 }
 
 // Rename renames (moves) oldpath to newpath. If newpath already exists and
 // is not a directory, Rename replaces it. OS-specific restrictions may
 // apply when oldpath and newpath are in different directories.
 func (f *Filesystem) Rename(oldpath, newpath string) error {
-	return f.fs.Rename(oldpath, newpath)
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	f.invalidate(oldpath, true)
+	f.invalidate(newpath, true)
+	if f.xattrs != nil {
+		f.xattrs.rename(f.absPath(oldpath), f.absPath(newpath))
+	}
+	f.sparse.rename(f.absPath(oldpath), f.absPath(newpath))
+	f.notifyRename(oldpath, newpath)
+	return nil
 }
 
 // Remove removes the named file or directory.
 func (f *Filesystem) Remove(filename string) error {
-	return f.fs.Remove(filename)
+	if err := f.fs.Remove(filename); err != nil {
+		return err
+	}
+	f.invalidate(filename, true)
+	if f.xattrs != nil {
+		f.xattrs.drop(f.absPath(filename))
+	}
+	f.sparse.drop(f.absPath(filename))
+	f.notify(OpRemove, filename)
+	return nil
 }
 
 // Join joins any number of path elements into a single path, adding a
@@ -116,28 +248,57 @@ func (f *Filesystem) Capabilities() billy.Capability {
 // Chmod changes the mode of the named file to mode. If the file is a
 // symbolic link, it changes the mode of the link's target.
 func (f *Filesystem) Chmod(name string, mode os.FileMode) error {
-	return f.fs.Chmod(name, mode)
+	if err := f.fs.Chmod(name, mode); err != nil {
+		return err
+	}
+	f.invalidateTarget(name)
+	f.notify(OpChmod, name)
+	return nil
 }
 
 // Lchown changes the numeric uid and gid of the named file. If the file is
 // a symbolic link, it changes the uid and gid of the link itself.
 func (f *Filesystem) Lchown(name string, uid, gid int) error {
-	return f.fs.Lchown(name, uid, gid)
+	uid, gid, err := f.chownIDs("lchown", name, uid, gid)
+	if err != nil {
+		return err
+	}
+	if err := f.fs.Lchown(name, uid, gid); err != nil {
+		return err
+	}
+	f.invalidate(name, false)
+	f.notify(OpChmod, name)
+	return nil
 }
 
 // Chown changes the numeric uid and gid of the named file. If the file is a
 // symbolic link, it changes the uid and gid of the link's target.
 func (f *Filesystem) Chown(name string, uid, gid int) error {
-	return f.fs.Chown(name, uid, gid)
+	uid, gid, err := f.chownIDs("chown", name, uid, gid)
+	if err != nil {
+		return err
+	}
+	if err := f.fs.Chown(name, uid, gid); err != nil {
+		return err
+	}
+	f.invalidateTarget(name)
+	f.notify(OpChmod, name)
+	return nil
 }
 
 // Chtimes changes the access and modification times of the named file,
 // similar to the Unix utime() or utimes() functions.
 //
 // The underlying filesystem may truncate or round the values to a less
-// precise time unit.
+// precise time unit; set Options.TimePrecision to that unit so that Stat
+// reports the times passed to Chtimes.
 func (f *Filesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	return f.fs.Chtimes(name, atime, mtime)
+	if err := f.fs.Chtimes(name, f.truncTime(atime), f.truncTime(mtime)); err != nil {
+		return err
+	}
+	f.invalidateTarget(name)
+	f.notify(OpChmod, name)
+	return nil
 }
 
 // go-billy Chroot interface functions
@@ -179,7 +340,20 @@ func (f *Filesystem) Chroot(name string) (billy.Filesystem, error) {
 		return &Filesystem{}, err
 	}
 
-	return &Filesystem{fs}, nil
+	return &Filesystem{
+		fs:              fs,
+		hub:             f.hub,
+		meta:            f.meta,
+		blocks:          f.blocks,
+		xattrs:          f.xattrs,
+		sparse:          f.sparse,
+		writeBufferSize: f.writeBufferSize,
+		umask:           f.umask,
+		idmap:           f.idmap,
+		precision:       f.precision,
+		epoch:           f.epoch,
+		maxSymlinks:     f.maxSymlinks,
+	}, nil
 }
 
 // Root returns the root path of the filesystem.
@@ -197,6 +371,26 @@ func (f *Filesystem) Root() string {
 // entries sorted by filename. This implements the billy.Dir interface by
 // converting from fs.DirEntry (used internally by absfs) to os.FileInfo.
 func (f *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	var err error
+	if f.meta != nil {
+		infos, err = f.cachedReadDir(name)
+	} else {
+		infos, err = f.readDir(name)
+	}
+	if f.idmap == nil && f.precision <= 0 || err != nil {
+		return infos, err
+	}
+	// The cached slice is shared, so translate the entries into a copy.
+	mapped := make([]os.FileInfo, len(infos))
+	for i, info := range infos {
+		mapped[i] = f.statInfo(info)
+	}
+	return mapped, nil
+}
+
+// readDir reads the directory named by name from the underlying absfs.
+func (f *Filesystem) readDir(name string) ([]os.FileInfo, error) {
 	// Get directory entries from underlying absfs
 	entries, err := f.fs.ReadDir(name)
 	if err != nil {
@@ -204,13 +398,16 @@ func (f *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
 	}
 
 	// Convert []fs.DirEntry to []os.FileInfo
-	infos := make([]os.FileInfo, len(entries))
-	for i, entry := range entries {
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if isTxJournal(entry) {
+			continue
+		}
 		info, err := entry.Info()
 		if err != nil {
 			return nil, err
 		}
-		infos[i] = info
+		infos = append(infos, info)
 	}
 
 	return infos, nil
@@ -221,7 +418,18 @@ func (f *Filesystem) ReadDir(name string) ([]os.FileInfo, error) {
 // perm are used for all directories that MkdirAll creates. If path is/
 // already a directory, MkdirAll does nothing and returns nil.
 func (f *Filesystem) MkdirAll(filename string, perm os.FileMode) error {
-	return f.fs.MkdirAll(filename, perm)
+	if _, err := f.fs.Stat(filename); err == nil {
+		return f.fs.MkdirAll(filename, f.mode(perm))
+	}
+	if err := f.fs.MkdirAll(filename, f.mode(perm)); err != nil {
+		return err
+	}
+	f.invalidateAll(filename)
+	if err := f.stamp(filename); err != nil {
+		return err
+	}
+	f.notify(OpCreate, filename)
+	return nil
 }
 
 // go-billy Symlink interface functions
@@ -230,14 +438,34 @@ func (f *Filesystem) MkdirAll(filename string, perm os.FileMode) error {
 // symbolic link, the returned FileInfo describes the symbolic link. Lstat
 // makes no attempt to follow the link.
 func (f *Filesystem) Lstat(filename string) (os.FileInfo, error) {
-	return f.fs.Lstat(filename)
+	var info os.FileInfo
+	var err error
+	if f.meta != nil {
+		info, err = f.cachedStat(filename, false)
+	} else {
+		info, err = f.fs.Lstat(filename)
+	}
+	return f.statInfo(f.sparseInfo(filename, info)), err
 }
 
 // Symlink creates a symbolic-link from link to target. target may be an
 // absolute or relative path, and need not refer to an existing node.
-// Parent directories of link are created as necessary.
+// Parent directories of link are created as necessary, with mode 0777
+// (before umask).
 func (f *Filesystem) Symlink(target, link string) error {
-	return f.fs.Symlink(target, link)
+	if dir := path.Dir(path.Clean("/" + link)); dir != "/" {
+		if _, err := f.fs.Lstat(dir); err != nil {
+			if err := f.fs.MkdirAll(dir, f.mode(0777)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := f.fs.Symlink(target, link); err != nil {
+		return err
+	}
+	f.invalidateAll(link)
+	f.notify(OpCreate, link)
+	return nil
 }
 
 // Readlink returns the target path of link.
@@ -258,12 +486,25 @@ func (f *Filesystem) Readlink(link string) (string, error) {
 func (f *Filesystem) TempFile(dir string, prefix string) (billy.File, error) {
 	// get the temp directory, then create a temp file
 	initRNG()
-	p := path.Join(f.fs.TempDir(), prefix+"_"+randSeq(5))
-	file, err := f.fs.Create(p)
-	if err != nil {
-		return nil, err
+	const flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	for {
+		p := path.Join(f.fs.TempDir(), prefix+"_"+randSeq(5))
+		file, err := f.fs.OpenFile(p, flag, f.mode(0666))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.invalidate(p, false)
+		f.notify(OpCreate, p)
+		return f.newFile(file, p, flag), nil
 	}
-	return &File{f: file}, nil
+}
+
+// mode returns perm with the bits of the umask cleared.
+func (f *Filesystem) mode(perm os.FileMode) os.FileMode {
+	return perm &^ f.umask
 }
 
 // randSeq generates a random string of length n
@@ -3,10 +3,12 @@ package billyfs_test
 import (
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/absfs/absfs"
 	"github.com/absfs/billyfs"
 	"github.com/absfs/osfs"
 
@@ -757,3 +759,118 @@ func TestTempFile(t *testing.T) {
 		// Note: exact format depends on implementation
 	})
 }
+
+// verbatimModeFS stores the modes of the files and directories it creates
+// unchanged, ignoring the umask of the process, as in-memory backends do.
+type verbatimModeFS struct {
+	absfs.SymlinkFileSystem
+}
+
+func (v *verbatimModeFS) Create(name string) (absfs.File, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (v *verbatimModeFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	_, statErr := v.Lstat(name)
+	f, err := v.SymlinkFileSystem.OpenFile(name, flag, perm)
+	if err == nil && flag&os.O_CREATE != 0 && statErr != nil {
+		err = v.Chmod(name, perm)
+	}
+	return f, err
+}
+
+func (v *verbatimModeFS) Mkdir(name string, perm os.FileMode) error {
+	if err := v.SymlinkFileSystem.Mkdir(name, perm); err != nil {
+		return err
+	}
+	return v.Chmod(name, perm)
+}
+
+func (v *verbatimModeFS) MkdirAll(name string, perm os.FileMode) error {
+	if _, err := v.Stat(name); err == nil {
+		return nil
+	}
+	if dir := path.Dir(name); dir != name {
+		if err := v.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+	}
+	return v.Mkdir(name, perm)
+}
+
+// TestUmask tests that the umask applies to every way of creating files
+// and directories
+func TestUmask(t *testing.T) {
+	osFS, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	tests := []struct {
+		name  string
+		fs    absfs.SymlinkFileSystem
+		umask os.FileMode
+	}{
+		// The umask of the process still applies to the local
+		// filesystem, so use one that covers it.
+		{"os", osFS, 0077},
+		{"memory", &verbatimModeFS{osFS}, 0022},
+		{"memory without umask", &verbatimModeFS{osFS}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bfs, err := billyfs.NewFSWithOptions(tt.fs, t.TempDir(), billyfs.Options{Umask: tt.umask})
+			if err != nil {
+				t.Fatalf("failed to create billyfs: %v", err)
+			}
+			assertPerm := func(name string, perm os.FileMode) {
+				t.Helper()
+				info, err := bfs.Stat(name)
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if want := perm &^ tt.umask; info.Mode().Perm() != want {
+					t.Errorf("%s: expected mode %v, got %v", name, want, info.Mode().Perm())
+				}
+			}
+
+			file, err := bfs.Create("created")
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			file.Close()
+			assertPerm("created", 0666)
+
+			if file, err = bfs.OpenFile("script", os.O_WRONLY|os.O_CREATE, 0775); err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			file.Close()
+			assertPerm("script", 0775)
+
+			if err := bfs.MkdirAll("a/b", 0777); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			assertPerm("a", 0777)
+			assertPerm("a/b", 0777)
+
+			if err := bfs.Symlink("../../created", "links/sub/link"); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+			assertPerm("links", 0777)
+			assertPerm("links/sub", 0777)
+
+			bfs.MkdirAll("tmp", 0777)
+			if file, err = bfs.TempFile("", "tmp"); err != nil {
+				t.Fatalf("TempFile failed: %v", err)
+			}
+			file.Close()
+			assertPerm(file.Name(), 0666)
+			bfs.Remove(file.Name())
+
+			chroot, _ := bfs.Chroot("a")
+			if err := chroot.MkdirAll("c", 0777); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			assertPerm("a/c", 0777)
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package billyfs
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// DefaultBlockCacheBlockSize is the block size used by the block cache when
+// BlockCacheOptions.BlockSize is zero.
+const DefaultBlockCacheBlockSize = 64 * 1024
+
+// BlockCacheOptions configures the read-through cache of file contents kept
+// by a Filesystem.
+//
+// Blocks are keyed by path and by the size and modification time the file
+// had when the reading handle first needed them, so handles of a file that
+// changed on the backend do not share stale blocks. Writes and truncations
+// through the Filesystem and its Files drop the cached blocks of the file.
+type BlockCacheOptions struct {
+	// MaxBytes is the memory budget for cached blocks. Zero disables the
+	// cache.
+	MaxBytes int64
+
+	// BlockSize is the unit in which contents are read from the backend
+	// and cached. Zero means DefaultBlockCacheBlockSize.
+	BlockSize int
+
+	// Readahead is the number of blocks fetched in addition to the
+	// requested one when a handle reads sequentially.
+	Readahead int
+}
+
+// BlockCacheStats returns the statistics of the block cache shared by f and
+// the Filesystems derived from it. It returns zero statistics if the cache
+// is disabled.
+func (f *Filesystem) BlockCacheStats() CacheStats {
+	if f.blocks == nil {
+		return CacheStats{}
+	}
+	return f.blocks.stats()
+}
+
+// fileIdentity identifies a version of a file's contents.
+type fileIdentity struct {
+	size  int64
+	mtime int64
+}
+
+type blockKey struct {
+	path  string
+	id    fileIdentity
+	index int64
+}
+
+type block struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is an LRU cache of file blocks bounded by total size.
+type blockCache struct {
+	mu        sync.Mutex
+	blockSize int
+	readahead int
+	maxBytes  int64
+	bytes     int64
+	entries   map[blockKey]*list.Element
+	byPath    map[string]map[blockKey]struct{}
+	lru       *list.List
+
+	// gen counts invalidations so that blocks read from the backend
+	// concurrently with a write are not stored.
+	gen uint64
+
+	hits, misses, evictions uint64
+}
+
+func newBlockCache(opts BlockCacheOptions) *blockCache {
+	if opts.MaxBytes <= 0 {
+		return nil
+	}
+	size := opts.BlockSize
+	if size <= 0 {
+		size = DefaultBlockCacheBlockSize
+	}
+	return &blockCache{
+		blockSize: size,
+		readahead: max(opts.Readahead, 0),
+		maxBytes:  opts.MaxBytes,
+		entries:   make(map[blockKey]*list.Element),
+		byPath:    make(map[string]map[blockKey]struct{}),
+		lru:       list.New(),
+	}
+}
+
+// generation returns the current invalidation generation.
+func (c *blockCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns the cached block for key and records the lookup.
+func (c *blockCache) get(key blockKey) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.hits++
+		return el.Value.(*block).data, c.gen, true
+	}
+	c.misses++
+	return nil, c.gen, false
+}
+
+// put stores the block data for key unless the cache was invalidated since
+// generation gen.
+func (c *blockCache) put(key blockKey, data []byte, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || int64(len(data)) > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.lru.PushFront(&block{key: key, data: data})
+	keys := c.byPath[key.path]
+	if keys == nil {
+		keys = make(map[blockKey]struct{})
+		c.byPath[key.path] = keys
+	}
+	keys[key] = struct{}{}
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *blockCache) removeElement(el *list.Element) {
+	b := c.lru.Remove(el).(*block)
+	delete(c.entries, b.key)
+	c.bytes -= int64(len(b.data))
+	keys := c.byPath[b.key.path]
+	delete(keys, b.key)
+	if len(keys) == 0 {
+		delete(c.byPath, b.key.path)
+	}
+}
+
+// invalidate drops the blocks of the file at p. If tree is set, the blocks
+// of all files below p are dropped as well.
+func (c *blockCache) invalidate(p string, tree bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for q, keys := range c.byPath {
+		if q != p && !(tree && isWithin(p, q)) {
+			continue
+		}
+		for key := range keys {
+			c.removeElement(c.entries[key])
+		}
+	}
+}
+
+func (c *blockCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// blockReader is the per-handle state of reads through the block cache.
+type blockReader struct {
+	mu   sync.Mutex
+	path string
+	id   fileIdentity
+	// gen is the cache generation at which id was taken. The identity is
+	// taken again once any file was changed through the Filesystem.
+	gen   uint64
+	valid bool
+	// next is the block following the last one read, used to detect
+	// sequential access.
+	next int64
+}
+
+// identity returns the identity of the file contents read by the handle.
+func (f *File) identity() (fileIdentity, error) {
+	gen := f.fs.blocks.generation()
+	if f.cache.valid && f.cache.gen == gen {
+		return f.cache.id, nil
+	}
+	info, err := f.f.Stat()
+	if err != nil {
+		return fileIdentity{}, err
+	}
+	f.cache.id = fileIdentity{size: info.Size(), mtime: info.ModTime().UnixNano()}
+	f.cache.gen = gen
+	f.cache.valid = true
+	return f.cache.id, nil
+}
+
+// cachedReadAt implements ReadAt through the block cache.
+func (f *File) cachedReadAt(p []byte, off int64) (int, error) {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+	c := f.fs.blocks
+	id, err := f.identity()
+	if err != nil {
+		return 0, err
+	}
+	bs := int64(c.blockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= id.size {
+			return n, io.EOF
+		}
+		index := pos / bs
+		data, err := f.cachedBlock(id, index)
+		if err != nil {
+			return n, err
+		}
+		start := pos - index*bs
+		if start >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// cachedBlock returns block index of the file, reading it and any readahead
+// blocks from the backend on a miss.
+func (f *File) cachedBlock(id fileIdentity, index int64) ([]byte, error) {
+	c := f.fs.blocks
+	key := blockKey{path: f.cache.path, id: id, index: index}
+	data, gen, ok := c.get(key)
+	sequential := index == f.cache.next
+	f.cache.next = index + 1
+	if ok {
+		return data, nil
+	}
+
+	count := int64(1)
+	if sequential {
+		count += int64(c.readahead)
+	}
+	bs := int64(c.blockSize)
+	if last := (id.size - 1) / bs; index+count-1 > last {
+		count = max(last-index+1, 1)
+	}
+	buf := make([]byte, count*bs)
+	m, err := f.f.ReadAt(buf, index*bs)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:m]
+	for i := int64(0); i < count; i++ {
+		start := min(i*bs, int64(m))
+		end := min(start+bs, int64(m))
+		if i > 0 && start == end {
+			break
+		}
+		part := buf[start:end:end]
+		if i == 0 {
+			data = part
+		}
+		key.index = index + i
+		c.put(key, part, gen)
+	}
+	return data, nil
+}
+
+// cachedRead implements Read through the block cache, advancing the
+// offset of the underlying file.
+func (f *File) cachedRead(p []byte) (int, error) {
+	pos, err := f.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.cachedReadAt(p, pos)
+	if n > 0 {
+		if _, serr := f.f.Seek(pos+int64(n), io.SeekStart); serr != nil {
+			return 0, serr
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,284 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// countingFS wraps an absfs filesystem and counts the reads and writes
+// issued on the files it opens, standing in for a slow remote backend.
+// Writes fail with errInjected while failWrites is set.
+type countingFS struct {
+	absfs.SymlinkFileSystem
+	reads      atomic.Int64
+	writes     atomic.Int64
+	failWrites atomic.Bool
+}
+
+var errInjected = errors.New("injected failure")
+
+// isInjected reports whether err is errInjected. The prefixing backend
+// rewrites error values, so the message is compared.
+func isInjected(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errInjected.Error())
+}
+
+func (c *countingFS) Open(name string) (absfs.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c *countingFS) Create(name string) (absfs.File, error) {
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (c *countingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.SymlinkFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, fs: c}, nil
+}
+
+type countingFile struct {
+	absfs.File
+	fs *countingFS
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	f.fs.reads.Add(1)
+	return f.File.Read(p)
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.reads.Add(1)
+	return f.File.ReadAt(p, off)
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	f.fs.writes.Add(1)
+	if f.fs.failWrites.Load() {
+		return 0, errInjected
+	}
+	return f.File.Write(p)
+}
+
+func (f *countingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.writes.Add(1)
+	if f.fs.failWrites.Load() {
+		return 0, errInjected
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// newBlockCacheTestFS creates a billyfs filesystem with the block cache
+// enabled over a counting backend
+func newBlockCacheTestFS(t *testing.T, opts billyfs.BlockCacheOptions) (*billyfs.Filesystem, *countingFS, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &countingFS{SymlinkFileSystem: fs}
+
+	bfs, err := billyfs.NewFSWithOptions(counting, tmpDir, billyfs.Options{BlockCache: opts})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+
+	return bfs, counting, tmpDir
+}
+
+// testContent returns n bytes of position-dependent data
+func testContent(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+// TestBlockCacheShared tests that blocks are shared across handles
+func TestBlockCacheShared(t *testing.T) {
+	bfs, counting, _ := newBlockCacheTestFS(t, billyfs.BlockCacheOptions{
+		MaxBytes:  1 << 20,
+		BlockSize: 1024,
+	})
+	data := testContent(10000)
+	writeBillyFile(t, bfs, "pack.bin", data)
+
+	for i := 0; i < 3; i++ {
+		f, err := bfs.Open("pack.bin")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		p := make([]byte, 100)
+		for _, off := range []int64{0, 50, 5000, 9900} {
+			if _, err := f.ReadAt(p, off); err != nil {
+				t.Fatalf("ReadAt(%d) failed: %v", off, err)
+			}
+			if !bytes.Equal(p, data[off:off+100]) {
+				t.Errorf("ReadAt(%d) mismatch", off)
+			}
+		}
+		if n, err := f.ReadAt(p, 9990); n != 10 || err != io.EOF {
+			t.Errorf("expected 10 bytes and io.EOF at end, got %d, %v", n, err)
+		}
+		f.Close()
+	}
+
+	// Blocks 0, 4 and 9 are read once each.
+	if got := counting.reads.Load(); got != 3 {
+		t.Errorf("expected 3 backend reads, got %d", got)
+	}
+	stats := bfs.BlockCacheStats()
+	if stats.Misses != 3 || stats.Hits == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// TestBlockCacheReadahead tests that sequential reads fetch several blocks
+// per backend read
+func TestBlockCacheReadahead(t *testing.T) {
+	bfs, counting, _ := newBlockCacheTestFS(t, billyfs.BlockCacheOptions{
+		MaxBytes:  1 << 20,
+		BlockSize: 1024,
+		Readahead: 3,
+	})
+	data := testContent(16 * 1024)
+	writeBillyFile(t, bfs, "pack.bin", data)
+
+	f, err := bfs.Open("pack.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+	if n := counting.reads.Load(); n != 4 {
+		t.Errorf("expected 4 backend reads of 4 blocks, got %d", n)
+	}
+}
+
+// TestBlockCacheInvalidation tests that writes drop cached blocks
+func TestBlockCacheInvalidation(t *testing.T) {
+	bfs, _, tmpDir := newBlockCacheTestFS(t, billyfs.BlockCacheOptions{
+		MaxBytes:  1 << 20,
+		BlockSize: 16,
+	})
+	writeBillyFile(t, bfs, "file.txt", []byte("hello world"))
+
+	reader, err := bfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+	readAll := func() string {
+		t.Helper()
+		p := make([]byte, 64)
+		n, err := reader.ReadAt(p, 0)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		return string(p[:n])
+	}
+	if got := readAll(); got != "hello world" {
+		t.Fatalf("unexpected content %q", got)
+	}
+
+	// A write through another handle is visible to the reader.
+	w, err := bfs.OpenFile("file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	w.Write([]byte(", again"))
+	if got := readAll(); got != "hello world, again" {
+		t.Errorf("after Write: unexpected content %q", got)
+	}
+	w.Truncate(5)
+	if got := readAll(); got != "hello" {
+		t.Errorf("after Truncate: unexpected content %q", got)
+	}
+	w.Close()
+
+	// Replacing the file through the Filesystem is visible to new handles.
+	writeBillyFile(t, bfs, "other.txt", []byte("replacement"))
+	if err := bfs.Rename("other.txt", "file.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	f, err := bfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if string(got) != "replacement" {
+		t.Errorf("after Rename: unexpected content %q", got)
+	}
+
+	// Changes on the backend alter the file identity seen by new handles.
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("changed outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err = bfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, _ = io.ReadAll(f)
+	f.Close()
+	if string(got) != "changed outside" {
+		t.Errorf("after external change: unexpected content %q", got)
+	}
+}
+
+// TestBlockCacheBudget tests that the memory budget is respected
+func TestBlockCacheBudget(t *testing.T) {
+	bfs, counting, _ := newBlockCacheTestFS(t, billyfs.BlockCacheOptions{
+		MaxBytes:  4096,
+		BlockSize: 1024,
+	})
+	data := testContent(8192)
+	writeBillyFile(t, bfs, "big.bin", data)
+
+	f, err := bfs.Open("big.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+	if stats := bfs.BlockCacheStats(); stats.Evictions != 4 {
+		t.Errorf("expected 4 evictions, got %+v", stats)
+	}
+
+	// The first block was evicted and is read again.
+	before := counting.reads.Load()
+	p := make([]byte, 10)
+	if _, err := f.ReadAt(p, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if counting.reads.Load() != before+1 {
+		t.Error("expected evicted block to be read from the backend")
+	}
+}
@@ -0,0 +1,993 @@
+package billyfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// DefaultCompressionFrameSize is the uncompressed size of the frames files
+// are compressed in when CompressionOptions.FrameSize is zero.
+const DefaultCompressionFrameSize = 64 << 10
+
+const (
+	cmpMagic      = "BFZ1"
+	cmpHeaderSize = len(cmpMagic) + 4
+	cmpIndexEntry = 8 + 4 + 1 + 4
+	cmpFooterSize = 8 + 8 + 4 + len(cmpMagic)
+
+	frameStored  = 0
+	frameDeflate = 1
+)
+
+// ErrCorruptCompressed is returned when a compressed file cannot be decoded.
+var ErrCorruptCompressed = errors.New("billyfs: corrupt compressed file")
+
+// CompressionOptions configures a CompressedFS.
+type CompressionOptions struct {
+	// FrameSize is the uncompressed size of the independently compressed
+	// frames files are split into. Reading at an arbitrary offset only
+	// decompresses the frame containing it. Zero selects
+	// DefaultCompressionFrameSize.
+	FrameSize int
+
+	// Level is the flate compression level. Zero selects
+	// flate.DefaultCompression.
+	Level int
+
+	// Policy decides whether a newly created or truncated file is
+	// compressed. Files it rejects are stored unchanged. Nil selects
+	// DefaultCompressionPolicy.
+	Policy func(name string) bool
+}
+
+var (
+	compressedExts = map[string]bool{
+		".7z": true, ".br": true, ".bz2": true, ".gif": true, ".gz": true,
+		".jpeg": true, ".jpg": true, ".lz4": true, ".mp3": true, ".mp4": true,
+		".png": true, ".tgz": true, ".webp": true, ".xz": true, ".zip": true,
+		".zst": true,
+	}
+	looseObject = regexp.MustCompile(`(^|/)objects/[0-9a-f]{2}/[0-9a-f]{38,62}$`)
+)
+
+// DefaultCompressionPolicy compresses every file except git loose objects,
+// which are zlib compressed already, and files whose extension denotes a
+// compressed format.
+func DefaultCompressionPolicy(name string) bool {
+	if looseObject.MatchString(name) {
+		return false
+	}
+	return !compressedExts[strings.ToLower(path.Ext(name))]
+}
+
+// CompressedFS is a billy.Filesystem that stores file contents compressed
+// on another billy.Filesystem such as a Filesystem.
+//
+// Files are split into frames that are compressed independently and
+// followed by an index of the frame offsets and checksums, so reads at any
+// offset only decompress the frames they touch. Frames that do not shrink are stored
+// uncompressed. Files not selected by the policy, and existing files that
+// are not in the compressed format, are passed through unchanged.
+//
+// Files opened for writing keep the frame being written in memory. Frames
+// that writes have moved past are compressed into a hidden scratch file
+// next to the file, and the file is rewritten from both when closed;
+// errors from the rewrite are returned by Close.
+// Stat, Lstat and ReadDir report uncompressed sizes, which are read from
+// the end of each compressed file.
+type CompressedFS struct {
+	fs        billy.Filesystem
+	frameSize int
+	level     int
+	policy    func(name string) bool
+}
+
+// NewCompressedFS returns a CompressedFS storing its data on fs.
+func NewCompressedFS(fs billy.Filesystem, opts CompressionOptions) (*CompressedFS, error) {
+	if opts.FrameSize < 0 {
+		return nil, errors.New("billyfs: negative compression frame size")
+	}
+	if opts.FrameSize == 0 {
+		opts.FrameSize = DefaultCompressionFrameSize
+	}
+	if opts.Level == 0 {
+		opts.Level = flate.DefaultCompression
+	}
+	if opts.Level < flate.HuffmanOnly || opts.Level > flate.BestCompression {
+		return nil, errors.New("billyfs: invalid compression level")
+	}
+	if opts.Policy == nil {
+		opts.Policy = DefaultCompressionPolicy
+	}
+	return &CompressedFS{
+		fs:        fs,
+		frameSize: opts.FrameSize,
+		level:     opts.Level,
+		policy:    opts.Policy,
+	}, nil
+}
+
+// frameEntry locates a frame in a compressed file.
+type frameEntry struct {
+	offset int64
+	length int
+	method byte
+	crc    uint32
+}
+
+// valid reports whether e lies between the header and the index at end
+// and can hold a frame of n uncompressed bytes.
+func (e frameEntry) valid(end, n int64) bool {
+	if e.offset < int64(cmpHeaderSize) || e.offset > end || int64(e.length) > end-e.offset {
+		return false
+	}
+	switch e.method {
+	case frameStored:
+		return int64(e.length) == n
+	case frameDeflate:
+		return e.length > 0
+	}
+	return false
+}
+
+// compressedIndex is the decoded trailer of a compressed file.
+type compressedIndex struct {
+	frameSize int
+	size      int64
+	frames    []frameEntry
+}
+
+// readIndex decodes the trailer of a file of the given stored size. It
+// reports false if the file is not in the compressed format.
+func readIndex(r io.ReaderAt, size int64) (*compressedIndex, bool, error) {
+	if size < int64(cmpHeaderSize+cmpFooterSize) {
+		return nil, false, nil
+	}
+	header := make([]byte, cmpHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, false, err
+	}
+	footer := make([]byte, cmpFooterSize)
+	if _, err := r.ReadAt(footer, size-int64(cmpFooterSize)); err != nil {
+		return nil, false, err
+	}
+	if string(header[:len(cmpMagic)]) != cmpMagic || string(footer[20:]) != cmpMagic {
+		return nil, false, nil
+	}
+
+	// A raw file may start and end with the magic by chance, so the rest
+	// of the trailer must be consistent with the file before it is trusted.
+	idx := &compressedIndex{
+		frameSize: int(binary.BigEndian.Uint32(header[len(cmpMagic):])),
+		size:      int64(binary.BigEndian.Uint64(footer[8:])),
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer))
+	count := int64(binary.BigEndian.Uint32(footer[16:]))
+	if idx.frameSize <= 0 || idx.size < 0 || indexOffset < int64(cmpHeaderSize) ||
+		indexOffset+count*cmpIndexEntry != size-int64(cmpFooterSize) {
+		return nil, false, nil
+	}
+	if count != (idx.size+int64(idx.frameSize)-1)/int64(idx.frameSize) {
+		return nil, false, nil
+	}
+
+	raw := make([]byte, count*cmpIndexEntry)
+	if _, err := r.ReadAt(raw, indexOffset); err != nil {
+		return nil, true, err
+	}
+	idx.frames = make([]frameEntry, count)
+	for i := range idx.frames {
+		e := raw[i*cmpIndexEntry:]
+		entry := frameEntry{
+			offset: int64(binary.BigEndian.Uint64(e)),
+			length: int(binary.BigEndian.Uint32(e[8:])),
+			method: e[12],
+			crc:    binary.BigEndian.Uint32(e[13:]),
+		}
+		if !entry.valid(indexOffset, idx.frameLen(int64(i))) {
+			return nil, false, nil
+		}
+		idx.frames[i] = entry
+	}
+	return idx, true, nil
+}
+
+// frameLen returns the uncompressed length of frame i.
+func (idx *compressedIndex) frameLen(i int64) int64 {
+	return min(int64(idx.frameSize), idx.size-i*int64(idx.frameSize))
+}
+
+// readFrame returns the uncompressed content of frame i, verified against
+// its checksum.
+func (idx *compressedIndex) readFrame(r io.ReaderAt, i int64) ([]byte, error) {
+	return idx.frames[i].read(r, idx.frameLen(i))
+}
+
+// read returns the want uncompressed bytes of the frame e, verified
+// against its checksum.
+func (e frameEntry) read(r io.ReaderAt, want int64) ([]byte, error) {
+	raw := make([]byte, e.length)
+	if n, err := r.ReadAt(raw, e.offset); n < len(raw) {
+		if err == io.EOF {
+			return nil, ErrCorruptCompressed
+		}
+		return nil, err
+	}
+	var plain []byte
+	switch e.method {
+	case frameStored:
+		plain = raw
+	case frameDeflate:
+		plain = make([]byte, want)
+		zr := flate.NewReader(bytes.NewReader(raw))
+		defer zr.Close()
+		if _, err := io.ReadFull(zr, plain); err != nil {
+			return nil, ErrCorruptCompressed
+		}
+	}
+	if int64(len(plain)) != want || crc32.ChecksumIEEE(plain) != e.crc {
+		return nil, ErrCorruptCompressed
+	}
+	return plain, nil
+}
+
+// storedIndex returns the index of the named file, or nil if it is not
+// compressed.
+func (c *CompressedFS) storedIndex(filename string, info os.FileInfo) (*compressedIndex, error) {
+	if !info.Mode().IsRegular() || info.Size() < int64(cmpHeaderSize+cmpFooterSize) {
+		return nil, nil
+	}
+	f, err := c.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	idx, _, err := readIndex(f, info.Size())
+	return idx, err
+}
+
+// plainInfo converts a FileInfo of the underlying filesystem into one
+// reporting the uncompressed size.
+func (c *CompressedFS) plainInfo(filename string, info os.FileInfo) (os.FileInfo, error) {
+	idx, err := c.storedIndex(filename, info)
+	if err != nil {
+		return nil, err
+	}
+	if idx == nil {
+		return info, nil
+	}
+	return &sizedInfo{FileInfo: info, size: idx.size}, nil
+}
+
+// go-billy Basic interface functions
+
+// Create creates or truncates the named file.
+func (c *CompressedFS) Create(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens the named file for reading.
+func (c *CompressedFS) Open(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the given flags. New and truncated
+// files are compressed if the policy selects them; existing files keep
+// their current format.
+func (c *CompressedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	compress := c.policy(filename)
+	if info, err := c.fs.Stat(filename); err == nil && info.Size() > 0 && (!writable || flag&os.O_TRUNC == 0) {
+		idx, err := c.storedIndex(filename, info)
+		if err != nil {
+			return nil, err
+		}
+		compress = idx != nil
+	}
+	if !compress {
+		return c.fs.OpenFile(filename, flag, perm)
+	}
+
+	uflag := os.O_RDONLY
+	if writable {
+		uflag = flag&(os.O_CREATE|os.O_EXCL|os.O_TRUNC) | os.O_RDWR
+	}
+	file, err := c.fs.OpenFile(filename, uflag, perm)
+	if err != nil {
+		return nil, err
+	}
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	idx, ok, err := readIndex(file, end)
+	if err == nil && !ok && end > 0 {
+		err = ErrCorruptCompressed
+	}
+	if err != nil {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: filename, Err: err}
+	}
+	if idx == nil {
+		idx = &compressedIndex{frameSize: c.frameSize}
+	}
+
+	return &compressedFile{
+		c:        c,
+		f:        file,
+		name:     filename,
+		flag:     flag,
+		perm:     perm,
+		base:     idx,
+		baseSize: idx.size,
+		size:     idx.size,
+		dirty:    make(map[int64][]byte),
+		staged:   make(map[int64]stagedFrame),
+		cached:   -1,
+	}, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (c *CompressedFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := c.fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.plainInfo(filename, info)
+}
+
+// Rename renames oldpath to newpath.
+func (c *CompressedFS) Rename(oldpath, newpath string) error {
+	return c.fs.Rename(oldpath, newpath)
+}
+
+// Remove removes the named file or empty directory.
+func (c *CompressedFS) Remove(filename string) error {
+	return c.fs.Remove(filename)
+}
+
+// Join joins any number of path elements into a single path.
+func (c *CompressedFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// go-billy TempFile interface functions
+
+// TempFile creates a new temporary file in dir with a name beginning with
+// prefix.
+func (c *CompressedFS) TempFile(dir, prefix string) (billy.File, error) {
+	initRNG()
+	for {
+		name := path.Join(dir, prefix+"_"+randSeq(5))
+		f, err := c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// go-billy Dir interface functions
+
+// ReadDir reads the directory named by dirname and returns its entries with
+// uncompressed sizes.
+func (c *CompressedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	infos, err := c.fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if infos[i], err = c.plainInfo(path.Join(dirname, info.Name()), info); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (c *CompressedFS) MkdirAll(filename string, perm os.FileMode) error {
+	return c.fs.MkdirAll(filename, perm)
+}
+
+// go-billy Symlink interface functions
+
+// Lstat returns a FileInfo describing the named file without following
+// symlinks.
+func (c *CompressedFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := c.fs.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.plainInfo(filename, info)
+}
+
+// Symlink creates link as a symbolic link to target.
+func (c *CompressedFS) Symlink(target, link string) error {
+	return c.fs.Symlink(target, link)
+}
+
+// Readlink returns the target of link.
+func (c *CompressedFS) Readlink(link string) (string, error) {
+	return c.fs.Readlink(link)
+}
+
+// go-billy Chroot interface functions
+
+// Chroot returns a CompressedFS with the same options rooted at path.
+func (c *CompressedFS) Chroot(path string) (billy.Filesystem, error) {
+	fs, err := c.fs.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	sub := *c
+	sub.fs = fs
+	return &sub, nil
+}
+
+// Root returns the root path of the underlying filesystem.
+func (c *CompressedFS) Root() string {
+	return c.fs.Root()
+}
+
+// go-billy Capabilities interface
+
+// Capabilities returns the capabilities of the underlying filesystem.
+func (c *CompressedFS) Capabilities() billy.Capability {
+	return billy.Capabilities(c.fs)
+}
+
+// go-billy Change interface functions
+
+func (c *CompressedFS) change() (billy.Change, error) {
+	if ch, ok := c.fs.(billy.Change); ok {
+		return ch, nil
+	}
+	return nil, billy.ErrNotSupported
+}
+
+// Chmod changes the mode of the named file.
+func (c *CompressedFS) Chmod(name string, mode os.FileMode) error {
+	ch, err := c.change()
+	if err != nil {
+		return err
+	}
+	return ch.Chmod(name, mode)
+}
+
+// Lchown changes the owner of the named file without following symlinks.
+func (c *CompressedFS) Lchown(name string, uid, gid int) error {
+	ch, err := c.change()
+	if err != nil {
+		return err
+	}
+	return ch.Lchown(name, uid, gid)
+}
+
+// Chown changes the owner of the named file.
+func (c *CompressedFS) Chown(name string, uid, gid int) error {
+	ch, err := c.change()
+	if err != nil {
+		return err
+	}
+	return ch.Chown(name, uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (c *CompressedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	ch, err := c.change()
+	if err != nil {
+		return err
+	}
+	return ch.Chtimes(name, atime, mtime)
+}
+
+// compressedFile implements billy.File for a compressed file. Reads are
+// served from modified frames held in memory, or else from the stored file.
+type compressedFile struct {
+	c    *CompressedFS
+	f    billy.File
+	name string
+	flag int
+	perm os.FileMode
+
+	mu sync.Mutex
+	// base is the index of the stored file; only its first baseSize bytes
+	// are still part of the content after truncation.
+	base     *compressedIndex
+	baseSize int64
+	size     int64
+	pos      int64
+	dirty    map[int64][]byte
+	modified bool
+	closed   bool
+
+	// staged holds the frames writes have moved past, compressed into a
+	// scratch file next to the file, so that only the frame being written
+	// is kept in dirty.
+	staged      map[int64]stagedFrame
+	scratch     billy.File
+	scratchName string
+	scratchEnd  int64
+	zw          *flate.Writer
+	zbuf        bytes.Buffer
+
+	// cached holds the last frame read from the stored file.
+	cached      int64
+	cachedFrame []byte
+}
+
+// stagedFrame locates a frame of size uncompressed bytes in the scratch
+// file.
+type stagedFrame struct {
+	frameEntry
+	size int64
+}
+
+func (f *compressedFile) frameSize() int64 {
+	return int64(f.base.frameSize)
+}
+
+// frame returns the current content of frame i, which must lie within the
+// file. The result must not be modified unless it is a dirty frame.
+func (f *compressedFile) frame(i int64) ([]byte, error) {
+	if p, ok := f.dirty[i]; ok {
+		return p, nil
+	}
+	fs := f.frameSize()
+	n := min(fs, f.size-i*fs)
+	start := i * fs
+	e, staged := f.staged[i]
+	if !staged && start >= f.baseSize {
+		return make([]byte, n), nil
+	}
+
+	if f.cached != i {
+		var plain []byte
+		var err error
+		if staged {
+			plain, err = e.read(f.scratch, e.size)
+		} else {
+			plain, err = f.base.readFrame(f.f, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.cached, f.cachedFrame = i, plain
+	}
+	plain := f.cachedFrame
+	if valid := f.baseSize - start; !staged && valid < int64(len(plain)) {
+		plain = plain[:valid]
+	}
+	if int64(len(plain)) == n {
+		return plain, nil
+	}
+	out := make([]byte, n)
+	copy(out, plain)
+	return out, nil
+}
+
+func (f *compressedFile) Name() string {
+	return f.name
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *compressedFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	fs := f.frameSize()
+	n := 0
+	for n < len(p) && off < f.size {
+		i := off / fs
+		plain, err := f.frame(i)
+		if err != nil {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		c := copy(p[n:], plain[off-i*fs:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *compressedFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = f.size
+	}
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *compressedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *compressedFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	fs := f.frameSize()
+	end := off + int64(len(p))
+	if end > f.size {
+		if err := f.grow(end); err != nil {
+			return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+	}
+	first, last := off/fs, (end-1)/fs
+	for i := range f.dirty {
+		if i < first || i > last {
+			if err := f.stage(i); err != nil {
+				return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+			}
+		}
+	}
+	for i := first; i <= last; i++ {
+		buf, err := f.dirtyFrame(i)
+		if err != nil {
+			return int(max(i*fs-off, 0)), &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		start := i * fs
+		lo, hi := max(start, off), min(start+int64(len(buf)), end)
+		copy(buf[lo-start:], p[lo-off:hi-off])
+		f.modified = true
+		if i < last {
+			if err := f.stage(i); err != nil {
+				return int(hi - off), &os.PathError{Op: "write", Path: f.name, Err: err}
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// stage compresses the dirty frame i into the scratch file. The space of
+// a frame staged before is reused if the new data fits.
+func (f *compressedFile) stage(i int64) error {
+	plain := f.dirty[i]
+	if f.scratch == nil {
+		scratch, name, err := f.createTemp(".bfz-scratch-", 0600)
+		if err != nil {
+			return err
+		}
+		f.scratch, f.scratchName = scratch, name
+	}
+	e, data, err := f.encode(plain)
+	if err != nil {
+		return err
+	}
+
+	old, ok := f.staged[i]
+	w, canReuse := f.scratch.(io.WriterAt)
+	if ok && canReuse && e.length <= old.length {
+		e.offset = old.offset
+		_, err = w.WriteAt(data, e.offset)
+	} else {
+		e.offset = f.scratchEnd
+		if _, err = f.scratch.Seek(e.offset, io.SeekStart); err == nil {
+			_, err = f.scratch.Write(data)
+		}
+		f.scratchEnd += int64(len(data))
+	}
+	if err != nil {
+		return err
+	}
+	f.staged[i] = stagedFrame{frameEntry: e, size: int64(len(plain))}
+	delete(f.dirty, i)
+	if f.cached == i {
+		f.cached = -1
+	}
+	return nil
+}
+
+// encode compresses plain into a frame, which is stored uncompressed if
+// it does not shrink. The returned data is only valid until the next call.
+func (f *compressedFile) encode(plain []byte) (frameEntry, []byte, error) {
+	f.zbuf.Reset()
+	if f.zw == nil {
+		zw, err := flate.NewWriter(&f.zbuf, f.c.level)
+		if err != nil {
+			return frameEntry{}, nil, err
+		}
+		f.zw = zw
+	} else {
+		f.zw.Reset(&f.zbuf)
+	}
+	if _, err := f.zw.Write(plain); err != nil {
+		return frameEntry{}, nil, err
+	}
+	if err := f.zw.Close(); err != nil {
+		return frameEntry{}, nil, err
+	}
+
+	e := frameEntry{method: frameDeflate, crc: crc32.ChecksumIEEE(plain)}
+	data := f.zbuf.Bytes()
+	if len(data) >= len(plain) {
+		e.method, data = frameStored, plain
+	}
+	e.length = len(data)
+	return e, data, nil
+}
+
+// dirtyFrame returns a modifiable copy of frame i, recording it as dirty.
+func (f *compressedFile) dirtyFrame(i int64) ([]byte, error) {
+	if p, ok := f.dirty[i]; ok {
+		return p, nil
+	}
+	plain, err := f.frame(i)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(plain))
+	copy(buf, plain)
+	f.dirty[i] = buf
+	return buf, nil
+}
+
+// grow extends the file with zeros to size. The previous last frame is
+// padded in memory so that its length stays consistent with the new size.
+func (f *compressedFile) grow(size int64) error {
+	fs := f.frameSize()
+	if f.size > 0 {
+		last := (f.size - 1) / fs
+		if f.size%fs != 0 {
+			buf, err := f.dirtyFrame(last)
+			if err != nil {
+				return err
+			}
+			n := min(fs, size-last*fs)
+			f.dirty[last] = append(buf, make([]byte, n-int64(len(buf)))...)
+		}
+	}
+	f.size = size
+	return nil
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *compressedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size == f.size {
+		return nil
+	}
+	if size > f.size {
+		if err := f.grow(size); err != nil {
+			return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+		}
+		f.modified = true
+		return nil
+	}
+
+	fs := f.frameSize()
+	for i, e := range f.staged {
+		switch start := i * fs; {
+		case start >= size:
+			delete(f.staged, i)
+		case start+e.size > size:
+			if _, err := f.dirtyFrame(i); err != nil {
+				return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+			}
+			delete(f.staged, i)
+		}
+	}
+	f.cached = -1
+	for i, buf := range f.dirty {
+		switch start := i * fs; {
+		case start >= size:
+			delete(f.dirty, i)
+		case start+int64(len(buf)) > size:
+			f.dirty[i] = buf[:size-start]
+		}
+	}
+	f.baseSize = min(f.baseSize, size)
+	f.size = size
+	f.modified = true
+	return nil
+}
+
+// Close writes the modified content to a new compressed file and renames
+// it over the original.
+func (f *compressedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	if !f.modified {
+		return f.f.Close()
+	}
+	err := f.rewrite()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	if f.scratch != nil {
+		f.scratch.Close()
+		f.c.fs.Remove(f.scratchName)
+	}
+	if err != nil {
+		return &os.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// rewrite stores the current content in compressed form next to the
+// original and replaces it.
+func (f *compressedFile) rewrite() error {
+	perm := f.perm
+	if info, err := f.c.fs.Stat(f.name); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, tmpName, err := f.createTemp(".bfz-", perm)
+	if err != nil {
+		return err
+	}
+	err = f.writeTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.c.fs.Rename(tmpName, f.name)
+	}
+	if err != nil {
+		f.c.fs.Remove(tmpName)
+	}
+	return err
+}
+
+// createTemp creates a new hidden file next to the file, named after it
+// with the given infix.
+func (f *compressedFile) createTemp(infix string, perm os.FileMode) (billy.File, string, error) {
+	initRNG()
+	for {
+		name := path.Join(path.Dir(f.name), "."+path.Base(f.name)+infix+randSeq(6))
+		tmp, err := f.c.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return tmp, name, err
+	}
+}
+
+// writeTo writes the compressed representation of the file to w.
+func (f *compressedFile) writeTo(w io.Writer) error {
+	if f.size == 0 {
+		return nil
+	}
+
+	header := make([]byte, cmpHeaderSize)
+	copy(header, cmpMagic)
+	binary.BigEndian.PutUint32(header[len(cmpMagic):], uint32(f.frameSize()))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	count := (f.size + f.frameSize() - 1) / f.frameSize()
+	index := make([]byte, 0, count*cmpIndexEntry)
+	offset := int64(cmpHeaderSize)
+	for i := int64(0); i < count; i++ {
+		var e frameEntry
+		var data []byte
+		_, dirty := f.dirty[i]
+		if s, ok := f.staged[i]; ok && !dirty && s.size == min(f.frameSize(), f.size-i*f.frameSize()) {
+			// Staged frames are copied without decompressing them.
+			e, data = s.frameEntry, make([]byte, s.length)
+			if n, err := f.scratch.ReadAt(data, s.offset); n < len(data) {
+				return err
+			}
+		} else {
+			plain, err := f.frame(i)
+			if err != nil {
+				return err
+			}
+			if e, data, err = f.encode(plain); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		index = binary.BigEndian.AppendUint64(index, uint64(offset))
+		index = binary.BigEndian.AppendUint32(index, uint32(len(data)))
+		index = append(index, e.method)
+		index = binary.BigEndian.AppendUint32(index, e.crc)
+		offset += int64(len(data))
+	}
+
+	footer := make([]byte, 0, cmpFooterSize)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(offset))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(f.size))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(count))
+	footer = append(footer, cmpMagic...)
+	if _, err := w.Write(index); err != nil {
+		return err
+	}
+	_, err := w.Write(footer)
+	return err
+}
+
+func (f *compressedFile) Lock() error {
+	return f.f.Lock()
+}
+
+func (f *compressedFile) Unlock() error {
+	return f.f.Unlock()
+}
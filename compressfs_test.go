@@ -0,0 +1,321 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// newCompressedTestFS creates a CompressedFS over a temporary billyfs
+// filesystem
+func newCompressedTestFS(t *testing.T, opts billyfs.CompressionOptions) (*billyfs.CompressedFS, string) {
+	t.Helper()
+	bfs, tmpDir := newTestFS(t)
+	cfs, err := billyfs.NewCompressedFS(bfs, opts)
+	if err != nil {
+		t.Fatalf("NewCompressedFS failed: %v", err)
+	}
+	return cfs, tmpDir
+}
+
+// writeBillyFile creates name on fs with the given content
+func writeBillyFile(t *testing.T, fs billy.Filesystem, name string, data []byte) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// TestCompressedRoundTrip tests that contents are stored compressed and
+// sizes are reported uncompressed
+func TestCompressedRoundTrip(t *testing.T) {
+	cfs, tmpDir := newCompressedTestFS(t, billyfs.CompressionOptions{FrameSize: 1024})
+
+	data := []byte(strings.Repeat("package main // repeated worktree content\n", 1000))
+	writeBillyFile(t, cfs, "main.go", data)
+
+	raw, err := os.Stat(filepath.Join(tmpDir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Size() >= int64(len(data))/4 {
+		t.Errorf("expected stored size well below %d, got %d", len(data), raw.Size())
+	}
+
+	info, err := cfs.Stat("main.go")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), info.Size())
+	}
+	infos, err := cfs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Size() != int64(len(data)) {
+		t.Errorf("expected ReadDir to report size %d", len(data))
+	}
+
+	f, err := cfs.Open("main.go")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+
+	p := make([]byte, 100)
+	for _, off := range []int64{0, 1000, 1020, 20000, int64(len(data)) - 100} {
+		if _, err := f.ReadAt(p, off); err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+		if !bytes.Equal(p, data[off:off+100]) {
+			t.Errorf("ReadAt(%d) mismatch", off)
+		}
+	}
+	if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	tail, _ := io.ReadAll(f)
+	if !bytes.Equal(tail, data[len(data)-10:]) {
+		t.Error("tail mismatch after Seek")
+	}
+}
+
+// TestCompressedRandomAccess compares random modifications across reopens
+// against an in-memory model
+func TestCompressedRandomAccess(t *testing.T) {
+	cfs, _ := newCompressedTestFS(t, billyfs.CompressionOptions{FrameSize: 32})
+
+	rng := rand.New(rand.NewSource(1))
+	var model []byte
+	for round := 0; round < 20; round++ {
+		f, err := cfs.OpenFile("data.bin", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		w := f.(io.WriterAt)
+		for i := 0; i < 20; i++ {
+			switch rng.Intn(3) {
+			case 0:
+				off := rng.Int63n(int64(len(model)) + 50)
+				p := bytes.Repeat([]byte{byte(rng.Intn(4))}, 1+rng.Intn(80))
+				if _, err := w.WriteAt(p, off); err != nil {
+					t.Fatalf("WriteAt failed: %v", err)
+				}
+				if end := off + int64(len(p)); end > int64(len(model)) {
+					model = append(model, make([]byte, end-int64(len(model)))...)
+				}
+				copy(model[off:], p)
+			case 1:
+				size := rng.Int63n(int64(len(model)) + 50)
+				if err := f.Truncate(size); err != nil {
+					t.Fatalf("Truncate failed: %v", err)
+				}
+				if size > int64(len(model)) {
+					model = append(model, make([]byte, size-int64(len(model)))...)
+				}
+				model = model[:size]
+			case 2:
+				got := make([]byte, len(model))
+				if _, err := f.ReadAt(got, 0); err != nil && err != io.EOF {
+					t.Fatalf("ReadAt failed: %v", err)
+				}
+				if !bytes.Equal(got, model) {
+					t.Fatalf("round %d step %d: content mismatch before close", round, i)
+				}
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		f, err = cfs.Open("data.bin")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if !bytes.Equal(got, model) {
+			t.Fatalf("round %d: content mismatch after reopen", round)
+		}
+	}
+}
+
+// TestCompressedPolicy tests that rejected and foreign files are stored
+// unchanged
+func TestCompressedPolicy(t *testing.T) {
+	cfs, tmpDir := newCompressedTestFS(t, billyfs.CompressionOptions{})
+	data := []byte(strings.Repeat("a", 4096))
+
+	for _, name := range []string{"archive.gz", "objects/ab/" + strings.Repeat("c", 38)} {
+		if err := cfs.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeBillyFile(t, cfs, name, data)
+		raw, err := os.ReadFile(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Errorf("%s: expected file to be stored unchanged", name)
+		}
+	}
+
+	// A pre-existing plain file keeps its format when modified.
+	if err := os.WriteFile(filepath.Join(tmpDir, "plain.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("plain.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte("b"))
+	f.Close()
+	raw, err := os.ReadFile(filepath.Join(tmpDir, "plain.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, append(data, 'b')) {
+		t.Error("expected plain file to stay uncompressed")
+	}
+
+	custom, err := billyfs.NewCompressedFS(cfs, billyfs.CompressionOptions{
+		Policy: func(name string) bool { return strings.HasSuffix(name, ".pack") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBillyFile(t, custom, "objects.pack", data)
+	if info, _ := os.Stat(filepath.Join(tmpDir, "objects.pack")); info.Size() >= int64(len(data)) {
+		t.Error("expected custom policy to compress .pack file")
+	}
+}
+
+// TestCompressedCorruption tests that damaged frames are reported
+func TestCompressedCorruption(t *testing.T) {
+	cfs, tmpDir := newCompressedTestFS(t, billyfs.CompressionOptions{FrameSize: 64})
+	writeBillyFile(t, cfs, "file.txt", []byte(strings.Repeat("compressible ", 100)))
+
+	raw := filepath.Join(tmpDir, "file.txt")
+	data, err := os.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 8; i < 20; i++ {
+		data[i] ^= 0xff
+	}
+	if err := os.WriteFile(raw, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := cfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := io.ReadAll(f); err == nil {
+		t.Error("expected error reading corrupted frame")
+	}
+}
+
+// TestCompressedStaging tests that frames written past are staged in a
+// scratch file that is removed on close
+func TestCompressedStaging(t *testing.T) {
+	cfs, tmpDir := newCompressedTestFS(t, billyfs.CompressionOptions{FrameSize: 64})
+
+	f, err := cfs.Create("big.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	var want []byte
+	for i := 0; i < 100; i++ {
+		line := []byte(strings.Repeat(string(rune('a'+i%26)), 40))
+		want = append(want, line...)
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(tmpDir, ".big.txt.bfz-scratch-*"))
+	if len(matches) != 1 {
+		t.Fatalf("expected a scratch file while writing, got %v", matches)
+	}
+
+	// Rewrite a staged frame and read everything back before closing.
+	if _, err := f.(io.WriterAt).WriteAt([]byte("XYZ"), 70); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(want[70:], "XYZ")
+	got := make([]byte, len(want))
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("content mismatch before close")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	matches, _ = filepath.Glob(filepath.Join(tmpDir, ".big.txt.bfz-*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files left after close: %v", matches)
+	}
+	f, err = cfs.Open("big.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("content mismatch after reopen: %v", err)
+	}
+}
+
+// TestCompressedMagicCollision tests that a raw file that merely starts
+// and ends with the magic is not read as compressed
+func TestCompressedMagicCollision(t *testing.T) {
+	cfs, tmpDir := newCompressedTestFS(t, billyfs.CompressionOptions{})
+
+	data := []byte("BFZ1" + strings.Repeat("raw data ", 10) + "BFZ1")
+	if err := os.WriteFile(filepath.Join(tmpDir, "raw.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfs.Stat("raw.bin")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), info.Size())
+	}
+	f, err := cfs.Open("raw.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("expected raw content, got %q, %v", got, err)
+	}
+}
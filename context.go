@@ -0,0 +1,421 @@
+package billyfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// WithContext returns a view of f whose operations are bound to ctx. Every
+// method of the view and of the Files it opens checks ctx before calling the
+// backend and fails with a *fs.PathError wrapping context.Canceled or
+// context.DeadlineExceeded once ctx is done. When ctx is done, all Files
+// opened through the view that are still open are closed, which releases
+// their backend resources and makes further I/O on them fail.
+//
+// Operations already in progress in the backend when ctx is done are not
+// interrupted; a File is closed once the calls in progress on it return.
+func (f *Filesystem) WithContext(ctx context.Context) billy.Filesystem {
+	t := &ctxTracker{ctx: ctx, files: make(map[*ctxFile]struct{})}
+	return &ctxFS{fs: f, ctx: ctx, tracker: t}
+}
+
+// ctxTracker records the open Files of a context view so they can be
+// closed on cancellation.
+type ctxTracker struct {
+	ctx   context.Context
+	mu    sync.Mutex
+	files map[*ctxFile]struct{}
+	done  bool
+
+	// stop unregisters closeAll from ctx. closeAll is only registered
+	// while files are tracked, so that views outliving their files do
+	// not keep it registered.
+	stop func() bool
+}
+
+// add registers file and reports false if the context is already done.
+func (t *ctxTracker) add(file *ctxFile) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done || t.ctx.Err() != nil {
+		return false
+	}
+	if t.stop == nil {
+		t.stop = context.AfterFunc(t.ctx, t.closeAll)
+	}
+	t.files[file] = struct{}{}
+	return true
+}
+
+func (t *ctxTracker) remove(file *ctxFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.files, file)
+	if len(t.files) == 0 && t.stop != nil {
+		t.stop()
+		t.stop = nil
+	}
+}
+
+// closeAll cancels the tracked files concurrently, so that a call in
+// progress on one of them does not delay closing the others.
+func (t *ctxTracker) closeAll() {
+	t.mu.Lock()
+	files := t.files
+	t.files = nil
+	t.stop = nil
+	t.done = true
+	t.mu.Unlock()
+	for file := range files {
+		go file.cancel()
+	}
+}
+
+// ctxFS is the billy.Filesystem returned by Filesystem.WithContext.
+type ctxFS struct {
+	fs      *Filesystem
+	ctx     context.Context
+	tracker *ctxTracker
+}
+
+// check returns a *fs.PathError for op on name if the context is done.
+func (c *ctxFS) check(op, name string) error {
+	if err := c.ctx.Err(); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// track wraps file and registers it for closing on cancellation.
+func (c *ctxFS) track(op, name string, file billy.File) (billy.File, error) {
+	cf := &ctxFile{f: file, ctx: c.ctx, tracker: c.tracker}
+	if !c.tracker.add(cf) {
+		file.Close()
+		return nil, c.check(op, name)
+	}
+	return cf, nil
+}
+
+// go-billy Basic interface functions
+
+func (c *ctxFS) Create(filename string) (billy.File, error) {
+	if err := c.check("open", filename); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.track("open", filename, file)
+}
+
+func (c *ctxFS) Open(filename string) (billy.File, error) {
+	if err := c.check("open", filename); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.track("open", filename, file)
+}
+
+func (c *ctxFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if err := c.check("open", filename); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return c.track("open", filename, file)
+}
+
+func (c *ctxFS) Stat(filename string) (os.FileInfo, error) {
+	if err := c.check("stat", filename); err != nil {
+		return nil, err
+	}
+	return c.fs.Stat(filename)
+}
+
+func (c *ctxFS) Rename(oldpath, newpath string) error {
+	if err := c.check("rename", oldpath); err != nil {
+		return err
+	}
+	return c.fs.Rename(oldpath, newpath)
+}
+
+func (c *ctxFS) Remove(filename string) error {
+	if err := c.check("remove", filename); err != nil {
+		return err
+	}
+	return c.fs.Remove(filename)
+}
+
+func (c *ctxFS) Join(elem ...string) string {
+	return c.fs.Join(elem...)
+}
+
+// go-billy TempFile interface functions
+
+func (c *ctxFS) TempFile(dir, prefix string) (billy.File, error) {
+	if err := c.check("tempfile", dir); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return c.track("tempfile", dir, file)
+}
+
+// go-billy Dir interface functions
+
+func (c *ctxFS) ReadDir(path string) ([]os.FileInfo, error) {
+	if err := c.check("readdir", path); err != nil {
+		return nil, err
+	}
+	return c.fs.ReadDir(path)
+}
+
+func (c *ctxFS) MkdirAll(filename string, perm os.FileMode) error {
+	if err := c.check("mkdir", filename); err != nil {
+		return err
+	}
+	return c.fs.MkdirAll(filename, perm)
+}
+
+// go-billy Symlink interface functions
+
+func (c *ctxFS) Lstat(filename string) (os.FileInfo, error) {
+	if err := c.check("lstat", filename); err != nil {
+		return nil, err
+	}
+	return c.fs.Lstat(filename)
+}
+
+func (c *ctxFS) Symlink(target, link string) error {
+	if err := c.check("symlink", link); err != nil {
+		return err
+	}
+	return c.fs.Symlink(target, link)
+}
+
+func (c *ctxFS) Readlink(link string) (string, error) {
+	if err := c.check("readlink", link); err != nil {
+		return "", err
+	}
+	return c.fs.Readlink(link)
+}
+
+// go-billy Chroot interface functions
+
+// Chroot returns a view of the chrooted filesystem bound to the same
+// context. Files opened through it are closed on cancellation as well.
+func (c *ctxFS) Chroot(path string) (billy.Filesystem, error) {
+	if err := c.check("chroot", path); err != nil {
+		return nil, err
+	}
+	sub, err := c.fs.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxFS{fs: sub.(*Filesystem), ctx: c.ctx, tracker: c.tracker}, nil
+}
+
+func (c *ctxFS) Root() string {
+	return c.fs.Root()
+}
+
+// go-billy Capabilities interface
+
+func (c *ctxFS) Capabilities() billy.Capability {
+	return c.fs.Capabilities()
+}
+
+// go-billy Change interface functions
+
+func (c *ctxFS) Chmod(name string, mode os.FileMode) error {
+	if err := c.check("chmod", name); err != nil {
+		return err
+	}
+	return c.fs.Chmod(name, mode)
+}
+
+func (c *ctxFS) Lchown(name string, uid, gid int) error {
+	if err := c.check("lchown", name); err != nil {
+		return err
+	}
+	return c.fs.Lchown(name, uid, gid)
+}
+
+func (c *ctxFS) Chown(name string, uid, gid int) error {
+	if err := c.check("chown", name); err != nil {
+		return err
+	}
+	return c.fs.Chown(name, uid, gid)
+}
+
+func (c *ctxFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := c.check("chtimes", name); err != nil {
+		return err
+	}
+	return c.fs.Chtimes(name, atime, mtime)
+}
+
+// ctxFile is a billy.File opened through a context view.
+type ctxFile struct {
+	f       billy.File
+	ctx     context.Context
+	tracker *ctxTracker
+
+	// inflight is held for reading by the calls in progress on f, which
+	// cancel waits for before closing the underlying file.
+	inflight sync.RWMutex
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// check returns a *fs.PathError for op if the context is done.
+func (f *ctxFile) check(op string) error {
+	if err := f.ctx.Err(); err != nil {
+		return &fs.PathError{Op: op, Path: f.f.Name(), Err: err}
+	}
+	return nil
+}
+
+// begin checks the context for op and registers a call in progress, which
+// the caller ends with f.inflight.RUnlock if begin succeeds.
+func (f *ctxFile) begin(op string) error {
+	f.inflight.RLock()
+	if err := f.check(op); err != nil {
+		f.inflight.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// cancel closes the underlying file on behalf of the context once the
+// calls in progress return.
+func (f *ctxFile) cancel() {
+	f.inflight.Lock()
+	defer f.inflight.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		f.f.Close()
+	}
+}
+
+func (f *ctxFile) Name() string {
+	return f.f.Name()
+}
+
+func (f *ctxFile) Write(p []byte) (int, error) {
+	if err := f.begin("write"); err != nil {
+		return 0, err
+	}
+	defer f.inflight.RUnlock()
+	return f.f.Write(p)
+}
+
+func (f *ctxFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.begin("write"); err != nil {
+		return 0, err
+	}
+	defer f.inflight.RUnlock()
+	if w, ok := f.f.(io.WriterAt); ok {
+		return w.WriteAt(p, off)
+	}
+	return 0, &fs.PathError{Op: "write", Path: f.f.Name(), Err: billy.ErrNotSupported}
+}
+
+func (f *ctxFile) Read(p []byte) (int, error) {
+	if err := f.begin("read"); err != nil {
+		return 0, err
+	}
+	defer f.inflight.RUnlock()
+	return f.f.Read(p)
+}
+
+func (f *ctxFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.begin("read"); err != nil {
+		return 0, err
+	}
+	defer f.inflight.RUnlock()
+	return f.f.ReadAt(p, off)
+}
+
+func (f *ctxFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.begin("seek"); err != nil {
+		return 0, err
+	}
+	defer f.inflight.RUnlock()
+	return f.f.Seek(offset, whence)
+}
+
+// Close closes the file. Once the context is done it still releases the
+// underlying file but returns the context error.
+func (f *ctxFile) Close() error {
+	f.tracker.remove(f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	wasClosed := f.closed
+	if !wasClosed {
+		f.closed = true
+		if err := f.f.Close(); err != nil && f.ctx.Err() == nil {
+			return err
+		}
+	}
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	if wasClosed {
+		return &fs.PathError{Op: "close", Path: f.f.Name(), Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// Lock locks the file. It does not hold up cancellation while it waits for
+// the lock.
+func (f *ctxFile) Lock() error {
+	if err := f.check("lock"); err != nil {
+		return err
+	}
+	return f.f.Lock()
+}
+
+// Unlock unlocks the file even if the context is done, so that locks taken
+// before cancellation can be released.
+func (f *ctxFile) Unlock() error {
+	return f.f.Unlock()
+}
+
+func (f *ctxFile) Truncate(size int64) error {
+	if err := f.begin("truncate"); err != nil {
+		return err
+	}
+	defer f.inflight.RUnlock()
+	return f.f.Truncate(size)
+}
+
+// Sync commits the contents of the file to stable storage if the
+// underlying file supports it.
+func (f *ctxFile) Sync() error {
+	if err := f.begin("sync"); err != nil {
+		return err
+	}
+	defer f.inflight.RUnlock()
+	if s, ok := f.f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return &fs.PathError{Op: "sync", Path: f.f.Name(), Err: billy.ErrNotSupported}
+}
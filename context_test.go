@@ -0,0 +1,328 @@
+package billyfs_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// TestWithContextCanceled tests that operations fail after cancellation
+func TestWithContextCanceled(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cfs := bfs.WithContext(ctx)
+
+	f, err := cfs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	cancel()
+
+	var pathErr *fs.PathError
+	_, err = cfs.Stat("file.txt")
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &pathErr) {
+		t.Errorf("expected *fs.PathError wrapping context.Canceled, got %v", err)
+	}
+	if pathErr != nil && (pathErr.Op != "stat" || pathErr.Path != "file.txt") {
+		t.Errorf("unexpected path error %+v", pathErr)
+	}
+
+	if _, err := cfs.Open("file.txt"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Open to fail with context.Canceled, got %v", err)
+	}
+	if err := cfs.MkdirAll("dir", 0755); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected MkdirAll to fail with context.Canceled, got %v", err)
+	}
+	if _, err := f.Write([]byte("more")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Write to fail with context.Canceled, got %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Close to report context.Canceled, got %v", err)
+	}
+
+	// The original filesystem is unaffected.
+	info, err := bfs.Stat("file.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != 4 {
+		t.Errorf("expected size 4, got %d", info.Size())
+	}
+}
+
+// TestWithContextClosesHandles tests that open files are closed on
+// cancellation
+func TestWithContextClosesHandles(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cfs := bfs.WithContext(ctx)
+
+	if err := bfs.MkdirAll("sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	sub, err := cfs.Chroot("sub")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	f, err := sub.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	underlying, err := bfs.Open("sub/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer underlying.Close()
+
+	cancel()
+
+	// Wait for the cancellation callback to close the handle.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := f.Seek(0, 0)
+		if errors.Is(err, context.Canceled) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handle not closed after cancellation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestWithContextDeadline tests that deadlines are reported
+func TestWithContextDeadline(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	cfs := bfs.WithContext(ctx)
+	if _, err := cfs.Create("file.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := bfs.Stat("file.txt"); err == nil {
+		t.Error("expected no file to be created")
+	}
+}
+
+// TestWithContextActive tests normal operation with a live context
+func TestWithContextActive(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	cfs := bfs.WithContext(context.Background())
+
+	f, err := cfs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := cfs.Rename("file.txt", "renamed.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	infos, err := cfs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "renamed.txt" {
+		t.Errorf("unexpected ReadDir result %v", infos)
+	}
+}
+
+// blockingFS wraps an absfs filesystem whose files block writes of the
+// contents "block" until release is closed, and logs the end of writes and
+// closes
+type blockingFS struct {
+	absfs.SymlinkFileSystem
+	started chan struct{}
+	release chan struct{}
+
+	mu  sync.Mutex
+	log []string
+}
+
+func (b *blockingFS) record(entry string) {
+	b.mu.Lock()
+	b.log = append(b.log, entry)
+	b.mu.Unlock()
+}
+
+func (b *blockingFS) entries() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.log...)
+}
+
+func (b *blockingFS) Create(name string) (absfs.File, error) {
+	return b.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (b *blockingFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := b.SymlinkFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingFile{File: f, fs: b}, nil
+}
+
+type blockingFile struct {
+	absfs.File
+	fs *blockingFS
+}
+
+func (f *blockingFile) wait(p []byte) {
+	if string(p) == "block" {
+		close(f.fs.started)
+		<-f.fs.release
+	}
+}
+
+func (f *blockingFile) Write(p []byte) (int, error) {
+	f.wait(p)
+	n, err := f.File.Write(p)
+	f.fs.record("write")
+	return n, err
+}
+
+func (f *blockingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.wait(p)
+	n, err := f.File.WriteAt(p, off)
+	f.fs.record("write")
+	return n, err
+}
+
+func (f *blockingFile) Close() error {
+	f.fs.record("close")
+	return f.File.Close()
+}
+
+// TestWithContextCancelDuringWrite tests that cancellation waits for a
+// write in progress before closing the file
+func TestWithContextCancelDuringWrite(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	backend := &blockingFS{SymlinkFileSystem: fs, started: make(chan struct{}), release: make(chan struct{})}
+	bfs, err := billyfs.NewFSWithOptions(backend, t.TempDir(), billyfs.Options{WriteBufferSize: 4})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cfs := bfs.WithContext(ctx)
+
+	f, err := cfs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := f.Write([]byte("block"))
+		done <- err
+	}()
+	<-backend.started
+	cancel()
+
+	// Give the cancellation callback the opportunity to close the file.
+	time.Sleep(50 * time.Millisecond)
+	for _, entry := range backend.entries() {
+		if entry == "close" {
+			t.Fatal("file closed during a write")
+		}
+	}
+
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		log := backend.entries()
+		if n := len(log); n > 0 && log[n-1] == "close" {
+			if log[n-2] != "write" {
+				t.Errorf("unexpected operation sequence %v", log)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handle not closed after cancellation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := f.(interface{ Sync() error }).Sync(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Sync to fail with context.Canceled, got %v", err)
+	}
+}
+
+// TestWithContextCancelOthers tests that a write in progress on one file
+// does not delay closing the other files on cancellation
+func TestWithContextCancelOthers(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	backend := &blockingFS{SymlinkFileSystem: fs, started: make(chan struct{}), release: make(chan struct{})}
+	bfs, err := billyfs.NewFS(backend, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cfs := bfs.WithContext(ctx)
+
+	var files []interface{ Write([]byte) (int, error) }
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		f, err := cfs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		files = append(files, f)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := files[0].Write([]byte("block"))
+		done <- err
+	}()
+	<-backend.started
+	cancel()
+
+	// The blocked file stays open until released, so both closes come
+	// from the other files.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		closes := 0
+		for _, entry := range backend.entries() {
+			if entry == "close" {
+				closes++
+			}
+		}
+		if closes == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(backend.release)
+			t.Fatal("other files not closed while a write was in progress")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+}
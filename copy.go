@@ -0,0 +1,205 @@
+package billyfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/absfs/basefs"
+)
+
+// FileCopier is implemented by absfs filesystems that can copy a file
+// without transferring its contents through the caller, such as remote
+// stores with server-side copies. Filesystem.CopyFile uses it when the
+// wrapped filesystem provides it. Implementations return an error wrapping
+// errors.ErrUnsupported when the copy cannot be made that way, in which
+// case CopyFile copies the data.
+type FileCopier interface {
+	CopyFile(src, dst string) error
+}
+
+// CopyFile copies the contents of the file src to dst, creating dst with
+// the permissions of src or truncating it if it exists. Where possible the
+// data is not read into memory: on the local filesystem the file is cloned
+// if the filesystem supports it, or copied by the kernel, and backends
+// implementing FileCopier copy it themselves.
+func (f *Filesystem) CopyFile(src, dst string) error {
+	info, err := f.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || f.absPath(src) == f.absPath(dst) {
+		return &os.LinkError{Op: "copyfile", Old: src, New: dst, Err: fs.ErrInvalid}
+	}
+	err = f.cloneFile(src, dst, info.Mode().Perm())
+	if errors.Is(err, errors.ErrUnsupported) {
+		return f.copyFile(src, dst, info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	f.invalidateTarget(dst)
+	f.sparse.drop(f.absPath(dst))
+	f.notify(OpCreate, dst)
+	return nil
+}
+
+// cloneFile copies src to dst on the local filesystem or through the
+// backend, or returns errors.ErrUnsupported.
+func (f *Filesystem) cloneFile(src, dst string, perm os.FileMode) error {
+	if srcpath, ok := f.nativePath(src); ok {
+		dstpath, _ := f.nativePath(dst)
+		return nativeCopyFile(srcpath, dstpath, perm)
+	}
+	if copier, ok := basefs.Unwrap(f.fs).(FileCopier); ok {
+		return copier.CopyFile(f.absPath(src), f.absPath(dst))
+	}
+	return errors.ErrUnsupported
+}
+
+// nativeCopyFile copies src to dst on the local filesystem, cloning the
+// file if the filesystem supports it.
+func nativeCopyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if reflink(out, in) != nil {
+		if _, err := out.ReadFrom(in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// copyFile copies src to dst through File handles.
+func (f *Filesystem) copyFile(src, dst string, perm os.FileMode) error {
+	in, err := f.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := f.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ReadFrom implements io.ReaderFrom. If both the file and r, a File or an
+// *os.File, are on the local filesystem, the data is copied by the kernel
+// with copy_file_range(2) or sendfile(2) where available. Otherwise it is
+// copied through a buffer.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	n, err := copyNative(f, r)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return io.Copy(writerOnly{f}, r)
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, copying like ReadFrom when w is a File
+// or an *os.File.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	switch w := w.(type) {
+	case *File:
+		return w.ReadFrom(f)
+	case *os.File:
+		n, err := copyNative(w, f)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return n, err
+		}
+	}
+	return io.Copy(w, readerOnly{f})
+}
+
+// copyNative copies from src to dst by the kernel. Each is a File or an
+// *os.File; errors.ErrUnsupported is returned if either is not open for
+// the copy on the local filesystem.
+func copyNative(dst io.Writer, src io.Reader) (int64, error) {
+	in, inDone, err := openNativeEnd(src, false)
+	if err != nil {
+		return 0, err
+	}
+	out, outDone, err := openNativeEnd(dst, true)
+	if err != nil {
+		inDone(0)
+		return 0, err
+	}
+	n, err := out.ReadFrom(in)
+	inDone(n)
+	outDone(n)
+	return n, err
+}
+
+// openNativeEnd returns x, a File or an *os.File, as an *os.File at the
+// offset of x, and a function to call with the number of bytes copied.
+func openNativeEnd(x any, write bool) (*os.File, func(n int64), error) {
+	switch x := x.(type) {
+	case *os.File:
+		return x, func(int64) {}, nil
+	case *File:
+		return x.reopen(write)
+	}
+	return nil, nil, errors.ErrUnsupported
+}
+
+// reopen opens the file again on the local filesystem, for writing if
+// write is set, at the offset of the handle. The returned function closes
+// it and moves the handle past the n bytes copied.
+func (f *File) reopen(write bool) (*os.File, func(n int64), error) {
+	flag, ok := os.O_RDONLY, f.flag&os.O_WRONLY == 0
+	if write {
+		flag, ok = os.O_WRONLY, f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	}
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+	if err := f.flush(); err != nil {
+		return nil, nil, err
+	}
+	file, err := f.openNative(flag)
+	if err != nil {
+		return nil, nil, errors.ErrUnsupported
+	}
+	var off int64
+	if write && f.flag&os.O_APPEND != 0 {
+		off, err = file.Seek(0, io.SeekEnd)
+	} else if off, err = f.Seek(0, io.SeekCurrent); err == nil {
+		_, err = file.Seek(off, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, func(n int64) {
+		file.Close()
+		if n > 0 {
+			f.Seek(off+n, io.SeekStart)
+			if write {
+				f.wroteAt(off, int(n))
+			}
+		}
+	}, nil
+}
+
+// writerOnly and readerOnly hide the ReadFrom and WriteTo methods of a
+// File from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
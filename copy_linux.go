@@ -0,0 +1,17 @@
+package billyfs
+
+import (
+	"os"
+	"syscall"
+)
+
+const ficlone = 0x40049409 // FICLONE
+
+// reflink makes dst share the data of src, on filesystems supporting it.
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package billyfs
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink reports that cloning files is not implemented on this platform.
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,189 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// copierFS is a countingFS whose backend copies files itself
+type copierFS struct {
+	countingFS
+	copies int
+}
+
+func (c *copierFS) CopyFile(src, dst string) error {
+	c.copies++
+	data, err := os.ReadFile(osfs.ToNative(src))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(osfs.ToNative(dst), data, 0644)
+}
+
+// newCountingTestFS creates a billyfs filesystem over a backend that is
+// not recognized as the local filesystem
+func newCountingTestFS(t *testing.T, fs absfs.SymlinkFileSystem) *billyfs.Filesystem {
+	t.Helper()
+	bfs, err := billyfs.NewFS(fs, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	return bfs
+}
+
+// testCopy copies between two files at non-zero offsets and checks the
+// contents and the offsets afterwards
+func testCopy(t *testing.T, bfs *billyfs.Filesystem) {
+	t.Helper()
+	data := testContent(200000)
+	writeBillyFile(t, bfs, "src.bin", data)
+
+	src, err := bfs.Open("src.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer src.Close()
+	dst, err := bfs.Create("dst.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer dst.Close()
+	src.Seek(100, io.SeekStart)
+	dst.Write([]byte("header"))
+
+	n, err := io.Copy(dst, src)
+	if err != nil || n != int64(len(data)-100) {
+		t.Fatalf("io.Copy: got %d, %v", n, err)
+	}
+	if pos, _ := src.Seek(0, io.SeekCurrent); pos != int64(len(data)) {
+		t.Errorf("expected the source at its end, got %d", pos)
+	}
+	dst.Write([]byte("trailer"))
+
+	got := readBillyFile(t, bfs, "dst.bin")
+	want := append(append([]byte("header"), data[100:]...), "trailer"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("copied content mismatch: %d bytes, want %d", len(got), len(want))
+	}
+
+	// WriteTo an *os.File and a plain writer.
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	src.Seek(0, io.SeekStart)
+	if n, err := src.(io.WriterTo).WriteTo(out); err != nil || n != int64(len(data)) {
+		t.Errorf("WriteTo *os.File: got %d, %v", n, err)
+	}
+	if got, _ := os.ReadFile(out.Name()); !bytes.Equal(got, data) {
+		t.Error("WriteTo *os.File: content mismatch")
+	}
+	var buf bytes.Buffer
+	src.Seek(-10, io.SeekEnd)
+	if n, err := src.(io.WriterTo).WriteTo(&buf); err != nil || n != 10 {
+		t.Errorf("WriteTo buffer: got %d, %v", n, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data[len(data)-10:]) {
+		t.Error("WriteTo buffer: content mismatch")
+	}
+}
+
+// readBillyFile reads the whole named file
+func readBillyFile(t *testing.T, bfs billy.Filesystem, name string) []byte {
+	t.Helper()
+	f, err := bfs.Open(name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return data
+}
+
+// TestCopyNative tests copies between files on the local filesystem
+func TestCopyNative(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	testCopy(t, bfs)
+}
+
+// TestCopyBuffered tests copies on backends other than the local
+// filesystem
+func TestCopyBuffered(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &countingFS{SymlinkFileSystem: fs}
+	testCopy(t, newCountingTestFS(t, counting))
+	if counting.writes.Load() == 0 {
+		t.Error("expected the copy to write through the backend")
+	}
+}
+
+// TestCopyFile tests CopyFile on the local filesystem, through a backend
+// copy and through File handles
+func TestCopyFile(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	native, _ := newTestFS(t)
+	copier := &copierFS{countingFS: countingFS{SymlinkFileSystem: fs}}
+	counting := &countingFS{SymlinkFileSystem: fs}
+
+	for name, bfs := range map[string]*billyfs.Filesystem{
+		"native":   native,
+		"backend":  newCountingTestFS(t, copier),
+		"buffered": newCountingTestFS(t, counting),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := bfs.MkdirAll("objects", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			data := testContent(50000)
+			writeBillyFile(t, bfs, "objects/src", data)
+			if err := bfs.Chmod("objects/src", 0600); err != nil {
+				t.Fatalf("Chmod failed: %v", err)
+			}
+			writeBillyFile(t, bfs, "objects/dst", []byte("stale contents to be replaced"))
+
+			if err := bfs.CopyFile("objects/src", "objects/dst"); err != nil {
+				t.Fatalf("CopyFile failed: %v", err)
+			}
+			if got := readBillyFile(t, bfs, "objects/dst"); !bytes.Equal(got, data) {
+				t.Error("copied content mismatch")
+			}
+			if err := bfs.CopyFile("objects/src", "objects/new"); err != nil {
+				t.Fatalf("CopyFile failed: %v", err)
+			}
+			info, err := bfs.Stat("objects/new")
+			if err != nil || info.Size() != int64(len(data)) {
+				t.Fatalf("Stat: got %v, %v", info, err)
+			}
+			if name != "backend" && info.Mode().Perm() != 0600 {
+				t.Errorf("expected mode 0600, got %v", info.Mode())
+			}
+			if err := bfs.CopyFile("objects", "copy"); err == nil {
+				t.Error("expected copying a directory to fail")
+			}
+			if err := bfs.CopyFile("objects/src", "objects/src"); err == nil {
+				t.Error("expected copying a file onto itself to fail")
+			}
+		})
+	}
+	if copier.copies != 2 {
+		t.Errorf("expected 2 backend copies, got %d", copier.copies)
+	}
+}
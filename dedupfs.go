@@ -0,0 +1,942 @@
+package billyfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/basefs"
+)
+
+// DedupFS is a content-addressed absfs.SymlinkFileSystem. File contents are
+// stored once per distinct SHA-256 digest in a content pool, and the file
+// tree only records which digest each path refers to, so identical files
+// share storage. Pool entries are reference counted and removed as soon as
+// the last path referring to them is removed or overwritten.
+//
+// DedupFS keeps its data in a directory of a backing filesystem:
+//
+//	<dir>/tree/     directories, symlinks and one pointer file per regular file
+//	<dir>/objects/  pool entries named by digest, e.g. objects/ab/cdef...
+//	<dir>/staging/  contents of files open for writing
+//
+// Use it with billyfs by passing it to NewFS:
+//
+//	store, err := billyfs.NewDedupFS(osfs, "/var/lib/repos")
+//	bfs, err := billyfs.NewFS(store, "/")
+//
+// Writes are staged and committed to the pool when the File is closed.
+type DedupFS struct {
+	backing absfs.SymlinkFileSystem
+	tree    absfs.SymlinkFileSystem
+	objects string
+	staging string
+
+	// mu guards refs and the pointer files, which writePointer rewrites
+	// in place; readers of pointer files hold it for reading.
+	mu   sync.RWMutex
+	refs map[string]int
+}
+
+// NewDedupFS creates a DedupFS storing its data in dir on backing. dir must
+// be an absolute path to an existing directory; the pool and tree are
+// created inside it if necessary. Reference counts are rebuilt from the
+// existing tree, and left-over staging files are discarded.
+func NewDedupFS(backing absfs.SymlinkFileSystem, dir string) (*DedupFS, error) {
+	info, err := backing.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	d := &DedupFS{
+		backing: backing,
+		objects: path.Join(dir, "objects"),
+		staging: path.Join(dir, "staging"),
+		refs:    make(map[string]int),
+	}
+	for _, p := range []string{path.Join(dir, "tree"), d.objects} {
+		if err := backing.MkdirAll(p, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := backing.RemoveAll(d.staging); err != nil {
+		return nil, err
+	}
+	if err := backing.MkdirAll(d.staging, 0700); err != nil {
+		return nil, err
+	}
+
+	d.tree, err = basefs.NewFS(backing, path.Join(dir, "tree"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.walkPointers("/", func(_ string, ptr pointer) error {
+		if ptr.hash != "" {
+			d.refs[ptr.hash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// pointer is the content of a pointer file in the tree. The empty file is
+// represented by an empty pointer and has no pool entry.
+type pointer struct {
+	hash string
+	size int64
+}
+
+func (p pointer) String() string {
+	if p.hash == "" {
+		return ""
+	}
+	return p.hash + " " + strconv.FormatInt(p.size, 10) + "\n"
+}
+
+func parsePointer(data []byte) (pointer, error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return pointer{}, nil
+	}
+	hash, sizeStr, ok := strings.Cut(s, " ")
+	if !ok || len(hash) != sha256.Size*2 {
+		return pointer{}, errors.New("billyfs: malformed pointer file")
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return pointer{}, errors.New("billyfs: malformed pointer file")
+	}
+	return pointer{hash: hash, size: size}, nil
+}
+
+// readPointer reads the pointer file name, following symlinks.
+func (d *DedupFS) readPointer(name string) (pointer, error) {
+	data, err := d.tree.ReadFile(name)
+	if err != nil {
+		return pointer{}, err
+	}
+	ptr, err := parsePointer(data)
+	if err != nil {
+		return pointer{}, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return ptr, nil
+}
+
+// lockedReadPointer is readPointer for callers not holding d.mu.
+func (d *DedupFS) lockedReadPointer(name string) (pointer, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.readPointer(name)
+}
+
+// writePointer replaces the pointer file name, which must exist.
+func (d *DedupFS) writePointer(name string, ptr pointer) error {
+	f, err := d.tree.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(ptr.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// walkPointers calls fn for every regular file below dir.
+func (d *DedupFS) walkPointers(dir string, fn func(name string, ptr pointer) error) error {
+	entries, err := d.tree.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			err = d.walkPointers(name, fn)
+		case entry.Type().IsRegular():
+			var ptr pointer
+			ptr, err = d.readPointer(name)
+			if err == nil {
+				err = fn(name, ptr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DedupFS) objectPath(hash string) string {
+	return path.Join(d.objects, hash[:2], hash[2:])
+}
+
+// release drops a reference to hash and removes its pool entry once it is
+// no longer referenced. d.mu must be held.
+func (d *DedupFS) release(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	d.refs[hash]--
+	if d.refs[hash] > 0 {
+		return nil
+	}
+	delete(d.refs, hash)
+	err := d.backing.Remove(d.objectPath(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// commit moves the staged content into the pool and points name at it. If
+// name has been removed meanwhile the content is discarded.
+func (d *DedupFS) commit(name string, staged absfs.File, stagedPath string) error {
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, staged)
+	if err != nil {
+		return err
+	}
+	if err := staged.Close(); err != nil {
+		return err
+	}
+
+	var ptr pointer
+	if size > 0 {
+		ptr = pointer{hash: hex.EncodeToString(h.Sum(nil)), size: size}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if ptr.hash == "" {
+		if err := d.backing.Remove(stagedPath); err != nil {
+			return err
+		}
+	} else {
+		if err := d.store(ptr.hash, stagedPath); err != nil {
+			return err
+		}
+		d.refs[ptr.hash]++
+	}
+
+	old, err := d.readPointer(name)
+	if err == nil {
+		err = d.writePointer(name, ptr)
+	}
+	if os.IsNotExist(err) {
+		return d.release(ptr.hash)
+	}
+	if err != nil {
+		d.release(ptr.hash)
+		return err
+	}
+	return d.release(old.hash)
+}
+
+// store adds the file at stagedPath to the pool as hash, discarding it if
+// the pool already holds that content. d.mu must be held.
+func (d *DedupFS) store(hash, stagedPath string) error {
+	obj := d.objectPath(hash)
+	if _, err := d.backing.Stat(obj); err == nil {
+		return d.backing.Remove(stagedPath)
+	}
+	if err := d.backing.MkdirAll(path.Dir(obj), 0755); err != nil {
+		return err
+	}
+	return d.backing.Rename(stagedPath, obj)
+}
+
+// newStaging creates an empty staging file and returns it with its path.
+func (d *DedupFS) newStaging() (absfs.File, string, error) {
+	initRNG()
+	for {
+		p := path.Join(d.staging, randSeq(16))
+		f, err := d.backing.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, p, err
+	}
+}
+
+// absfs.Filer interface functions
+
+// OpenFile opens name with the given flags. Files opened for writing are
+// staged and committed to the content pool when closed.
+func (d *DedupFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	info, err := d.tree.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		dir, err := d.tree.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &dedupDir{File: dir, d: d, name: name}, nil
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		created, err := d.tree.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return nil, err
+		}
+		if err := created.Close(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	d.mu.Lock()
+	ptr, err := d.readPointer(name)
+	var blob absfs.File
+	if err == nil && ptr.hash != "" && flag&os.O_TRUNC == 0 {
+		blob, err = d.backing.Open(d.objectPath(ptr.hash))
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &dedupFile{d: d, name: name, flag: flag, size: ptr.size}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f.data = blob
+		return f, nil
+	}
+
+	staged, stagedPath, err := d.newStaging()
+	if err != nil {
+		if blob != nil {
+			blob.Close()
+		}
+		return nil, err
+	}
+	if blob != nil {
+		_, err = io.Copy(staged, blob)
+		blob.Close()
+		if err == nil {
+			_, err = staged.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			staged.Close()
+			d.backing.Remove(stagedPath)
+			return nil, err
+		}
+	}
+	f.data = staged
+	f.stagedPath = stagedPath
+	f.dirty = ptr.hash != "" && flag&os.O_TRUNC != 0
+	return f, nil
+}
+
+// Mkdir creates a directory.
+func (d *DedupFS) Mkdir(name string, perm os.FileMode) error {
+	return d.tree.Mkdir(name, perm)
+}
+
+// Remove removes a file or empty directory, releasing its content.
+func (d *DedupFS) Remove(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := d.tree.Lstat(name)
+	if err != nil {
+		return err
+	}
+	var ptr pointer
+	if info.Mode().IsRegular() {
+		if ptr, err = d.readPointer(name); err != nil {
+			return err
+		}
+	}
+	if err := d.tree.Remove(name); err != nil {
+		return err
+	}
+	return d.release(ptr.hash)
+}
+
+// Rename renames oldpath to newpath, releasing the content of a regular file
+// replaced at newpath.
+func (d *DedupFS) Rename(oldpath, newpath string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var replaced pointer
+	if path.Clean("/"+oldpath) != path.Clean("/"+newpath) {
+		if info, err := d.tree.Lstat(newpath); err == nil && info.Mode().IsRegular() {
+			var err error
+			if replaced, err = d.readPointer(newpath); err != nil {
+				return err
+			}
+		}
+	}
+	if err := d.tree.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return d.release(replaced.hash)
+}
+
+// Stat returns a FileInfo describing name, reporting the size of the file
+// contents rather than of the pointer file.
+func (d *DedupFS) Stat(name string) (os.FileInfo, error) {
+	info, err := d.tree.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.contentInfo(name, info)
+}
+
+// contentInfo replaces the size of a pointer file with the content size.
+func (d *DedupFS) contentInfo(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	ptr, err := d.lockedReadPointer(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedInfo{FileInfo: info, size: ptr.size}, nil
+}
+
+// Chmod changes the mode of name.
+func (d *DedupFS) Chmod(name string, mode os.FileMode) error {
+	return d.tree.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of name.
+func (d *DedupFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return d.tree.Chtimes(name, atime, mtime)
+}
+
+// Chown changes the owner of name.
+func (d *DedupFS) Chown(name string, uid, gid int) error {
+	return d.tree.Chown(name, uid, gid)
+}
+
+// ReadDir reads the directory name and returns its entries sorted by name.
+func (d *DedupFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := d.tree.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			entries[i] = &dedupDirEntry{DirEntry: entry, d: d, name: path.Join(name, entry.Name())}
+		}
+	}
+	return entries, nil
+}
+
+// ReadFile reads the contents of name.
+func (d *DedupFS) ReadFile(name string) ([]byte, error) {
+	f, err := d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir.
+func (d *DedupFS) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(d, dir)
+}
+
+// absfs.FileSystem interface functions
+
+// Chdir changes the current working directory.
+func (d *DedupFS) Chdir(dir string) error {
+	return d.tree.Chdir(dir)
+}
+
+// Getwd returns the current working directory.
+func (d *DedupFS) Getwd() (string, error) {
+	return d.tree.Getwd()
+}
+
+// TempDir returns the directory used for temporary files.
+func (d *DedupFS) TempDir() string {
+	return d.tree.TempDir()
+}
+
+// Open opens name for reading.
+func (d *DedupFS) Open(name string) (absfs.File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates name.
+func (d *DedupFS) Create(name string) (absfs.File, error) {
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (d *DedupFS) MkdirAll(name string, perm os.FileMode) error {
+	return d.tree.MkdirAll(name, perm)
+}
+
+// RemoveAll removes name and everything below it, releasing the content of
+// every removed file.
+func (d *DedupFS) RemoveAll(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := d.tree.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var hashes []string
+	collect := func(_ string, ptr pointer) error {
+		hashes = append(hashes, ptr.hash)
+		return nil
+	}
+	switch {
+	case info.IsDir():
+		err = d.walkPointers(name, collect)
+	case info.Mode().IsRegular():
+		var ptr pointer
+		if ptr, err = d.readPointer(name); err == nil {
+			err = collect(name, ptr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.tree.RemoveAll(name); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := d.release(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate changes the size of name.
+func (d *DedupFS) Truncate(name string, size int64) error {
+	f, err := d.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// absfs.SymLinker interface functions
+
+// Lstat returns a FileInfo describing name without following symlinks.
+func (d *DedupFS) Lstat(name string) (os.FileInfo, error) {
+	info, err := d.tree.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.contentInfo(name, info)
+}
+
+// Lchown changes the owner of name without following symlinks.
+func (d *DedupFS) Lchown(name string, uid, gid int) error {
+	return d.tree.Lchown(name, uid, gid)
+}
+
+// Readlink returns the target of the symlink name.
+func (d *DedupFS) Readlink(name string) (string, error) {
+	return d.tree.Readlink(name)
+}
+
+// Symlink creates newname as a symlink to oldname.
+func (d *DedupFS) Symlink(oldname, newname string) error {
+	return d.tree.Symlink(oldname, newname)
+}
+
+// CheckReport describes the inconsistencies found by DedupFS.Check.
+type CheckReport struct {
+	// Missing lists the paths whose content is absent from the pool.
+	Missing []string
+
+	// Corrupt lists the digests of pool entries whose content no longer
+	// matches their digest.
+	Corrupt []string
+
+	// Orphaned lists the digests of pool entries no path refers to.
+	Orphaned []string
+
+	// Miscounted lists the digests whose reference count differs from the
+	// number of paths referring to them.
+	Miscounted []string
+}
+
+// OK reports whether no inconsistencies were found.
+func (r *CheckReport) OK() bool {
+	return len(r.Missing)+len(r.Corrupt)+len(r.Orphaned)+len(r.Miscounted) == 0
+}
+
+// Check verifies that every file in the tree refers to a pool entry that
+// exists and matches its digest, that every pool entry is referenced and
+// that the reference counts are accurate. It does not modify the store.
+func (d *DedupFS) Check() (*CheckReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := &CheckReport{}
+	refs := make(map[string]int)
+	err := d.walkPointers("/", func(name string, ptr pointer) error {
+		if ptr.hash == "" {
+			return nil
+		}
+		refs[ptr.hash]++
+		if _, err := d.backing.Stat(d.objectPath(ptr.hash)); os.IsNotExist(err) {
+			report.Missing = append(report.Missing, name)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := d.poolHashes()
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range pool {
+		ok, err := d.verifyObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			report.Corrupt = append(report.Corrupt, hash)
+		}
+		if refs[hash] == 0 {
+			report.Orphaned = append(report.Orphaned, hash)
+		}
+	}
+
+	for hash, n := range refs {
+		if d.refs[hash] != n {
+			report.Miscounted = append(report.Miscounted, hash)
+		}
+	}
+	for hash := range d.refs {
+		if refs[hash] == 0 {
+			report.Miscounted = append(report.Miscounted, hash)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Miscounted)
+	return report, nil
+}
+
+// poolHashes lists the digests of all pool entries in sorted order.
+func (d *DedupFS) poolHashes() ([]string, error) {
+	dirs, err := d.backing.ReadDir(d.objects)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entries, err := d.backing.ReadDir(path.Join(d.objects, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			hashes = append(hashes, dir.Name()+entry.Name())
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// verifyObject reports whether the pool entry hash matches its digest.
+func (d *DedupFS) verifyObject(hash string) (bool, error) {
+	f, err := d.backing.Open(d.objectPath(hash))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, bufio.NewReader(f)); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == hash, nil
+}
+
+// dedupFile is a regular file of a DedupFS. Files opened read-only read
+// their pool entry directly; writable files work on a staging copy that is
+// committed on Close.
+type dedupFile struct {
+	d    *DedupFS
+	name string
+	flag int
+
+	// data is the pool entry or staging file; nil for an empty read-only
+	// file.
+	data       absfs.File
+	stagedPath string
+	size       int64
+	offset     int64
+	dirty      bool
+	closed     bool
+}
+
+func (f *dedupFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *dedupFile) pathErr(op string, err error) error {
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+func (f *dedupFile) check(op string, write bool) error {
+	if f.closed {
+		return f.pathErr(op, os.ErrClosed)
+	}
+	if write && !f.writable() {
+		return f.pathErr(op, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *dedupFile) Name() string {
+	return f.name
+}
+
+// checkRead is check for reads, which fail on handles opened write-only.
+func (f *dedupFile) checkRead() error {
+	if err := f.check("read", false); err != nil {
+		return err
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return f.pathErr("read", syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *dedupFile) Read(b []byte) (int, error) {
+	if err := f.checkRead(); err != nil {
+		return 0, err
+	}
+	if f.data == nil {
+		return 0, io.EOF
+	}
+	return f.data.Read(b)
+}
+
+func (f *dedupFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.checkRead(); err != nil {
+		return 0, err
+	}
+	if f.data == nil {
+		return 0, io.EOF
+	}
+	return f.data.ReadAt(b, off)
+}
+
+func (f *dedupFile) Write(b []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		if _, err := f.data.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	f.dirty = true
+	return f.data.Write(b)
+}
+
+func (f *dedupFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.data.WriteAt(b, off)
+}
+
+func (f *dedupFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *dedupFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+	if f.data != nil {
+		return f.data.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, f.pathErr("seek", syscall.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *dedupFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.dirty = true
+	return f.data.Truncate(size)
+}
+
+func (f *dedupFile) Sync() error {
+	if err := f.check("sync", false); err != nil {
+		return err
+	}
+	if f.data == nil {
+		return nil
+	}
+	return f.data.Sync()
+}
+
+func (f *dedupFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	info, err := f.d.tree.Stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	size := f.size
+	if f.writable() {
+		staged, err := f.data.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = staged.Size()
+	}
+	return &sizedInfo{FileInfo: info, size: size}, nil
+}
+
+func (f *dedupFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, f.pathErr("readdir", syscall.ENOTDIR)
+}
+
+func (f *dedupFile) Readdirnames(int) ([]string, error) {
+	return nil, f.pathErr("readdirnames", syscall.ENOTDIR)
+}
+
+func (f *dedupFile) ReadDir(int) ([]fs.DirEntry, error) {
+	return nil, f.pathErr("readdir", syscall.ENOTDIR)
+}
+
+// Close releases the file and, for files opened for writing, commits the
+// new content to the pool.
+func (f *dedupFile) Close() error {
+	if f.closed {
+		return f.pathErr("close", os.ErrClosed)
+	}
+	f.closed = true
+	if !f.writable() {
+		if f.data == nil {
+			return nil
+		}
+		return f.data.Close()
+	}
+	if !f.dirty {
+		f.data.Close()
+		return f.d.backing.Remove(f.stagedPath)
+	}
+	if err := f.d.commit(f.name, f.data, f.stagedPath); err != nil {
+		f.d.backing.Remove(f.stagedPath)
+		return fmt.Errorf("billyfs: committing %s: %w", f.name, err)
+	}
+	return nil
+}
+
+// dedupDir is a directory handle of a DedupFS. It reports content sizes for
+// the regular files it lists.
+type dedupDir struct {
+	absfs.File
+	d    *DedupFS
+	name string
+}
+
+func (f *dedupDir) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(n)
+	for i, info := range infos {
+		if info.Mode().IsRegular() {
+			if ptr, perr := f.d.lockedReadPointer(path.Join(f.name, info.Name())); perr == nil {
+				infos[i] = &sizedInfo{FileInfo: info, size: ptr.size}
+			}
+		}
+	}
+	return infos, err
+}
+
+func (f *dedupDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.File.ReadDir(n)
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			entries[i] = &dedupDirEntry{DirEntry: entry, d: f.d, name: path.Join(f.name, entry.Name())}
+		}
+	}
+	return entries, err
+}
+
+// dedupDirEntry reports the content size of a regular file from Info.
+type dedupDirEntry struct {
+	fs.DirEntry
+	d    *DedupFS
+	name string
+}
+
+func (e *dedupDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return e.d.contentInfo(e.name, info)
+}
+
+// sizedInfo overrides the size reported by a FileInfo.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *sizedInfo) Size() int64 {
+	return i.size
+}
@@ -0,0 +1,356 @@
+package billyfs_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// newDedupTestFS creates a billyfs filesystem over a DedupFS stored in a
+// temporary directory
+func newDedupTestFS(t *testing.T) (*billyfs.Filesystem, *billyfs.DedupFS, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+
+	store, err := billyfs.NewDedupFS(fs, tmpDir)
+	if err != nil {
+		t.Fatalf("NewDedupFS failed: %v", err)
+	}
+
+	bfs, err := billyfs.NewFS(store, "/")
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+
+	return bfs, store, tmpDir
+}
+
+// writeTestFile creates name on bfs with the given content
+func writeTestFile(t *testing.T, bfs *billyfs.Filesystem, name, content string) {
+	t.Helper()
+	f, err := bfs.Create(name)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// readTestFile returns the content of name on bfs
+func readTestFile(t *testing.T, bfs *billyfs.Filesystem, name string) string {
+	t.Helper()
+	f, err := bfs.Open(name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return string(data)
+}
+
+// countObjects returns the number of pool entries below dir
+func countObjects(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.Walk(filepath.Join(dir, "objects"), func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// checkStore fails the test if store reports inconsistencies
+func checkStore(t *testing.T, store *billyfs.DedupFS) {
+	t.Helper()
+	report, err := store.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("unexpected inconsistencies: %+v", report)
+	}
+}
+
+// TestDedupSharedContent tests that identical files share one pool entry
+func TestDedupSharedContent(t *testing.T) {
+	bfs, store, dir := newDedupTestFS(t)
+
+	if err := bfs.MkdirAll("a/b", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeTestFile(t, bfs, "one.txt", "same content")
+	writeTestFile(t, bfs, "a/b/two.txt", "same content")
+	writeTestFile(t, bfs, "other.txt", "different")
+
+	if n := countObjects(t, dir); n != 2 {
+		t.Errorf("expected 2 pool entries, got %d", n)
+	}
+	if got := readTestFile(t, bfs, "a/b/two.txt"); got != "same content" {
+		t.Errorf("expected 'same content', got %q", got)
+	}
+
+	info, err := bfs.Stat("one.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != int64(len("same content")) {
+		t.Errorf("expected size %d, got %d", len("same content"), info.Size())
+	}
+
+	infos, err := bfs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, info := range infos {
+		if info.Name() == "other.txt" && info.Size() != int64(len("different")) {
+			t.Errorf("expected ReadDir size %d, got %d", len("different"), info.Size())
+		}
+	}
+	checkStore(t, store)
+}
+
+// TestDedupGarbageCollection tests that unreferenced content is removed
+func TestDedupGarbageCollection(t *testing.T) {
+	bfs, store, dir := newDedupTestFS(t)
+
+	writeTestFile(t, bfs, "one.txt", "shared")
+	writeTestFile(t, bfs, "two.txt", "shared")
+
+	if err := bfs.Remove("one.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if n := countObjects(t, dir); n != 1 {
+		t.Errorf("expected shared entry to survive, got %d entries", n)
+	}
+	if err := bfs.Remove("two.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if n := countObjects(t, dir); n != 0 {
+		t.Errorf("expected pool to be empty, got %d entries", n)
+	}
+
+	t.Run("overwrite releases old content", func(t *testing.T) {
+		writeTestFile(t, bfs, "file.txt", "v1")
+		writeTestFile(t, bfs, "file.txt", "v2")
+		if n := countObjects(t, dir); n != 1 {
+			t.Errorf("expected 1 pool entry, got %d", n)
+		}
+		if got := readTestFile(t, bfs, "file.txt"); got != "v2" {
+			t.Errorf("expected 'v2', got %q", got)
+		}
+	})
+
+	t.Run("rename over existing releases replaced content", func(t *testing.T) {
+		writeTestFile(t, bfs, "src.txt", "src")
+		writeTestFile(t, bfs, "dst.txt", "dst")
+		if err := bfs.Rename("src.txt", "dst.txt"); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+		if got := readTestFile(t, bfs, "dst.txt"); got != "src" {
+			t.Errorf("expected 'src', got %q", got)
+		}
+		if n := countObjects(t, dir); n != 2 {
+			t.Errorf("expected 2 pool entries, got %d", n)
+		}
+	})
+
+	checkStore(t, store)
+}
+
+// TestDedupFileModes tests appending, reopening and truncation
+func TestDedupFileModes(t *testing.T) {
+	bfs, store, _ := newDedupTestFS(t)
+
+	writeTestFile(t, bfs, "file.txt", "hello")
+
+	f, err := bfs.OpenFile("file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("expected error reading from write-only file")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := readTestFile(t, bfs, "file.txt"); got != "hello world" {
+		t.Errorf("expected 'hello world', got %q", got)
+	}
+
+	f, err = bfs.OpenFile("file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := readTestFile(t, bfs, "file.txt"); got != "hello" {
+		t.Errorf("expected 'hello', got %q", got)
+	}
+
+	r, err := bfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := r.Write([]byte("x")); err == nil {
+		t.Error("expected error writing to read-only file")
+	}
+	r.Close()
+
+	writeTestFile(t, bfs, "empty.txt", "")
+	if got := readTestFile(t, bfs, "empty.txt"); got != "" {
+		t.Errorf("expected empty file, got %q", got)
+	}
+	checkStore(t, store)
+}
+
+// TestDedupConcurrentStat tests that Stat does not see pointer files
+// being rewritten
+func TestDedupConcurrentStat(t *testing.T) {
+	bfs, store, _ := newDedupTestFS(t)
+	writeTestFile(t, bfs, "file.txt", "aaaa")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			f, err := bfs.OpenFile("file.txt", os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				t.Errorf("OpenFile failed: %v", err)
+				return
+			}
+			content := "aaaa"
+			if i%2 == 0 {
+				content = "bbbbbbbbbbbb"
+			}
+			f.Write([]byte(content))
+			if err := f.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		info, err := store.Stat("/file.txt")
+		if err != nil || (info.Size() != 4 && info.Size() != 12) {
+			t.Errorf("unexpected Stat result %v, %v", info, err)
+			<-done
+			return
+		}
+	}
+	checkStore(t, store)
+}
+
+// TestDedupReopen tests that reference counts are rebuilt from the tree
+func TestDedupReopen(t *testing.T) {
+	bfs, _, dir := newDedupTestFS(t)
+	writeTestFile(t, bfs, "one.txt", "shared")
+	writeTestFile(t, bfs, "two.txt", "shared")
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := billyfs.NewDedupFS(fs, dir)
+	if err != nil {
+		t.Fatalf("NewDedupFS failed: %v", err)
+	}
+	checkStore(t, store)
+
+	if err := store.Remove("/one.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if n := countObjects(t, dir); n != 1 {
+		t.Errorf("expected shared entry to survive, got %d entries", n)
+	}
+}
+
+// TestDedupCheck tests detection of damaged stores
+func TestDedupCheck(t *testing.T) {
+	bfs, store, dir := newDedupTestFS(t)
+	writeTestFile(t, bfs, "corrupt.txt", "to be corrupted")
+	writeTestFile(t, bfs, "missing.txt", "to be deleted")
+
+	var objects []string
+	filepath.Walk(filepath.Join(dir, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			objects = append(objects, p)
+		}
+		return err
+	})
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 pool entries, got %d", len(objects))
+	}
+
+	// Find which object belongs to which file by content.
+	for _, p := range objects {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) == "to be corrupted" {
+			if err := os.WriteFile(p, []byte("garbage"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphan := filepath.Join(dir, "objects", "00", "00000000000000000000000000000000000000000000000000000000000000")
+	if err := os.MkdirAll(filepath.Dir(orphan), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if report.OK() {
+		t.Fatal("expected inconsistencies")
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "/missing.txt" {
+		t.Errorf("expected /missing.txt to be missing, got %v", report.Missing)
+	}
+	// The orphan's empty content does not match its name either.
+	if len(report.Corrupt) != 2 {
+		t.Errorf("expected 2 corrupt entries, got %v", report.Corrupt)
+	}
+	if len(report.Orphaned) != 1 {
+		t.Errorf("expected 1 orphaned entry, got %v", report.Orphaned)
+	}
+}
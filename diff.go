@@ -0,0 +1,355 @@
+package billyfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// DiffKind describes how an entry differs between two trees.
+type DiffKind uint32
+
+// Differences reported in DiffEntry.Kind. DiffModified and DiffModeChanged
+// may be combined.
+const (
+	DiffAdded DiffKind = 1 << iota
+	DiffRemoved
+	DiffModified
+	DiffModeChanged
+	DiffTypeChanged
+)
+
+var diffNames = []struct {
+	kind   DiffKind
+	name   string
+	status string
+}{
+	{DiffAdded, "ADDED", "A"},
+	{DiffRemoved, "REMOVED", "D"},
+	{DiffModified, "MODIFIED", "M"},
+	{DiffModeChanged, "MODE", "M"},
+	{DiffTypeChanged, "TYPE", "T"},
+}
+
+// String returns the names of the differences in k separated by "|".
+func (k DiffKind) String() string {
+	var names []string
+	for _, n := range diffNames {
+		if k&n.kind != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, "|")
+}
+
+// status returns the letter used for k by git diff --name-status.
+func (k DiffKind) status() string {
+	for _, n := range diffNames {
+		if k&n.kind != 0 {
+			return n.status
+		}
+	}
+	return "?"
+}
+
+// DiffEntry describes an entry that differs between two trees.
+type DiffEntry struct {
+	// Path is the slash-separated path of the entry, relative to the
+	// roots of the trees.
+	Path string
+	Kind DiffKind
+
+	// From and To describe the entry in each tree. From is nil for an
+	// added entry and To for a removed one.
+	From, To os.FileInfo
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// Hash compares the contents of regular files of the same size by
+	// their SHA-256 hash. Without it, files differing in size or
+	// modification time are reported as modified.
+	Hash bool
+
+	// QuickCheck, with Hash, considers files of the same size and
+	// modification time unchanged without reading them, as git status
+	// does.
+	QuickCheck bool
+
+	// PruneDirs does not descend into directories with the same mode,
+	// size and modification time in both trees. Adding, removing or
+	// renaming an entry updates the modification time of its directory,
+	// but changes deeper in the tree or to the contents of a file do not,
+	// so this suits trees where every change is made by replacing entries
+	// of the pruned directories.
+	PruneDirs bool
+}
+
+// Diff compares the trees of two billy filesystems and returns the
+// entries that differ, in depth-first walk order: the entries of each
+// directory are visited by name, and a directory is followed by its
+// descendants, so a/x comes before a.txt. Entries of directories only in
+// one tree are reported individually. Symbolic links are compared by
+// target when the filesystems implement billy.Symlink.
+func Diff(from, to billy.Filesystem, opts DiffOptions) ([]DiffEntry, error) {
+	d := &differ{from: from, to: to, opts: opts}
+	return d.run()
+}
+
+// differ holds the state of a Diff call.
+type differ struct {
+	from, to billy.Filesystem
+	opts     DiffOptions
+	entries  []DiffEntry
+
+	// stale also reports regular files with the same contents but another
+	// modification time, with no Kind, for Sync to restore their times.
+	stale bool
+}
+
+// run compares the trees and returns the entries that differ.
+func (d *differ) run() ([]DiffEntry, error) {
+	if err := d.dir(""); err != nil {
+		return nil, err
+	}
+	return d.entries, nil
+}
+
+// dir compares the directory name, present in both trees.
+func (d *differ) dir(name string) error {
+	fromInfos, err := diffReadDir(d.from, name)
+	if err != nil {
+		return err
+	}
+	toInfos, err := diffReadDir(d.to, name)
+	if err != nil {
+		return err
+	}
+	for len(fromInfos) > 0 || len(toInfos) > 0 {
+		var a, b os.FileInfo
+		switch {
+		case len(toInfos) == 0 || len(fromInfos) > 0 && fromInfos[0].Name() < toInfos[0].Name():
+			a, fromInfos = fromInfos[0], fromInfos[1:]
+		case len(fromInfos) == 0 || toInfos[0].Name() < fromInfos[0].Name():
+			b, toInfos = toInfos[0], toInfos[1:]
+		default:
+			a, b = fromInfos[0], toInfos[0]
+			fromInfos, toInfos = fromInfos[1:], toInfos[1:]
+		}
+		child := a
+		if child == nil {
+			child = b
+		}
+		if err := d.entry(path.Join(name, child.Name()), a, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry compares the entry name, described by a in the first tree and b
+// in the second; either may be nil.
+func (d *differ) entry(name string, a, b os.FileInfo) error {
+	switch {
+	case b == nil:
+		return d.one(d.from, name, a, DiffRemoved)
+	case a == nil:
+		return d.one(d.to, name, b, DiffAdded)
+	case a.Mode().Type() != b.Mode().Type():
+		d.add(name, DiffTypeChanged, a, b)
+		if a.IsDir() {
+			return d.tree(d.from, name, DiffRemoved)
+		}
+		if b.IsDir() {
+			return d.tree(d.to, name, DiffAdded)
+		}
+		return nil
+	}
+
+	var kind DiffKind
+	if a.Mode().Perm() != b.Mode().Perm() {
+		kind |= DiffModeChanged
+	}
+	changed, err := d.changed(name, a, b)
+	if err != nil {
+		return err
+	}
+	if changed {
+		kind |= DiffModified
+	}
+	if kind != 0 || d.stale && a.Mode().IsRegular() && !sameStat(a, b) {
+		d.add(name, kind, a, b)
+	}
+	if a.IsDir() && (!d.opts.PruneDirs || kind != 0 || !sameStat(a, b)) {
+		return d.dir(name)
+	}
+	return nil
+}
+
+// changed reports whether the contents of an entry of the same type in
+// both trees differ.
+func (d *differ) changed(name string, a, b os.FileInfo) (bool, error) {
+	switch {
+	case a.IsDir():
+		return false, nil
+	case a.Mode()&os.ModeSymlink != 0:
+		fromLink, ok1 := d.from.(billy.Symlink)
+		toLink, ok2 := d.to.(billy.Symlink)
+		if !ok1 || !ok2 {
+			return !sameStat(a, b), nil
+		}
+		target1, err := fromLink.Readlink(name)
+		if err != nil {
+			return false, err
+		}
+		target2, err := toLink.Readlink(name)
+		if err != nil {
+			return false, err
+		}
+		return target1 != target2, nil
+	case a.Size() != b.Size():
+		return true, nil
+	case !d.opts.Hash:
+		return !a.ModTime().Equal(b.ModTime()), nil
+	case d.opts.QuickCheck && a.ModTime().Equal(b.ModTime()):
+		return false, nil
+	}
+	h1, err := hashFile(d.from, name)
+	if err != nil {
+		return false, err
+	}
+	h2, err := hashFile(d.to, name)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(h1, h2), nil
+}
+
+// one reports the entry name, only in the tree fs, and its descendants.
+func (d *differ) one(fs billy.Filesystem, name string, info os.FileInfo, kind DiffKind) error {
+	if kind == DiffAdded {
+		d.add(name, kind, nil, info)
+	} else {
+		d.add(name, kind, info, nil)
+	}
+	if info.IsDir() {
+		return d.tree(fs, name, kind)
+	}
+	return nil
+}
+
+// tree reports the descendants of the directory name, only in the tree
+// fs.
+func (d *differ) tree(fs billy.Filesystem, name string, kind DiffKind) error {
+	infos, err := diffReadDir(fs, name)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := d.one(fs, path.Join(name, info.Name()), info, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *differ) add(name string, kind DiffKind, a, b os.FileInfo) {
+	d.entries = append(d.entries, DiffEntry{Path: name, Kind: kind, From: a, To: b})
+}
+
+// diffReadDir returns the entries of the directory name of fs, sorted by
+// name. Symbolic links are not followed.
+func diffReadDir(fs billy.Filesystem, name string) ([]os.FileInfo, error) {
+	if name == "" {
+		name = "/"
+	}
+	infos, err := fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// sameStat reports whether a and b have the same mode, size and
+// modification time.
+func sameStat(a, b os.FileInfo) bool {
+	return a.Mode() == b.Mode() && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// hashFile returns the SHA-256 hash of the contents of the file name.
+func hashFile(fs billy.Filesystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// DiffFormat selects the output format of WriteDiff.
+type DiffFormat int
+
+const (
+	// DiffFormatText writes a line per entry with the status letter of
+	// git diff --name-status (A, D, M or T), a tab and the path.
+	DiffFormatText DiffFormat = iota
+
+	// DiffFormatJSON writes a JSON object per line, with the path, the
+	// names of the differences and the mode and size of the entry in
+	// each tree it is in.
+	DiffFormatJSON
+)
+
+// diffRecord is the JSON form of a DiffEntry.
+type diffRecord struct {
+	Path     string `json:"path"`
+	Change   string `json:"change"`
+	FromMode string `json:"from_mode,omitempty"`
+	ToMode   string `json:"to_mode,omitempty"`
+	FromSize *int64 `json:"from_size,omitempty"`
+	ToSize   *int64 `json:"to_size,omitempty"`
+}
+
+// WriteDiff writes entries to w in format.
+func WriteDiff(w io.Writer, entries []DiffEntry, format DiffFormat) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if format == DiffFormatText {
+			if _, err := fmt.Fprintf(w, "%s\t%s\n", e.Kind.status(), e.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		r := diffRecord{Path: e.Path, Change: e.Kind.String()}
+		if e.From != nil {
+			size := e.From.Size()
+			r.FromMode, r.FromSize = e.From.Mode().String(), &size
+		}
+		if e.To != nil {
+			size := e.To.Size()
+			r.ToMode, r.ToSize = e.To.Mode().String(), &size
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
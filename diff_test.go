@@ -0,0 +1,154 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+)
+
+// diffPaths formats entries as "path KIND" strings
+func diffPaths(entries []billyfs.DiffEntry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Path+" "+e.Kind.String())
+	}
+	return out
+}
+
+// setupDiffTrees creates two trees differing in every supported way, with
+// the same modification time on all files
+func setupDiffTrees(t *testing.T) (*billyfs.Filesystem, *billyfs.Filesystem) {
+	t.Helper()
+	from, _ := newTestFS(t)
+	to, _ := newTestFS(t)
+	setupGlobTree(t, from, "a.txt", "b.txt", "dir/c.txt", "gone/x", "typ", "mode.sh")
+	setupGlobTree(t, to, "a.txt", "b.txt", "dir/c.txt", "new/y", "typ/z", "mode.sh", "added.txt")
+	writeBillyFile(t, from, "a.txt", []byte("hello"))
+	writeBillyFile(t, to, "a.txt", []byte("HELLO"))
+	for _, bfs := range []*billyfs.Filesystem{from, to} {
+		writeBillyFile(t, bfs, "b.txt", []byte("same"))
+	}
+	from.Symlink("a.txt", "link")
+	to.Symlink("b.txt", "link")
+	to.Chmod("mode.sh", 0755)
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, bfs := range []*billyfs.Filesystem{from, to} {
+		for _, name := range []string{"a.txt", "b.txt", "dir/c.txt", "dir", "mode.sh"} {
+			if err := bfs.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatalf("Chtimes failed: %v", err)
+			}
+		}
+	}
+	return from, to
+}
+
+// TestDiff tests the differences reported with and without hashing
+func TestDiff(t *testing.T) {
+	from, to := setupDiffTrees(t)
+
+	entries, err := billyfs.Diff(from, to, billyfs.DiffOptions{Hash: true})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := []string{
+		"a.txt MODIFIED", "added.txt ADDED", "gone REMOVED", "gone/x REMOVED",
+		"link MODIFIED", "mode.sh MODE", "new ADDED", "new/y ADDED",
+		"typ TYPE", "typ/z ADDED",
+	}
+	if got := diffPaths(entries); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected diff:\n%v\nwant:\n%v", got, want)
+	}
+	for _, e := range entries {
+		if e.Path == "gone" && (e.From == nil || e.To != nil) {
+			t.Errorf("expected only From for a removed entry, got %+v", e)
+		}
+	}
+
+	// Same size and modification time is taken as unchanged.
+	for _, opts := range []billyfs.DiffOptions{{}, {Hash: true, QuickCheck: true}} {
+		entries, err = billyfs.Diff(from, to, opts)
+		if err != nil {
+			t.Fatalf("Diff failed: %v", err)
+		}
+		if got := diffPaths(entries); got[0] != "added.txt ADDED" {
+			t.Errorf("%+v: expected a.txt to be unchanged, got %v", opts, got)
+		}
+	}
+
+	entries, _ = billyfs.Diff(from, from, billyfs.DiffOptions{Hash: true})
+	if len(entries) != 0 {
+		t.Errorf("expected no differences with itself, got %v", diffPaths(entries))
+	}
+
+	// Directories are followed by their descendants.
+	setupGlobTree(t, to, "new.txt")
+	entries, _ = billyfs.Diff(from, to, billyfs.DiffOptions{Hash: true})
+	got := strings.Join(diffPaths(entries), ",")
+	if !strings.Contains(got, "new ADDED,new/y ADDED,new.txt ADDED") {
+		t.Errorf("expected depth-first order, got %v", got)
+	}
+}
+
+// TestDiffPruneDirs tests that directories with the same stat are skipped
+func TestDiffPruneDirs(t *testing.T) {
+	from, to := setupDiffTrees(t)
+	writeBillyFile(t, to, "dir/c.txt", []byte("changed in place"))
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	to.Chtimes("dir", mtime, mtime)
+
+	has := func(entries []billyfs.DiffEntry, name string) bool {
+		for _, e := range entries {
+			if e.Path == name {
+				return true
+			}
+		}
+		return false
+	}
+	entries, _ := billyfs.Diff(from, to, billyfs.DiffOptions{})
+	if !has(entries, "dir/c.txt") {
+		t.Error("expected dir/c.txt to be reported without pruning")
+	}
+	entries, _ = billyfs.Diff(from, to, billyfs.DiffOptions{PruneDirs: true})
+	if has(entries, "dir/c.txt") {
+		t.Error("expected dir to be pruned")
+	}
+	if !has(entries, "gone/x") {
+		t.Error("expected other directories to be compared")
+	}
+}
+
+// TestWriteDiff tests the output formats
+func TestWriteDiff(t *testing.T) {
+	from, to := setupDiffTrees(t)
+	entries, err := billyfs.Diff(from, to, billyfs.DiffOptions{Hash: true})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := billyfs.WriteDiff(&buf, entries, billyfs.DiffFormatText); err != nil {
+		t.Fatalf("WriteDiff failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(entries) || lines[0] != "M\ta.txt" || lines[2] != "D\tgone" || lines[8] != "T\ttyp" {
+		t.Errorf("unexpected text output:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := billyfs.WriteDiff(&buf, entries, billyfs.DiffFormatJSON); err != nil {
+		t.Fatalf("WriteDiff failed: %v", err)
+	}
+	var record map[string]any
+	line, _, _ := strings.Cut(buf.String(), "\n")
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", line, err)
+	}
+	if record["path"] != "a.txt" || record["change"] != "MODIFIED" || record["from_size"] != 5.0 {
+		t.Errorf("unexpected record %v", record)
+	}
+}
@@ -0,0 +1,820 @@
+package billyfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// DefaultEncryptionChunkSize is the plaintext size of the chunks files are
+// encrypted in when EncryptionOptions.ChunkSize is zero.
+const DefaultEncryptionChunkSize = 4096
+
+const (
+	encMagic      = "BFE1"
+	encSaltSize   = 32
+	encHeaderSize = len(encMagic) + 4 + encSaltSize
+	encNonceSize  = 12
+	encOverhead   = encNonceSize + 16
+)
+
+var (
+	// ErrInvalidKey is returned by NewEncryptedFS for master keys that are
+	// not 32 bytes long.
+	ErrInvalidKey = errors.New("billyfs: encryption key must be 32 bytes")
+
+	// ErrDecrypt is returned when encrypted data or names fail
+	// authentication, because they were modified or the key is wrong.
+	ErrDecrypt = errors.New("billyfs: message authentication failed")
+)
+
+// EncryptionOptions configures an EncryptedFS.
+type EncryptionOptions struct {
+	// ChunkSize is the plaintext size of the independently authenticated
+	// chunks file contents are split into. It must be the same every time
+	// a tree is opened. Zero selects DefaultEncryptionChunkSize.
+	ChunkSize int
+
+	// EncryptNames encrypts every path component and symlink target in
+	// addition to file contents. Names are encrypted deterministically so
+	// they can be looked up; equal names therefore have equal ciphertexts,
+	// and the encoded names are about 4/3 longer than the originals plus
+	// 38 bytes, which must fit the limits of the underlying filesystem.
+	EncryptNames bool
+}
+
+// EncryptedFS is a billy.Filesystem that encrypts file contents, and
+// optionally names, before storing them on another billy.Filesystem such as
+// a Filesystem.
+//
+// Each file starts with a header holding a random salt from which its key
+// is derived with the master key. The contents follow as a sequence of
+// AES-256-GCM sealed chunks, each with a random nonce and bound to its
+// position, so files can be read and written at arbitrary offsets by
+// re-encrypting only the affected chunks. Stat, Lstat and ReadDir report
+// plaintext sizes, computed from the stored sizes.
+//
+// The handles of a file opened through an EncryptedFS, or through those
+// derived from it with Chroot, share its size and serialize their updates.
+// Other writers of the stored file must not modify it concurrently.
+type EncryptedFS struct {
+	fs        billy.Filesystem
+	fileKey   []byte
+	names     cipher.AEAD
+	nameKey   []byte
+	chunkSize int
+	files     *encryptedFiles
+}
+
+// NewEncryptedFS returns an EncryptedFS storing its data on fs and
+// encrypting it with keys derived from masterKey, which must be 32 bytes.
+func NewEncryptedFS(fs billy.Filesystem, masterKey []byte, opts EncryptionOptions) (*EncryptedFS, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidKey
+	}
+	if opts.ChunkSize < 0 {
+		return nil, errors.New("billyfs: negative encryption chunk size")
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultEncryptionChunkSize
+	}
+
+	e := &EncryptedFS{
+		fs:        fs,
+		fileKey:   deriveKey(masterKey, "file", nil),
+		chunkSize: opts.ChunkSize,
+		files:     &encryptedFiles{nodes: make(map[string]*encryptedNode)},
+	}
+	if opts.EncryptNames {
+		aead, err := newGCM(deriveKey(masterKey, "name", nil))
+		if err != nil {
+			return nil, err
+		}
+		e.names = aead
+		e.nameKey = deriveKey(masterKey, "name-nonce", nil)
+	}
+	return e, nil
+}
+
+// deriveKey derives a 32 byte key for the given purpose from key.
+func deriveKey(key []byte, label string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("billyfs " + label + "\x00"))
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// diskChunkSize is the stored size of a full chunk.
+func (e *EncryptedFS) diskChunkSize() int64 {
+	return int64(e.chunkSize + encOverhead)
+}
+
+// plainSize returns the plaintext size of a file stored in size bytes.
+func (e *EncryptedFS) plainSize(size int64) int64 {
+	body := size - int64(encHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	full, rem := body/e.diskChunkSize(), body%e.diskChunkSize()
+	plain := full * int64(e.chunkSize)
+	if rem > encOverhead {
+		plain += rem - encOverhead
+	}
+	return plain
+}
+
+// encryptName encrypts a single path component.
+func (e *EncryptedFS) encryptName(name string) string {
+	if e.names == nil || name == "" || name == "." || name == ".." {
+		return name
+	}
+	mac := hmac.New(sha256.New, e.nameKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:encNonceSize]
+	sealed := e.names.Seal(nonce[:encNonceSize:encNonceSize], nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decryptName decrypts a single path component.
+func (e *EncryptedFS) decryptName(name string) (string, error) {
+	if e.names == nil || name == "" || name == "." || name == ".." {
+		return name, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(sealed) < encOverhead {
+		return "", ErrDecrypt
+	}
+	plain, err := e.names.Open(nil, sealed[:encNonceSize], sealed[encNonceSize:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+// encryptPath encrypts every component of p.
+func (e *EncryptedFS) encryptPath(p string) string {
+	if e.names == nil {
+		return p
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = e.encryptName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// decryptPath decrypts every component of p.
+func (e *EncryptedFS) decryptPath(p string) (string, error) {
+	if e.names == nil {
+		return p, nil
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		plain, err := e.decryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = plain
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// plainInfo converts a FileInfo of the underlying filesystem into one
+// reporting the plaintext name and size.
+func (e *EncryptedFS) plainInfo(name string, info os.FileInfo) os.FileInfo {
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		size = e.plainSize(size)
+	}
+	return &encryptedInfo{FileInfo: info, name: name, size: size}
+}
+
+// go-billy Basic interface functions
+
+// Create creates or truncates the named file.
+func (e *EncryptedFS) Create(filename string) (billy.File, error) {
+	return e.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens the named file for reading.
+func (e *EncryptedFS) Open(filename string) (billy.File, error) {
+	return e.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the given flags. Files opened for
+// writing are opened read-write on the underlying filesystem, since partial
+// chunk updates need to read the chunk first; O_APPEND is implemented by
+// the returned File.
+func (e *EncryptedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	uflag := flag &^ (os.O_WRONLY | os.O_RDWR | os.O_APPEND)
+	if writable {
+		uflag |= os.O_RDWR
+	}
+	key := path.Join(e.fs.Root(), e.encryptPath(filename))
+	node := e.files.acquire(key)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	file, err := e.fs.OpenFile(e.encryptPath(filename), uflag, perm)
+	if err != nil {
+		e.files.release(key)
+		return nil, err
+	}
+
+	f := &encryptedFile{e: e, f: file, name: filename, flag: flag, key: key, node: node}
+	if err := f.init(); err != nil {
+		file.Close()
+		e.files.release(key)
+		return nil, &os.PathError{Op: "open", Path: filename, Err: err}
+	}
+	return f, nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (e *EncryptedFS) Stat(filename string) (os.FileInfo, error) {
+	info, err := e.fs.Stat(e.encryptPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	return e.plainInfo(path.Base(filename), info), nil
+}
+
+// Rename renames oldpath to newpath.
+func (e *EncryptedFS) Rename(oldpath, newpath string) error {
+	return e.fs.Rename(e.encryptPath(oldpath), e.encryptPath(newpath))
+}
+
+// Remove removes the named file or empty directory.
+func (e *EncryptedFS) Remove(filename string) error {
+	return e.fs.Remove(e.encryptPath(filename))
+}
+
+// Join joins any number of path elements into a single path.
+func (e *EncryptedFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// go-billy TempFile interface functions
+
+// TempFile creates a new temporary file in dir with a name beginning with
+// prefix.
+func (e *EncryptedFS) TempFile(dir, prefix string) (billy.File, error) {
+	initRNG()
+	for {
+		name := path.Join(dir, prefix+"_"+randSeq(5))
+		f, err := e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// go-billy Dir interface functions
+
+// ReadDir reads the directory named by dirname and returns its entries with
+// plaintext names and sizes.
+func (e *EncryptedFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	infos, err := e.fs.ReadDir(e.encryptPath(dirname))
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		name, err := e.decryptName(info.Name())
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: path.Join(dirname, info.Name()), Err: err}
+		}
+		infos[i] = e.plainInfo(name, info)
+	}
+	return infos, nil
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (e *EncryptedFS) MkdirAll(filename string, perm os.FileMode) error {
+	return e.fs.MkdirAll(e.encryptPath(filename), perm)
+}
+
+// go-billy Symlink interface functions
+
+// Lstat returns a FileInfo describing the named file without following
+// symlinks.
+func (e *EncryptedFS) Lstat(filename string) (os.FileInfo, error) {
+	info, err := e.fs.Lstat(e.encryptPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	return e.plainInfo(path.Base(filename), info), nil
+}
+
+// Symlink creates link as a symbolic link to target. With EncryptNames the
+// target is stored encrypted.
+func (e *EncryptedFS) Symlink(target, link string) error {
+	return e.fs.Symlink(e.encryptPath(target), e.encryptPath(link))
+}
+
+// Readlink returns the target of link.
+func (e *EncryptedFS) Readlink(link string) (string, error) {
+	target, err := e.fs.Readlink(e.encryptPath(link))
+	if err != nil {
+		return "", err
+	}
+	plain, err := e.decryptPath(target)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: err}
+	}
+	return plain, nil
+}
+
+// go-billy Chroot interface functions
+
+// Chroot returns an EncryptedFS with the same keys rooted at path.
+func (e *EncryptedFS) Chroot(path string) (billy.Filesystem, error) {
+	fs, err := e.fs.Chroot(e.encryptPath(path))
+	if err != nil {
+		return nil, err
+	}
+	sub := *e
+	sub.fs = fs
+	return &sub, nil
+}
+
+// Root returns the root path of the underlying filesystem.
+func (e *EncryptedFS) Root() string {
+	return e.fs.Root()
+}
+
+// go-billy Capabilities interface
+
+// Capabilities returns the capabilities of the underlying filesystem.
+func (e *EncryptedFS) Capabilities() billy.Capability {
+	return billy.Capabilities(e.fs)
+}
+
+// go-billy Change interface functions
+
+func (e *EncryptedFS) change() (billy.Change, error) {
+	if c, ok := e.fs.(billy.Change); ok {
+		return c, nil
+	}
+	return nil, billy.ErrNotSupported
+}
+
+// Chmod changes the mode of the named file.
+func (e *EncryptedFS) Chmod(name string, mode os.FileMode) error {
+	c, err := e.change()
+	if err != nil {
+		return err
+	}
+	return c.Chmod(e.encryptPath(name), mode)
+}
+
+// Lchown changes the owner of the named file without following symlinks.
+func (e *EncryptedFS) Lchown(name string, uid, gid int) error {
+	c, err := e.change()
+	if err != nil {
+		return err
+	}
+	return c.Lchown(e.encryptPath(name), uid, gid)
+}
+
+// Chown changes the owner of the named file.
+func (e *EncryptedFS) Chown(name string, uid, gid int) error {
+	c, err := e.change()
+	if err != nil {
+		return err
+	}
+	return c.Chown(e.encryptPath(name), uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (e *EncryptedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c, err := e.change()
+	if err != nil {
+		return err
+	}
+	return c.Chtimes(e.encryptPath(name), atime, mtime)
+}
+
+// encryptedInfo reports the plaintext name and size of a file.
+type encryptedInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i *encryptedInfo) Name() string {
+	return i.name
+}
+
+func (i *encryptedInfo) Size() int64 {
+	return i.size
+}
+
+// encryptedFiles tracks the open files of an EncryptedFS and of the
+// EncryptedFS derived from it with Chroot, keyed by their stored paths.
+type encryptedFiles struct {
+	mu    sync.Mutex
+	nodes map[string]*encryptedNode
+}
+
+// encryptedNode is the state shared by the handles of a file. Its lock
+// serializes their reads and updates, which depend on the plaintext size
+// to find the final chunk.
+type encryptedNode struct {
+	mu   sync.Mutex
+	size int64
+	refs int
+}
+
+// acquire returns the node of the file stored at key, adding a reference.
+func (r *encryptedFiles) acquire(key string) *encryptedNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[key]
+	if !ok {
+		n = &encryptedNode{}
+		r.nodes[key] = n
+	}
+	n.refs++
+	return n
+}
+
+// release drops a reference to the node of key.
+func (r *encryptedFiles) release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := r.nodes[key]; n != nil {
+		if n.refs--; n.refs == 0 {
+			delete(r.nodes, key)
+		}
+	}
+}
+
+// encryptedFile implements billy.File for an EncryptedFS.
+type encryptedFile struct {
+	e    *EncryptedFS
+	f    billy.File
+	name string
+	flag int
+	key  string
+	node *encryptedNode
+
+	// mu guards pos and closed; it is taken before node.mu.
+	mu     sync.Mutex
+	aead   cipher.AEAD
+	salt   []byte
+	pos    int64
+	closed bool
+}
+
+// init reads the header of the file, or writes one for a new file.
+func (f *encryptedFile) init() error {
+	end, err := f.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, encHeaderSize)
+	switch {
+	case end == 0 && !f.writable():
+		f.node.size = 0
+		return nil
+	case end == 0:
+		copy(header, encMagic)
+		binary.BigEndian.PutUint32(header[len(encMagic):], uint32(f.e.chunkSize))
+		if _, err := rand.Read(header[len(encMagic)+4:]); err != nil {
+			return err
+		}
+		if err := writeFullAt(f.f, header, 0); err != nil {
+			return err
+		}
+	default:
+		if _, err := f.f.ReadAt(header, 0); err != nil {
+			if err == io.EOF {
+				return ErrDecrypt
+			}
+			return err
+		}
+		if string(header[:len(encMagic)]) != encMagic {
+			return ErrDecrypt
+		}
+		if int(binary.BigEndian.Uint32(header[len(encMagic):])) != f.e.chunkSize {
+			return errors.New("billyfs: encryption chunk size mismatch")
+		}
+	}
+
+	f.salt = header[len(encMagic)+4:]
+	aead, err := newGCM(deriveKey(f.e.fileKey, "chunk", f.salt))
+	if err != nil {
+		return err
+	}
+	f.aead = aead
+	f.node.size = f.e.plainSize(end)
+	return nil
+}
+
+func (f *encryptedFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// chunkAAD binds a chunk to its file, position and whether it is the last
+// chunk, so chunks cannot be moved, swapped or cut off undetected.
+func (f *encryptedFile) chunkAAD(i int64, final bool) []byte {
+	aad := make([]byte, 0, len(f.salt)+9)
+	aad = append(aad, f.salt...)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(i))
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+func (f *encryptedFile) chunkOffset(i int64) int64 {
+	return int64(encHeaderSize) + i*f.e.diskChunkSize()
+}
+
+// readChunk returns the plaintext of chunk i of a file of the current
+// size.
+func (f *encryptedFile) readChunk(i int64) ([]byte, error) {
+	cs := int64(f.e.chunkSize)
+	n := min(cs, f.node.size-i*cs)
+	sealed := make([]byte, n+encOverhead)
+	if _, err := f.f.ReadAt(sealed, f.chunkOffset(i)); err != nil {
+		if err == io.EOF {
+			return nil, ErrDecrypt
+		}
+		return nil, err
+	}
+	final := i == (f.node.size-1)/cs
+	plain, err := f.aead.Open(sealed[encNonceSize:encNonceSize], sealed[:encNonceSize], sealed[encNonceSize:], f.chunkAAD(i, final))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// writeChunk seals plain as chunk i.
+func (f *encryptedFile) writeChunk(i int64, plain []byte, final bool) error {
+	sealed := make([]byte, encNonceSize, encNonceSize+len(plain)+encOverhead)
+	if _, err := rand.Read(sealed); err != nil {
+		return err
+	}
+	sealed = f.aead.Seal(sealed, sealed, plain, f.chunkAAD(i, final))
+	return writeFullAt(f.f, sealed, f.chunkOffset(i))
+}
+
+// writeFullAt writes p at off in file, which need not implement
+// io.WriterAt. The file offset is not preserved.
+func writeFullAt(file billy.File, p []byte, off int64) error {
+	if w, ok := file.(io.WriterAt); ok {
+		_, err := w.WriteAt(p, off)
+		return err
+	}
+	if _, err := file.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := file.Write(p)
+	return err
+}
+
+// update writes p at off and grows the file to newSize, re-encrypting every
+// affected chunk. Chunks between the old end of the file and off are
+// filled with zeros, and the previous last chunk is re-sealed as a
+// non-final chunk.
+func (f *encryptedFile) update(off int64, p []byte, newSize int64) error {
+	cs := int64(f.e.chunkSize)
+	end := off + int64(len(p))
+	if newSize == 0 || (end == off && newSize == f.node.size) {
+		return nil
+	}
+
+	first, last := off/cs, (end-1)/cs
+	if newSize > f.node.size {
+		if f.node.size > 0 {
+			first = min(first, (f.node.size-1)/cs)
+		} else {
+			first = 0
+		}
+		last = (newSize - 1) / cs
+	}
+	newLast := (newSize - 1) / cs
+
+	for i := first; i <= last; i++ {
+		start := i * cs
+		buf := make([]byte, min(cs, newSize-start))
+		if start < f.node.size {
+			old, err := f.readChunk(i)
+			if err != nil {
+				return err
+			}
+			copy(buf, old)
+		}
+		if lo, hi := max(start, off), min(start+int64(len(buf)), end); lo < hi {
+			copy(buf[lo-start:], p[lo-off:hi-off])
+		}
+		if err := f.writeChunk(i, buf, i == newLast); err != nil {
+			return err
+		}
+	}
+	f.node.size = newSize
+	return nil
+}
+
+func (f *encryptedFile) Name() string {
+	return f.name
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *encryptedFile) readAt(p []byte, off int64) (int, error) {
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	cs := int64(f.e.chunkSize)
+	n := 0
+	for n < len(p) && off < f.node.size {
+		i := off / cs
+		plain, err := f.readChunk(i)
+		if err != nil {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		c := copy(p[n:], plain[off-i*cs:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = f.node.size
+	}
+	n, err := f.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at off, extending the file with zeros if off is beyond
+// its end.
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *encryptedFile) writeAt(p []byte, off int64) (int, error) {
+	if !f.writable() {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	if err := f.update(off, p, max(f.node.size, off+int64(len(p)))); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	return len(p), nil
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.node.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Truncate changes the plaintext size of the file, re-sealing the new last
+// chunk.
+func (f *encryptedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if !f.writable() {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	var err error
+	switch {
+	case size > f.node.size:
+		err = f.update(f.node.size, nil, size)
+	case size == 0:
+		if err = f.f.Truncate(int64(encHeaderSize)); err == nil {
+			f.node.size = 0
+		}
+	case size < f.node.size:
+		err = f.shrink(size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// shrink cuts the file down to size, which is positive and smaller than the
+// current size.
+func (f *encryptedFile) shrink(size int64) error {
+	cs := int64(f.e.chunkSize)
+	last := (size - 1) / cs
+	plain, err := f.readChunk(last)
+	if err != nil {
+		return err
+	}
+	plain = plain[:size-last*cs]
+	if err := f.f.Truncate(f.chunkOffset(last) + int64(len(plain)+encOverhead)); err != nil {
+		return err
+	}
+	if err := f.writeChunk(last, plain, true); err != nil {
+		return err
+	}
+	f.node.size = size
+	return nil
+}
+
+func (f *encryptedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		f.e.files.release(f.key)
+	}
+	return f.f.Close()
+}
+
+func (f *encryptedFile) Lock() error {
+	return f.f.Lock()
+}
+
+func (f *encryptedFile) Unlock() error {
+	return f.f.Unlock()
+}
@@ -0,0 +1,342 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+var testMasterKey = bytes.Repeat([]byte{0x42}, 32)
+
+// newEncryptedTestFS creates an EncryptedFS over a temporary billyfs
+// filesystem
+func newEncryptedTestFS(t *testing.T, opts billyfs.EncryptionOptions) (*billyfs.EncryptedFS, *billyfs.Filesystem, string) {
+	t.Helper()
+	bfs, tmpDir := newTestFS(t)
+	efs, err := billyfs.NewEncryptedFS(bfs, testMasterKey, opts)
+	if err != nil {
+		t.Fatalf("NewEncryptedFS failed: %v", err)
+	}
+	return efs, bfs, tmpDir
+}
+
+// TestEncryptedRoundTrip tests that contents are stored encrypted
+func TestEncryptedRoundTrip(t *testing.T) {
+	efs, _, tmpDir := newEncryptedTestFS(t, billyfs.EncryptionOptions{})
+
+	secret := strings.Repeat("top secret source code ", 500)
+	f, err := efs.Create("secret.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write([]byte(secret)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(tmpDir, "secret.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Error("plaintext found in stored file")
+	}
+
+	f, err = efs.Open("secret.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(data) != secret {
+		t.Error("decrypted content does not match")
+	}
+
+	info, err := efs.Stat("secret.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != int64(len(secret)) {
+		t.Errorf("expected size %d, got %d", len(secret), info.Size())
+	}
+	infos, err := efs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Size() != int64(len(secret)) {
+		t.Errorf("expected ReadDir to report size %d, got %v", len(secret), infos)
+	}
+}
+
+// TestEncryptedRandomAccess compares random reads, writes, seeks and
+// truncations against an in-memory model
+func TestEncryptedRandomAccess(t *testing.T) {
+	efs, _, _ := newEncryptedTestFS(t, billyfs.EncryptionOptions{ChunkSize: 16})
+
+	f, err := efs.Create("random.bin")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	w := f.(io.WriterAt)
+
+	rng := rand.New(rand.NewSource(1))
+	var model []byte
+	for i := 0; i < 300; i++ {
+		switch rng.Intn(4) {
+		case 0, 1:
+			off := rng.Int63n(int64(len(model)) + 40)
+			p := make([]byte, rng.Intn(50))
+			rng.Read(p)
+			if _, err := w.WriteAt(p, off); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			if end := off + int64(len(p)); end > int64(len(model)) {
+				model = append(model, make([]byte, end-int64(len(model)))...)
+			}
+			copy(model[off:], p)
+		case 2:
+			size := rng.Int63n(int64(len(model)) + 40)
+			if err := f.Truncate(size); err != nil {
+				t.Fatalf("Truncate failed: %v", err)
+			}
+			if size > int64(len(model)) {
+				model = append(model, make([]byte, size-int64(len(model)))...)
+			}
+			model = model[:size]
+		case 3:
+			off := rng.Int63n(int64(len(model)) + 1)
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				t.Fatalf("Seek failed: %v", err)
+			}
+			p := make([]byte, rng.Intn(50))
+			n, err := f.Read(p)
+			if err != nil && err != io.EOF {
+				t.Fatalf("Read failed: %v", err)
+			}
+			want := model[off:min(int(off)+len(p), len(model))]
+			if !bytes.Equal(p[:n], want) {
+				t.Fatalf("step %d: read mismatch at %d", i, off)
+			}
+		}
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if end != int64(len(model)) {
+		t.Errorf("expected size %d, got %d", len(model), end)
+	}
+	info, err := efs.Stat("random.bin")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != int64(len(model)) {
+		t.Errorf("expected Stat size %d, got %d", len(model), info.Size())
+	}
+
+	got := make([]byte, len(model))
+	if _, err := f.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, model) {
+		t.Error("final content does not match model")
+	}
+}
+
+// TestEncryptedAppend tests O_APPEND handling
+func TestEncryptedAppend(t *testing.T) {
+	efs, _, _ := newEncryptedTestFS(t, billyfs.EncryptionOptions{ChunkSize: 8})
+
+	for _, s := range []string{"hello", " ", "world"} {
+		f, err := efs.OpenFile("log.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		f.Close()
+	}
+
+	f, err := efs.Open("log.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	if string(data) != "hello world" {
+		t.Errorf("expected 'hello world', got %q", data)
+	}
+}
+
+// TestEncryptedHandles tests that two handles of a file see the size
+// changes made through each other
+func TestEncryptedHandles(t *testing.T) {
+	efs, _, _ := newEncryptedTestFS(t, billyfs.EncryptionOptions{ChunkSize: 8})
+
+	a, err := efs.OpenFile("shared.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer a.Close()
+	b, err := efs.OpenFile("shared.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer b.Close()
+
+	for _, step := range []struct {
+		f billy.File
+		s string
+	}{{a, "0123456789"}, {b, "abc"}, {a, "XYZ"}, {b, "def"}} {
+		if _, err := step.f.Write([]byte(step.s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := a.Truncate(15); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if _, err := b.Write([]byte("!")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	want := "0123456789XYZde!"
+	got := make([]byte, 32)
+	n, err := a.ReadAt(got, 0)
+	if err != io.EOF {
+		t.Fatalf("ReadAt: expected io.EOF, got %v", err)
+	}
+	if string(got[:n]) != want {
+		t.Errorf("expected %q, got %q", want, got[:n])
+	}
+	if info, err := efs.Stat("shared.txt"); err != nil || info.Size() != int64(len(want)) {
+		t.Errorf("expected size %d, got %v, %v", len(want), info, err)
+	}
+}
+
+// TestEncryptedTampering tests that modified or misplaced data is rejected
+func TestEncryptedTampering(t *testing.T) {
+	efs, bfs, tmpDir := newEncryptedTestFS(t, billyfs.EncryptionOptions{ChunkSize: 16})
+
+	f, err := efs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write(bytes.Repeat([]byte("a"), 64))
+	f.Close()
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, err := billyfs.NewEncryptedFS(bfs, bytes.Repeat([]byte{1}, 32), billyfs.EncryptionOptions{ChunkSize: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := other.Open("file.txt")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		if _, err := io.ReadAll(f); err == nil {
+			t.Error("expected authentication error")
+		}
+	})
+
+	t.Run("truncated at chunk boundary", func(t *testing.T) {
+		raw := filepath.Join(tmpDir, "file.txt")
+		data, err := os.ReadFile(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drop the last sealed chunk: header (40) + 3 chunks of 16+28.
+		if err := os.WriteFile(raw, data[:40+3*44], 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := efs.Open("file.txt")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer f.Close()
+		if _, err := io.ReadAll(f); err == nil {
+			t.Error("expected authentication error")
+		}
+	})
+
+	t.Run("invalid key size", func(t *testing.T) {
+		if _, err := billyfs.NewEncryptedFS(bfs, []byte("short"), billyfs.EncryptionOptions{}); err != billyfs.ErrInvalidKey {
+			t.Errorf("expected ErrInvalidKey, got %v", err)
+		}
+	})
+}
+
+// TestEncryptedNames tests filename and symlink target encryption
+func TestEncryptedNames(t *testing.T) {
+	efs, _, tmpDir := newEncryptedTestFS(t, billyfs.EncryptionOptions{EncryptNames: true})
+
+	if err := efs.MkdirAll("private/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	f, err := efs.Create("private/dir/customer.go")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write([]byte("package customer"))
+	f.Close()
+	if err := efs.Symlink("private/dir/customer.go", "link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	err = filepath.Walk(tmpDir, func(p string, info os.FileInfo, err error) error {
+		for _, word := range []string{"private", "customer", "link"} {
+			if strings.Contains(filepath.Base(p), word) {
+				t.Errorf("plaintext name stored: %s", p)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := efs.ReadDir("private/dir")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "customer.go" || infos[0].Size() != 16 {
+		t.Errorf("unexpected ReadDir result: %v", infos)
+	}
+
+	target, err := efs.Readlink("link")
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if target != "private/dir/customer.go" {
+		t.Errorf("expected decrypted target, got %q", target)
+	}
+
+	sub, err := efs.Chroot("private")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	f, err = sub.Open("dir/customer.go")
+	if err != nil {
+		t.Fatalf("Open in chroot failed: %v", err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	if string(data) != "package customer" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
@@ -0,0 +1,103 @@
+package billyfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// DefaultMaxSymlinks is the number of symbolic links EvalSymlinks follows
+// when Options.MaxSymlinks is zero, the limit of Linux.
+const DefaultMaxSymlinks = 40
+
+// EvalSymlinks returns the path name refers to after resolving all
+// symbolic links in it. Absolute link targets are resolved from the root
+// of the Filesystem and relative ones from the directory of the link; ".."
+// at the root stays at the root, so the result never leaves Root(). The
+// result is absolute if name is, and relative to the root otherwise.
+//
+// EvalSymlinks fails with a *fs.PathError wrapping syscall.ELOOP after
+// following more links than Options.MaxSymlinks, which catches loops, and
+// with the error of Lstat if an element of the path does not exist.
+func (f *Filesystem) EvalSymlinks(name string) (string, error) {
+	resolved, err := f.evalSymlinks(name, false)
+	if err != nil || path.IsAbs(name) {
+		return resolved, err
+	}
+	if resolved == "/" {
+		return ".", nil
+	}
+	return resolved[1:], nil
+}
+
+// Realpath is like EvalSymlinks but always returns an absolute path.
+func (f *Filesystem) Realpath(name string) (string, error) {
+	return f.evalSymlinks(name, false)
+}
+
+// evalSymlinks resolves name and returns an absolute path. If missing is
+// true, the elements from the first one that does not exist on are joined
+// to the result lexically instead of failing.
+func (f *Filesystem) evalSymlinks(name string, missing bool) (string, error) {
+	limit := f.maxSymlinks
+	if limit == 0 {
+		limit = DefaultMaxSymlinks
+	}
+	resolved := "/"
+	links := 0
+	elems := strings.Split(name, "/")
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		// The backend is asked directly, as paths are also resolved to
+		// invalidate the metadata cache.
+		next := path.Join(resolved, elem)
+		info, err := f.fs.Lstat(next)
+		if missing && os.IsNotExist(err) {
+			return path.Join(append([]string{next}, elems...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			if !info.IsDir() && hasElems(elems) {
+				return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: syscall.ENOTDIR}
+			}
+			resolved = next
+			continue
+		}
+
+		if links++; links > limit {
+			return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := f.fs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		elems = append(strings.Split(target, "/"), elems...)
+	}
+	return resolved, nil
+}
+
+// hasElems reports whether elems names anything below the current path.
+func hasElems(elems []string) bool {
+	for _, elem := range elems {
+		if elem != "" && elem != "." {
+			return true
+		}
+	}
+	return false
+}
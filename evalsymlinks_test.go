@@ -0,0 +1,110 @@
+package billyfs_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// TestEvalSymlinks tests resolving relative and absolute links within the
+// root
+func TestEvalSymlinks(t *testing.T) {
+	bfs, dir := newTestFS(t)
+	setupGlobTree(t, bfs, "a/b/file", "etc/passwd")
+	links := map[string]string{
+		"rel":    "a/b",
+		"a/up":   "../a/b/file",
+		"abs":    "/a/b",
+		"escape": "../../../../etc",
+		"chain":  "rel/../up",
+	}
+	for link, target := range links {
+		if err := bfs.Symlink(target, link); err != nil {
+			t.Fatalf("Symlink failed: %v", err)
+		}
+	}
+	// Absolute targets written by other programs refer to the host.
+	os.Symlink("/../../etc/passwd", filepath.Join(dir, "abs-escape"))
+	os.Symlink("/etc", filepath.Join(dir, "host"))
+
+	tests := []struct {
+		name, want string
+	}{
+		{"a/b/file", "a/b/file"},
+		{"/a/b/file", "/a/b/file"},
+		{"rel", "a/b"},
+		{"/rel", "/a/b"},
+		{"rel/file", "a/b/file"},
+		{"rel/../b", "a/b"},
+		{"a/up", "a/b/file"},
+		{"abs/file", "a/b/file"},
+		{"escape/passwd", "etc/passwd"},
+		{"abs-escape", "etc/passwd"},
+		{"host/passwd", "etc/passwd"},
+		{"../../rel", "a/b"},
+		{"chain", "a/b/file"},
+		{".", "."},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		got, err := bfs.EvalSymlinks(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("EvalSymlinks(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if got, err := bfs.Realpath("rel/file"); err != nil || got != "/a/b/file" {
+		t.Errorf("Realpath = %q, %v; want /a/b/file", got, err)
+	}
+
+	if _, err := bfs.EvalSymlinks("rel/missing"); err == nil {
+		t.Error("expected missing path to fail")
+	}
+	if _, err := bfs.EvalSymlinks("a/b/file/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("expected ENOTDIR, got %v", err)
+	}
+
+	// Absolute targets resolve from the root of a chroot.
+	sub, err := bfs.Chroot("a")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	bfs.Symlink("/a/b", "a/abs")
+	if got, err := sub.(*billyfs.Filesystem).EvalSymlinks("abs/file"); err != nil || got != "b/file" {
+		t.Errorf("EvalSymlinks in chroot = %q, %v; want b/file", got, err)
+	}
+}
+
+// TestEvalSymlinksLoop tests failing with ELOOP on loops and long chains
+func TestEvalSymlinksLoop(t *testing.T) {
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	bfs, err := billyfs.NewFSWithOptions(backend, t.TempDir(), billyfs.Options{MaxSymlinks: 3})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	bfs.Symlink("loop2", "loop1")
+	bfs.Symlink("./loop1", "loop2")
+	bfs.Symlink("self/x", "self")
+	setupGlobTree(t, bfs, "target")
+	for i := 1; i <= 4; i++ {
+		bfs.Symlink(fmt.Sprintf("link%d", i-1), fmt.Sprintf("link%d", i))
+	}
+	bfs.Symlink("target", "link0")
+
+	for _, name := range []string{"loop1", "self", "link4"} {
+		if _, err := bfs.EvalSymlinks(name); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("EvalSymlinks(%q): expected ELOOP, got %v", name, err)
+		}
+	}
+	if got, err := bfs.EvalSymlinks("link2"); err != nil || got != "target" {
+		t.Errorf("EvalSymlinks(link2) = %q, %v; want target", got, err)
+	}
+}
@@ -0,0 +1,193 @@
+package billyfs
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Glob returns the names of all files matching pattern, in lexical order,
+// or nil if there is no matching file. Besides the syntax of path.Match
+// within a path element, pattern may contain a "**" element, which
+// matches zero or more directories, and brace alternatives such as
+// "*.{go,mod}", which may be nested. Only the directories that can hold
+// matches are read. As with filepath.Glob, I/O errors are ignored and the
+// only possible error is path.ErrBadPattern.
+func (f *Filesystem) Glob(pattern string) ([]string, error) {
+	return f.glob(pattern, nil)
+}
+
+// glob implements Glob, skipping the files ignored by m if it is not nil.
+func (f *Filesystem) glob(pattern string, m *IgnoreMatcher) ([]string, error) {
+	patterns := expandBraces(pattern)
+	g := &globber{fs: f, ignore: m, seen: make(map[string]bool)}
+	for _, p := range patterns {
+		root := "."
+		if path.IsAbs(p) {
+			root = "/"
+		}
+		var segs []string
+		for _, seg := range strings.Split(p, "/") {
+			if seg == "" {
+				continue
+			}
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, err
+			}
+			segs = append(segs, seg)
+		}
+		if len(segs) > 0 {
+			g.match(root, segs)
+		}
+	}
+	sort.Strings(g.matches)
+	return g.matches, nil
+}
+
+// globber holds the state of a Glob call.
+type globber struct {
+	fs      *Filesystem
+	ignore  *IgnoreMatcher
+	seen    map[string]bool
+	matches []string
+}
+
+// match adds the files under dir matching the pattern elements segs.
+func (g *globber) match(dir string, segs []string) {
+	if len(segs) == 0 {
+		if !g.seen[dir] && dir != "." && dir != "/" {
+			g.seen[dir] = true
+			g.matches = append(g.matches, dir)
+		}
+		return
+	}
+	seg, rest := segs[0], segs[1:]
+
+	if seg == "**" {
+		g.match(dir, rest)
+		for _, entry := range g.list(dir) {
+			switch name := path.Join(dir, entry.Name()); {
+			case entry.IsDir():
+				g.match(name, segs)
+			case len(rest) == 0:
+				g.match(name, rest)
+			}
+		}
+		return
+	}
+
+	if !hasMeta(seg) {
+		name := path.Join(dir, seg)
+		info, err := g.fs.Lstat(name)
+		if err != nil || g.ignore.skip(name, info.IsDir()) {
+			return
+		}
+		if len(rest) == 0 || g.isDir(name, info.Mode()) {
+			g.match(name, rest)
+		}
+		return
+	}
+
+	for _, entry := range g.list(dir) {
+		if ok, _ := path.Match(seg, entry.Name()); !ok {
+			continue
+		}
+		name := path.Join(dir, entry.Name())
+		if len(rest) == 0 || g.isDir(name, entry.Type()) {
+			g.match(name, rest)
+		}
+	}
+}
+
+// list returns the entries of dir that are not ignored.
+func (g *globber) list(dir string) []fs.DirEntry {
+	entries, _ := g.fs.readDirEntries(dir)
+	if g.ignore == nil {
+		return entries
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !g.ignore.skip(path.Join(dir, entry.Name()), entry.IsDir()) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// isDir reports whether name, of the given type, is a directory or a
+// symbolic link to one.
+func (g *globber) isDir(name string, mode fs.FileMode) bool {
+	if mode&fs.ModeSymlink != 0 {
+		info, err := g.fs.Stat(name)
+		return err == nil && info.IsDir()
+	}
+	return mode.IsDir()
+}
+
+// hasMeta reports whether a path element contains pattern syntax.
+func hasMeta(seg string) bool {
+	return strings.ContainsAny(seg, `*?[\`)
+}
+
+// expandBraces returns the patterns described by the brace alternatives of
+// pattern. A brace without a matching closing brace is taken literally.
+func expandBraces(pattern string) []string {
+	open, depth := -1, 0
+	var commas []int
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				open = i
+				commas = commas[:0]
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			if depth--; depth > 0 {
+				continue
+			}
+			prefix, suffix := pattern[:open], pattern[i+1:]
+			var out []string
+			start := open + 1
+			for _, end := range append(commas, i) {
+				out = append(out, expandBraces(prefix+pattern[start:end]+suffix)...)
+				start = end + 1
+			}
+			return out
+		}
+	}
+	return []string{pattern}
+}
+
+// matchSegments reports whether the path elements name match the pattern
+// elements pat, where a "**" element matches zero or more elements.
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
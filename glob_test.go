@@ -0,0 +1,76 @@
+package billyfs_test
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/billyfs"
+)
+
+// setupGlobTree creates files for the Glob tests
+func setupGlobTree(t *testing.T, bfs *billyfs.Filesystem, files ...string) {
+	t.Helper()
+	for _, name := range files {
+		if err := bfs.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		writeBillyFile(t, bfs, name, nil)
+	}
+}
+
+// TestGlob tests the pattern syntax of Glob
+func TestGlob(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	setupGlobTree(t, bfs, "go.mod", "main.go", "README.md",
+		"cmd/tool/main.go", "cmd/tool/main_test.go",
+		"internal/a/a.go", "internal/b/b.go", "internal/b/data/x.json",
+		"docs/guide.md", "docs/img/logo.png")
+
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"main.go"}},
+		{"**/*.go", []string{"cmd/tool/main.go", "cmd/tool/main_test.go", "internal/a/a.go", "internal/b/b.go", "main.go"}},
+		{"**/main.go", []string{"cmd/tool/main.go", "main.go"}},
+		{"*.{go,mod}", []string{"go.mod", "main.go"}},
+		{"{cmd,docs}/**/*.{md,png}", []string{"docs/guide.md", "docs/img/logo.png"}},
+		{"internal/[a-b]/?.go", []string{"internal/a/a.go", "internal/b/b.go"}},
+		{"internal/[^a]/*", []string{"internal/b/b.go", "internal/b/data"}},
+		{"internal/**", []string{"internal", "internal/a", "internal/a/a.go", "internal/b", "internal/b/b.go", "internal/b/data", "internal/b/data/x.json"}},
+		{"/docs/*.md", []string{"/docs/guide.md"}},
+		{"cmd/tool/main{,_test}.go", []string{"cmd/tool/main.go", "cmd/tool/main_test.go"}},
+		{"missing/**/*.go", nil},
+	} {
+		got, err := bfs.Glob(tc.pattern)
+		if err != nil {
+			t.Errorf("Glob(%q) failed: %v", tc.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Glob(%q): got %v, want %v", tc.pattern, got, tc.want)
+		}
+	}
+
+	if _, err := bfs.Glob("internal/[a"); err != path.ErrBadPattern {
+		t.Errorf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+// TestGlobPruning tests that Glob reads only the directories that can hold
+// matches
+func TestGlobPruning(t *testing.T) {
+	bfs, counting := setupWalkTree(t)
+	got, err := bfs.Glob("a/b/*")
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	if want := []string{"a/b/1", "a/b/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected matches %v", got)
+	}
+	// Literal elements are stat'ed rather than listed.
+	if n := counting.stats.Load(); n != 2 {
+		t.Errorf("expected 2 stats, got %d", n)
+	}
+}
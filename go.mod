@@ -7,4 +7,5 @@ require (
 	github.com/absfs/basefs v1.0.1-0.20251215211035-e448bdbe7e79
 	github.com/absfs/osfs v1.0.1-0.20251215210911-de085c499e3f
 	github.com/go-git/go-billy/v5 v5.7.0
+	golang.org/x/sys v0.31.0
 )
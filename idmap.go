@@ -0,0 +1,145 @@
+package billyfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// OverflowID is the id reported for files owned by a host id outside the
+// ranges of an IDMap, as the kernel does for user namespaces.
+const OverflowID = 65534
+
+// IDRange maps Count consecutive ids starting at ContainerID to the ids
+// starting at HostID, like a line of /proc/self/uid_map or a range
+// delegated in /etc/subuid.
+type IDRange struct {
+	ContainerID int
+	HostID      int
+	Count       int
+}
+
+// IDMap translates the user and group ids seen by users of a Filesystem to
+// the ids of the backend. Ranges should not overlap; the first matching
+// range is used.
+type IDMap struct {
+	UIDs []IDRange
+	GIDs []IDRange
+}
+
+// ParseIDMap parses ranges in the format of /proc/self/uid_map: a line per
+// range with the container id, the host id and the count separated by
+// spaces.
+func ParseIDMap(r io.Reader) ([]IDRange, error) {
+	var ranges []IDRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var ids [3]int
+		if len(fields) != len(ids) {
+			return nil, fmt.Errorf("billyfs: id map line %d: expected 3 fields", line)
+		}
+		for i, field := range fields {
+			id, err := strconv.Atoi(field)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("billyfs: id map line %d: invalid id %q", line, field)
+			}
+			ids[i] = id
+		}
+		ranges = append(ranges, IDRange{ContainerID: ids[0], HostID: ids[1], Count: ids[2]})
+	}
+	return ranges, scanner.Err()
+}
+
+// toHost returns the host id of the container id.
+func toHost(ranges []IDRange, id int) (int, bool) {
+	for _, r := range ranges {
+		if id >= r.ContainerID && id-r.ContainerID < r.Count {
+			return r.HostID + id - r.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// toContainer returns the container id of the host id, or OverflowID.
+func toContainer(ranges []IDRange, id int) int {
+	for _, r := range ranges {
+		if id >= r.HostID && id-r.HostID < r.Count {
+			return r.ContainerID + id - r.HostID
+		}
+	}
+	return OverflowID
+}
+
+// chownIDs returns the host ids for Chown and Lchown. An id of -1, which
+// leaves the id unchanged, is kept.
+func (f *Filesystem) chownIDs(op, name string, uid, gid int) (int, int, error) {
+	if f.idmap == nil {
+		return uid, gid, nil
+	}
+	var ok bool
+	if uid != -1 {
+		if uid, ok = toHost(f.idmap.UIDs, uid); !ok {
+			return 0, 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	if gid != -1 {
+		if gid, ok = toHost(f.idmap.GIDs, gid); !ok {
+			return 0, 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	return uid, gid, nil
+}
+
+// Owner returns the user and group ids of the owner of the file described
+// by info, as reported by Stat, Lstat or ReadDir. It reports false if the
+// backend does not provide them.
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	if info == nil {
+		return 0, 0, false
+	}
+	if m, ok := info.(*idFileInfo); ok {
+		return m.uid, m.gid, true
+	}
+	return sysOwner(info.Sys())
+}
+
+// idFileInfo is the FileInfo of a file whose owner is translated by an
+// IDMap. Its Sys value reports the translated ids where the platform has
+// them.
+type idFileInfo struct {
+	os.FileInfo
+	uid, gid int
+}
+
+func (i *idFileInfo) Sys() any {
+	return sysWithOwner(i.FileInfo.Sys(), i.uid, i.gid)
+}
+
+func (i *idFileInfo) unwrap() os.FileInfo {
+	return i.FileInfo
+}
+
+// idInfo returns info with the ids of its owner translated to container
+// ids.
+func (f *Filesystem) idInfo(info os.FileInfo) os.FileInfo {
+	if f.idmap == nil || info == nil {
+		return info
+	}
+	uid, gid, ok := sysOwner(info.Sys())
+	if !ok {
+		return info
+	}
+	return &idFileInfo{
+		FileInfo: info,
+		uid:      toContainer(f.idmap.UIDs, uid),
+		gid:      toContainer(f.idmap.GIDs, gid),
+	}
+}
@@ -0,0 +1,108 @@
+package billyfs_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// sysOnly hides the concrete type of a FileInfo so only its Sys value is
+// used
+type sysOnly struct {
+	os.FileInfo
+}
+
+// TestParseIDMap tests parsing ranges in the uid_map format
+func TestParseIDMap(t *testing.T) {
+	ranges, err := billyfs.ParseIDMap(strings.NewReader("0 1000 1\n\n1 100000 65536\n"))
+	if err != nil {
+		t.Fatalf("ParseIDMap failed: %v", err)
+	}
+	want := []billyfs.IDRange{{0, 1000, 1}, {1, 100000, 65536}}
+	if len(ranges) != 2 || ranges[0] != want[0] || ranges[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, ranges)
+	}
+	for _, bad := range []string{"0 1000", "0 x 1", "0 -1 1"} {
+		if _, err := billyfs.ParseIDMap(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestIDMap tests translating ids in Chown, Lchown, Stat, Lstat and
+// ReadDir
+func TestIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners requires root")
+	}
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	ranges := []billyfs.IDRange{{ContainerID: 0, HostID: 100000, Count: 65536}}
+	idmap := &billyfs.IDMap{UIDs: ranges, GIDs: ranges}
+
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		dir := t.TempDir()
+		bfs, err := billyfs.NewFSWithOptions(backend, dir, billyfs.Options{
+			IDMap:         idmap,
+			MetadataCache: billyfs.MetadataCacheOptions{TTL: ttl},
+		})
+		if err != nil {
+			t.Fatalf("failed to create billyfs: %v", err)
+		}
+		setupGlobTree(t, bfs, "owned", "unmapped")
+		bfs.Symlink("owned", "link")
+
+		if err := bfs.Chown("owned", 1000, 1001); err != nil {
+			t.Fatalf("Chown failed: %v", err)
+		}
+		if err := bfs.Lchown("link", 5, -1); err != nil {
+			t.Fatalf("Lchown failed: %v", err)
+		}
+		native, _ := os.Lstat(filepath.Join(dir, "owned"))
+		if uid, gid, _ := billyfs.Owner(native); uid != 101000 || gid != 101001 {
+			t.Errorf("expected host ids 101000:101001, got %d:%d", uid, gid)
+		}
+		os.Lchown(filepath.Join(dir, "unmapped"), 0, 0)
+
+		assertOwner := func(what string, info os.FileInfo, uid, gid int) {
+			t.Helper()
+			for _, i := range []os.FileInfo{info, sysOnly{info}} {
+				if u, g, ok := billyfs.Owner(i); !ok || u != uid || g != gid {
+					t.Errorf("%s: expected %d:%d, got %d:%d", what, uid, gid, u, g)
+				}
+			}
+		}
+		info, _ := bfs.Stat("owned")
+		assertOwner("Stat", info, 1000, 1001)
+		info, _ = bfs.Lstat("link")
+		assertOwner("Lstat", info, 5, billyfs.OverflowID)
+		info, _ = bfs.Stat("unmapped")
+		assertOwner("unmapped", info, billyfs.OverflowID, billyfs.OverflowID)
+
+		// Reading a cached directory again must not map the ids twice.
+		for i := 0; i < 2; i++ {
+			infos, err := bfs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			for _, info := range infos {
+				if info.Name() == "owned" {
+					assertOwner("ReadDir", info, 1000, 1001)
+				}
+			}
+		}
+
+		if err := bfs.Chown("owned", 70000, -1); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("expected unmapped id to be rejected, got %v", err)
+		}
+	}
+}
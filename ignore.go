@@ -0,0 +1,192 @@
+package billyfs
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// IgnoreMatcher reports which files of a Git worktree are ignored by the
+// patterns of its .git/info/exclude file and of the .gitignore files in
+// the worktree, with the precedence rules of Git: a pattern in a deeper
+// .gitignore overrides one in a shallower file, which overrides
+// .git/info/exclude, and the last matching pattern of a file wins. The
+// .git directory itself is always ignored. .gitignore files are read as
+// the directories holding them are matched.
+//
+// Pass an IgnoreMatcher in WalkOptions.Ignore, or call its Glob method, to
+// skip ignored files; ignored directories are never read.
+type IgnoreMatcher struct {
+	fs      *Filesystem
+	root    string
+	exclude []ignorePattern
+
+	mu   sync.Mutex
+	dirs map[string][]ignorePattern
+}
+
+// ignorePattern is a parsed line of an ignore file.
+type ignorePattern struct {
+	segs    []string
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnoreMatcher returns an IgnoreMatcher for the worktree rooted at
+// root.
+func (f *Filesystem) NewIgnoreMatcher(root string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{
+		fs:   f,
+		root: path.Join("/", root),
+		dirs: make(map[string][]ignorePattern),
+	}
+	exclude, err := m.readPatterns(path.Join(m.root, ".git/info/exclude"))
+	if err != nil {
+		return nil, err
+	}
+	m.exclude = exclude
+	return m, nil
+}
+
+// Match reports whether the file name, a directory if isDir is set, is
+// ignored, either itself or because one of its parent directories is.
+// Files outside the worktree are not ignored.
+func (m *IgnoreMatcher) Match(name string, isDir bool) bool {
+	rel, ok := m.relParts(name)
+	if !ok {
+		return false
+	}
+	for i := 1; i < len(rel); i++ {
+		if m.excluded(rel[:i], true) {
+			return true
+		}
+	}
+	return m.excluded(rel, isDir)
+}
+
+// Glob is like Filesystem.Glob but skips ignored files.
+func (m *IgnoreMatcher) Glob(pattern string) ([]string, error) {
+	return m.fs.glob(pattern, m)
+}
+
+// skip reports whether the file name is ignored, assuming its parent
+// directories are not. A nil IgnoreMatcher ignores nothing.
+func (m *IgnoreMatcher) skip(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel, ok := m.relParts(name)
+	return ok && m.excluded(rel, isDir)
+}
+
+// relParts returns the path elements of name relative to the root of the
+// worktree.
+func (m *IgnoreMatcher) relParts(name string) ([]string, bool) {
+	p := path.Join("/", name)
+	switch {
+	case p == m.root:
+		return nil, true
+	case isWithin(m.root, p):
+		return strings.Split(strings.TrimPrefix(p[len(m.root):], "/"), "/"), true
+	}
+	return nil, false
+}
+
+// excluded reports whether the file with the path elements rel is ignored
+// by the patterns that apply to it, regardless of its parent directories.
+func (m *IgnoreMatcher) excluded(rel []string, isDir bool) bool {
+	if len(rel) == 0 {
+		return false
+	}
+	if isDir && rel[len(rel)-1] == ".git" {
+		return true
+	}
+	ignored := false
+	apply := func(patterns []ignorePattern, sub []string) {
+		for _, p := range patterns {
+			if (!p.dirOnly || isDir) && matchSegments(p.segs, sub) {
+				ignored = !p.negate
+			}
+		}
+	}
+	apply(m.exclude, rel)
+	for i := range rel {
+		apply(m.dirPatterns(rel[:i]), rel[i:])
+	}
+	return ignored
+}
+
+// dirPatterns returns the patterns of the .gitignore file of the directory
+// with the path elements dir, reading it on first use.
+func (m *IgnoreMatcher) dirPatterns(dir []string) []ignorePattern {
+	key := strings.Join(dir, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	patterns, ok := m.dirs[key]
+	if !ok {
+		patterns, _ = m.readPatterns(path.Join(m.root, key, ".gitignore"))
+		m.dirs[key] = patterns
+	}
+	return patterns
+}
+
+// readPatterns parses the ignore file name. A missing file has no
+// patterns.
+func (m *IgnoreMatcher) readPatterns(name string) ([]ignorePattern, error) {
+	f, err := m.fs.fs.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return parseIgnore(data), nil
+}
+
+// parseIgnore parses the lines of an ignore file in the gitignore format.
+func parseIgnore(data []byte) []ignorePattern {
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var p ignorePattern
+		if line[0] == '!' {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		line = strings.ReplaceAll(line, "[!", "[^")
+		if !strings.Contains(line, "/") {
+			p.segs = []string{"**", line}
+		} else {
+			p.segs = strings.Split(strings.TrimPrefix(line, "/"), "/")
+			// A trailing "/**" matches what is inside, not the directory.
+			if p.segs[len(p.segs)-1] == "**" {
+				p.segs = append(p.segs[:len(p.segs)-1], "*", "**")
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
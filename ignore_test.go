@@ -0,0 +1,107 @@
+package billyfs_test
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/billyfs"
+)
+
+// setupIgnoreTree creates a worktree with ignore files
+func setupIgnoreTree(t *testing.T) (*billyfs.Filesystem, *statCountingFS) {
+	t.Helper()
+	bfs, counting := setupWalkTree(t)
+	setupGlobTree(t, bfs,
+		".git/HEAD", ".git/objects/pack/p.pack",
+		"build/out.o", "src/main.c", "src/main.o", "src/keep.o",
+		"src/gen/x.c", "docs/a.log", "docs/important.log", "notes.tmp")
+	files := map[string]string{
+		".git/info/exclude": "*.tmp\n",
+		".gitignore":        "# build output\n*.o\n/build/\n*.log\n!important.log\ndocs/**/*.bak\n",
+		"src/.gitignore":    "!keep.o\ngen/\n",
+	}
+	for name, data := range files {
+		if err := bfs.MkdirAll(".git/info", 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		writeBillyFile(t, bfs, name, []byte(data))
+	}
+	counting.stats.Store(0)
+	return bfs, counting
+}
+
+// TestIgnoreMatch tests the gitignore rules
+func TestIgnoreMatch(t *testing.T) {
+	bfs, _ := setupIgnoreTree(t)
+	m, err := bfs.NewIgnoreMatcher("/")
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"notes.tmp", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.o", false, true},
+		{"src/main.c", false, false},
+		{"src/main.o", false, true},
+		{"src/keep.o", false, false},
+		{"src/gen", true, true},
+		{"src/gen/x.c", false, true},
+		{"docs/a.log", false, true},
+		{"docs/important.log", false, false},
+		{"docs/x/y.bak", false, true},
+		{".git", true, true},
+		{".git/HEAD", false, true},
+		{"a/b/1", false, false},
+	} {
+		if got := m.Match(tc.name, tc.isDir); got != tc.ignored {
+			t.Errorf("Match(%q, %v): got %v", tc.name, tc.isDir, got)
+		}
+	}
+}
+
+// TestIgnoreGlobAndWalk tests that ignored subtrees are skipped and never
+// read
+func TestIgnoreGlobAndWalk(t *testing.T) {
+	bfs, _ := setupIgnoreTree(t)
+	m, err := bfs.NewIgnoreMatcher("/")
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher failed: %v", err)
+	}
+
+	got, err := m.Glob("**/*.{c,o,log,pack}")
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	want := []string{"docs/important.log", "src/keep.o", "src/main.c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected matches %v", got)
+	}
+
+	var walked []string
+	err = bfs.WalkDir(".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			walked = append(walked, name)
+		}
+		if name == "build" || name == "src/gen" || name == ".git" {
+			t.Errorf("ignored directory %s was walked", name)
+		}
+		return nil
+	}, billyfs.WalkOptions{Ignore: m})
+	if err != nil {
+		t.Fatalf("WalkDir failed: %v", err)
+	}
+	want = []string{".gitignore", "a/4", "a/b/1", "a/b/2", "a/c/3", "d/5",
+		"docs/important.log", "e/f/g/6", "src/.gitignore", "src/keep.o", "src/main.c", "z"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("unexpected walk %v", walked)
+	}
+}
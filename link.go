@@ -0,0 +1,144 @@
+package billyfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/absfs/basefs"
+)
+
+// HardLinker is implemented by absfs filesystems that can create hard
+// links. Filesystem.Link uses it when the wrapped filesystem provides it.
+// Implementations return an error wrapping errors.ErrUnsupported, or
+// syscall.EXDEV or ENOTSUP as os.Link does, when the link cannot be
+// created natively, in which case Link falls back to a copy.
+type HardLinker interface {
+	Link(oldname, newname string) error
+}
+
+// Linker is implemented by billy filesystems that support Link.
+type Linker interface {
+	// Link creates newname as a link to the file oldname.
+	Link(oldname, newname string) error
+
+	// HardLinks reports whether Link creates hard links sharing the
+	// contents of oldname, rather than independent copies.
+	HardLinks() bool
+}
+
+// HardLinks reports whether Link creates hard links. It is true for the
+// local filesystem and for backends implementing HardLinker.
+func (f *Filesystem) HardLinks() bool {
+	if _, ok := f.nativePath("/"); ok {
+		return true
+	}
+	_, ok := basefs.Unwrap(f.fs).(HardLinker)
+	return ok
+}
+
+// Link creates newname as a hard link to the file oldname. If the backend
+// does not support hard links, or cannot link these files because they are
+// on different devices or on a file system without hard links, newname is
+// created as a copy of oldname with the same mode and modification time; a
+// symbolic link is copied as a symbolic link to the same target. Link fails
+// if newname exists or if oldname is a directory, and returns the EPERM of
+// a link denied by the system, such as with protected_hardlinks, instead
+// of copying.
+func (f *Filesystem) Link(oldname, newname string) error {
+	if _, err := f.fs.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	err := f.hardLink(oldname, newname)
+	if linkUnsupported(err) {
+		err = f.copyLink(oldname, newname)
+	}
+	if err != nil {
+		return err
+	}
+	f.invalidate(oldname, false)
+	f.invalidate(newname, false)
+	f.notify(OpCreate, newname)
+	return nil
+}
+
+// hardLink creates a hard link through the backend, or returns
+// errors.ErrUnsupported.
+func (f *Filesystem) hardLink(oldname, newname string) error {
+	if oldpath, ok := f.nativePath(oldname); ok {
+		newpath, _ := f.nativePath(newname)
+		return os.Link(oldpath, newpath)
+	}
+	if linker, ok := basefs.Unwrap(f.fs).(HardLinker); ok {
+		return linker.Link(f.absPath(oldname), f.absPath(newname))
+	}
+	return errors.ErrUnsupported
+}
+
+// linkUnsupported reports whether err means that a hard link cannot be
+// created, as opposed to a failure a copy would meet as well. EPERM is a
+// denial, which a copy must not work around.
+func linkUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.ENOTSUP)
+}
+
+// copyLink emulates a hard link by copying oldname to newname.
+func (f *Filesystem) copyLink(oldname, newname string) error {
+	info, err := f.fs.Lstat(oldname)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrPermission}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := f.fs.Readlink(oldname)
+		if err != nil {
+			return err
+		}
+		return f.fs.Symlink(target, newname)
+	}
+
+	src, err := f.fs.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := f.fs.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		f.fs.Remove(newname)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		f.fs.Remove(newname)
+		return err
+	}
+	if err := f.fs.Chmod(newname, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return f.fs.Chtimes(newname, info.ModTime(), info.ModTime())
+}
+
+// LinkCount returns the number of hard links to the file described by
+// info, as reported by Stat, Lstat or ReadDir. It reports false if the
+// backend does not provide link counts. Backends other than the local
+// filesystem can provide them by returning a Sys value with an
+// Nlink() uint64 method.
+func LinkCount(info os.FileInfo) (uint64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	switch sys := info.Sys().(type) {
+	case interface{ Nlink() uint64 }:
+		return sys.Nlink(), true
+	default:
+		return sysLinkCount(sys)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package billyfs
+
+// sysLinkCount reports that link counts of the local filesystem are not
+// available on this platform.
+func sysLinkCount(sys any) (uint64, bool) {
+	return 0, false
+}
+
+// sysAllocatedBlocks reports that allocated blocks of the local filesystem
+// are not available on this platform.
+func sysAllocatedBlocks(sys any) (int64, bool) {
+	return 0, false
+}
+
+// sysOwner reports that owners of files of the local filesystem are not
+// available on this platform.
+func sysOwner(sys any) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// sysWithOwner returns sys unchanged, since it holds no owner on this
+// platform.
+func sysWithOwner(sys any, uid, gid int) any {
+	return sys
+}
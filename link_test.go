@@ -0,0 +1,203 @@
+package billyfs_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// hardLinkFS is a non-local backend providing hard links. If err is set,
+// creating links fails with it
+type hardLinkFS struct {
+	absfs.SymlinkFileSystem
+	links int
+	err   error
+}
+
+func (h *hardLinkFS) Link(oldname, newname string) error {
+	h.links++
+	if h.err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: h.err}
+	}
+	return os.Link(osfs.ToNative(oldname), osfs.ToNative(newname))
+}
+
+// TestLinkNative tests hard links on the local filesystem
+func TestLinkNative(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	var fs billy.Filesystem = bfs
+	linker, ok := fs.(billyfs.Linker)
+	if !ok || !linker.HardLinks() {
+		t.Fatal("expected the local filesystem to support hard links")
+	}
+
+	if err := bfs.MkdirAll("objects/ab", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeTestFile(t, bfs, "objects/ab/cdef", "object")
+	if err := bfs.Link("objects/ab/cdef", "clone"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	info, err := bfs.Stat("clone")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if n, ok := billyfs.LinkCount(info); ok && n != 2 {
+		t.Errorf("expected link count 2, got %d", n)
+	}
+	infos, err := bfs.ReadDir("objects/ab")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if n, ok := billyfs.LinkCount(infos[0]); ok && n != 2 {
+		t.Errorf("expected ReadDir link count 2, got %d", n)
+	}
+
+	// Both names share the contents.
+	f, err := bfs.OpenFile("clone", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte(" changed"))
+	f.Close()
+	if got := readTestFile(t, bfs, "objects/ab/cdef"); got != "object changed" {
+		t.Errorf("expected shared contents, got %q", got)
+	}
+
+	if err := bfs.Link("objects/ab/cdef", "clone"); !os.IsExist(err) {
+		t.Errorf("expected exist error, got %v", err)
+	}
+	if err := bfs.Link("objects", "dirlink"); err == nil {
+		t.Error("expected linking a directory to fail")
+	}
+}
+
+// TestLinkBackend tests that backends implementing HardLinker are used
+func TestLinkBackend(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	backend := &hardLinkFS{SymlinkFileSystem: fs}
+	bfs, err := billyfs.NewFS(backend, tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	if !bfs.HardLinks() {
+		t.Error("expected HardLinker backend to support hard links")
+	}
+
+	writeTestFile(t, bfs, "a", "data")
+	if err := bfs.Link("a", "b"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	if backend.links != 1 {
+		t.Errorf("expected the backend to create the link, got %d calls", backend.links)
+	}
+	if got := readTestFile(t, bfs, "b"); got != "data" {
+		t.Errorf("unexpected contents %q", got)
+	}
+}
+
+// TestLinkBackendFallback tests that Link copies when the backend cannot
+// link the files
+func TestLinkBackendFallback(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.ENOTSUP} {
+		backend := &hardLinkFS{SymlinkFileSystem: fs, err: errno}
+		bfs, err := billyfs.NewFS(backend, t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to create billyfs: %v", err)
+		}
+		writeTestFile(t, bfs, "a", "data")
+		if err := bfs.Link("a", "b"); err != nil {
+			t.Fatalf("%v: Link failed: %v", errno, err)
+		}
+		if backend.links != 1 {
+			t.Errorf("%v: expected the backend to be tried, got %d calls", errno, backend.links)
+		}
+		if got := readTestFile(t, bfs, "b"); got != "data" {
+			t.Errorf("%v: unexpected contents %q", errno, got)
+		}
+	}
+
+	// Other errors, including denials, are returned.
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EPERM} {
+		bfs, err := billyfs.NewFS(&hardLinkFS{SymlinkFileSystem: fs, err: errno}, t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to create billyfs: %v", err)
+		}
+		writeTestFile(t, bfs, "a", "data")
+		if err := bfs.Link("a", "b"); !errors.Is(err, errno) {
+			t.Errorf("expected %v, got %v", errno, err)
+		}
+		if _, err := bfs.Lstat("b"); !os.IsNotExist(err) {
+			t.Errorf("%v: expected no copy, got %v", errno, err)
+		}
+	}
+}
+
+// TestLinkCopyFallback tests that Link copies on backends without hard
+// links
+func TestLinkCopyFallback(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	bfs, err := billyfs.NewFS(&countingFS{SymlinkFileSystem: fs}, tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	if bfs.HardLinks() {
+		t.Error("expected copy fallback")
+	}
+
+	writeTestFile(t, bfs, "a", "data")
+	mtime := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := bfs.Chmod("a", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfs.Chtimes("a", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfs.Link("a", "b"); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	info, err := bfs.Stat("b")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mode and mtime to be copied, got %v %v", info.Mode(), info.ModTime())
+	}
+	if n, ok := billyfs.LinkCount(info); ok && n != 1 {
+		t.Errorf("expected independent copy, got link count %d", n)
+	}
+	if got := readTestFile(t, bfs, "b"); got != "data" {
+		t.Errorf("unexpected contents %q", got)
+	}
+
+	if err := bfs.Symlink("a", "sym"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfs.Link("sym", "sym2"); err != nil {
+		t.Fatalf("Link of symlink failed: %v", err)
+	}
+	if target, err := bfs.Readlink("sym2"); err != nil || target != "a" {
+		t.Errorf("expected symlink copy to a, got %q, %v", target, err)
+	}
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package billyfs
+
+import "syscall"
+
+// sysLinkCount returns the link count from the Sys value of a FileInfo of
+// the local filesystem.
+func sysLinkCount(sys any) (uint64, bool) {
+	if st, ok := sys.(*syscall.Stat_t); ok {
+		return uint64(st.Nlink), true
+	}
+	return 0, false
+}
+
+// sysAllocatedBlocks returns the number of 512-byte blocks allocated to a
+// file from the Sys value of a FileInfo of the local filesystem.
+func sysAllocatedBlocks(sys any) (int64, bool) {
+	if st, ok := sys.(*syscall.Stat_t); ok {
+		return int64(st.Blocks), true
+	}
+	return 0, false
+}
+
+// sysOwner returns the ids of the owner of a file from the Sys value of a
+// FileInfo of the local filesystem.
+func sysOwner(sys any) (uid, gid int, ok bool) {
+	if st, ok := sys.(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
+
+// sysWithOwner returns a copy of the Sys value of a FileInfo of the local
+// filesystem with the ids of the owner replaced.
+func sysWithOwner(sys any, uid, gid int) any {
+	if st, ok := sys.(*syscall.Stat_t); ok {
+		c := *st
+		c.Uid, c.Gid = uint32(uid), uint32(gid)
+		return &c
+	}
+	return sys
+}
@@ -0,0 +1,318 @@
+package billyfs
+
+import (
+	"container/list"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultMetadataCacheEntries is the number of entries kept by the metadata
+// cache when MetadataCacheOptions.MaxEntries is zero.
+const DefaultMetadataCacheEntries = 4096
+
+// MetadataCacheOptions configures the cache of Stat, Lstat and ReadDir
+// results kept by a Filesystem.
+//
+// The cache is invalidated by the mutating operations of the Filesystem, of
+// the Filesystems derived from it with Chroot and of the Files they open.
+// Changes made directly on the backend, or reaching a cached path through a
+// symbolic link in one of its parent directories, become visible once the
+// affected entries expire.
+type MetadataCacheOptions struct {
+	// TTL is how long a cached result is served. Zero disables the cache.
+	TTL time.Duration
+
+	// MaxEntries bounds the number of cached results. The least recently
+	// used results are evicted first. Zero means
+	// DefaultMetadataCacheEntries.
+	MaxEntries int
+}
+
+// CacheStats reports the effectiveness of a cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// HitRate returns the fraction of lookups served from the cache.
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// MetadataCacheStats returns the statistics of the metadata cache shared by
+// f and the Filesystems derived from it. It returns zero statistics if the
+// cache is disabled.
+func (f *Filesystem) MetadataCacheStats() CacheStats {
+	if f.meta == nil {
+		return CacheStats{}
+	}
+	return f.meta.stats()
+}
+
+type metaKind uint8
+
+const (
+	metaStat metaKind = iota
+	metaLstat
+	metaReadDir
+)
+
+type metaKey struct {
+	kind metaKind
+	path string
+}
+
+type metaEntry struct {
+	key     metaKey
+	info    os.FileInfo
+	infos   []os.FileInfo
+	expires time.Time
+
+	// viaLink is set for Stat results that followed a symbolic link. They
+	// depend on a path other than their own and are dropped on every
+	// mutation.
+	viaLink bool
+}
+
+// metaCache is an LRU cache of metadata keyed by absolute paths in the
+// namespace of the underlying absfs filesystem.
+type metaCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[metaKey]*list.Element
+	lru     *list.List
+	links   map[metaKey]struct{}
+
+	// gen counts invalidations so that results read from the backend
+	// concurrently with a mutation are not stored.
+	gen uint64
+
+	hits, misses, evictions uint64
+}
+
+func newMetaCache(opts MetadataCacheOptions) *metaCache {
+	if opts.TTL <= 0 {
+		return nil
+	}
+	max := opts.MaxEntries
+	if max <= 0 {
+		max = DefaultMetadataCacheEntries
+	}
+	return &metaCache{
+		ttl:     opts.TTL,
+		max:     max,
+		entries: make(map[metaKey]*list.Element),
+		lru:     list.New(),
+		links:   make(map[metaKey]struct{}),
+	}
+}
+
+// generation returns the current invalidation generation.
+func (c *metaCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns the live entry for key and records the lookup.
+func (c *metaCache) get(key metaKey) (*metaEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok {
+		e := el.Value.(*metaEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			return e, true
+		}
+		c.removeElement(el)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put stores e, evicting the least recently used entries beyond the bound.
+// Nothing is stored if the cache was invalidated since generation gen.
+func (c *metaCache) put(e *metaEntry, gen uint64) {
+	e.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	if e.viaLink {
+		c.links[e.key] = struct{}{}
+	}
+	for c.lru.Len() > c.max {
+		c.removeElement(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *metaCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*metaEntry)
+	delete(c.entries, e.key)
+	delete(c.links, e.key)
+}
+
+func (c *metaCache) remove(key metaKey) {
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// invalidate drops the entries describing p and its parent directory. If
+// tree is set, the entries of all descendants of p are dropped as well.
+func (c *metaCache) invalidate(p string, tree bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked(p, tree)
+}
+
+func (c *metaCache) invalidateLocked(p string, tree bool) {
+	c.gen++
+	for _, q := range []string{p, path.Dir(p)} {
+		c.remove(metaKey{metaStat, q})
+		c.remove(metaKey{metaLstat, q})
+		c.remove(metaKey{metaReadDir, q})
+	}
+	if tree {
+		for key, el := range c.entries {
+			if isWithin(p, key.path) {
+				c.removeElement(el)
+			}
+		}
+	}
+	for key := range c.links {
+		c.remove(key)
+	}
+}
+
+// invalidateAll drops the entries of p and of all its ancestors, as done
+// when MkdirAll may have created several directories.
+func (c *metaCache) invalidateAll(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.invalidateLocked(p, false)
+		if p == "/" || p == "." {
+			return
+		}
+		p = path.Dir(p)
+	}
+}
+
+func (c *metaCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// cachedStat returns the Stat or Lstat result for filename, consulting the
+// metadata cache if enabled. A cache miss is answered with a single Lstat
+// unless the file turns out to be a symbolic link that Stat must follow.
+func (f *Filesystem) cachedStat(filename string, follow bool) (os.FileInfo, error) {
+	kind := metaLstat
+	if follow {
+		kind = metaStat
+	}
+	key := metaKey{kind, f.absPath(filename)}
+	if e, ok := f.meta.get(key); ok {
+		return e.info, nil
+	}
+	gen := f.meta.generation()
+	info, err := f.fs.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	lkey := metaKey{metaLstat, key.path}
+	if info.Mode()&os.ModeSymlink == 0 {
+		f.meta.put(&metaEntry{key: lkey, info: info}, gen)
+		f.meta.put(&metaEntry{key: metaKey{metaStat, key.path}, info: info}, gen)
+		return info, nil
+	}
+	f.meta.put(&metaEntry{key: lkey, info: info}, gen)
+	if !follow {
+		return info, nil
+	}
+	info, err = f.fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	f.meta.put(&metaEntry{key: key, info: info, viaLink: true}, gen)
+	return info, nil
+}
+
+// cachedReadDir returns the ReadDir result for name, consulting the
+// metadata cache.
+func (f *Filesystem) cachedReadDir(name string) ([]os.FileInfo, error) {
+	key := metaKey{metaReadDir, f.absPath(name)}
+	if e, ok := f.meta.get(key); ok {
+		return append([]os.FileInfo(nil), e.infos...), nil
+	}
+	gen := f.meta.generation()
+	infos, err := f.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	f.meta.put(&metaEntry{key: key, infos: append([]os.FileInfo(nil), infos...)}, gen)
+	return infos, nil
+}
+
+// invalidate drops cached metadata and file blocks affected by a change to
+// name. If tree is set, name may be a directory whose descendants are
+// affected as well.
+func (f *Filesystem) invalidate(name string, tree bool) {
+	if f == nil || (f.meta == nil && f.blocks == nil) {
+		return
+	}
+	p := f.absPath(name)
+	if f.meta != nil {
+		f.meta.invalidate(p, tree)
+	}
+	if f.blocks != nil {
+		f.blocks.invalidate(p, tree)
+	}
+}
+
+// invalidateTarget is invalidate for changes that follow symbolic links:
+// the entries of the path name resolves to are dropped as well.
+func (f *Filesystem) invalidateTarget(name string) {
+	if f == nil || (f.meta == nil && f.blocks == nil) {
+		return
+	}
+	f.invalidate(name, false)
+	if resolved := f.resolveName(name); f.absPath(resolved) != f.absPath(name) {
+		f.invalidate(resolved, false)
+	}
+}
+
+// resolveName returns name with its symbolic links resolved, or name
+// itself if they cannot be resolved.
+func (f *Filesystem) resolveName(name string) string {
+	if resolved, err := f.evalSymlinks(name, true); err == nil {
+		return resolved
+	}
+	return name
+}
+
+// invalidateAll drops cached metadata of name and all its ancestors.
+func (f *Filesystem) invalidateAll(name string) {
+	if f == nil || f.meta == nil {
+		return
+	}
+	f.meta.invalidateAll(f.absPath(name))
+}
@@ -0,0 +1,313 @@
+package billyfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// newCachedTestFS creates a billyfs filesystem with the metadata cache
+// enabled
+func newCachedTestFS(t *testing.T, opts billyfs.MetadataCacheOptions) (*billyfs.Filesystem, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+
+	bfs, err := billyfs.NewFSWithOptions(fs, tmpDir, billyfs.Options{MetadataCache: opts})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+
+	return bfs, tmpDir
+}
+
+// TestMetadataCacheHits tests that repeated lookups are served from the
+// cache
+func TestMetadataCacheHits(t *testing.T) {
+	bfs, tmpDir := newCachedTestFS(t, billyfs.MetadataCacheOptions{TTL: time.Hour})
+	writeBillyFile(t, bfs, "file.txt", []byte("hello"))
+
+	for i := 0; i < 10; i++ {
+		info, err := bfs.Stat("file.txt")
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Size() != 5 {
+			t.Errorf("expected size 5, got %d", info.Size())
+		}
+	}
+	stats := bfs.MetadataCacheStats()
+	if stats.Misses != 1 || stats.Hits != 9 {
+		t.Errorf("expected 1 miss and 9 hits, got %+v", stats)
+	}
+	if rate := stats.HitRate(); rate != 0.9 {
+		t.Errorf("expected hit rate 0.9, got %v", rate)
+	}
+
+	// Changes made behind the adapter's back are not observed until the
+	// entry expires.
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("changed!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := bfs.Stat("file.txt"); info.Size() != 5 {
+		t.Errorf("expected cached size 5, got %d", info.Size())
+	}
+}
+
+// TestMetadataCacheInvalidation tests that mutations through the adapter
+// invalidate cached metadata
+func TestMetadataCacheInvalidation(t *testing.T) {
+	bfs, _ := newCachedTestFS(t, billyfs.MetadataCacheOptions{TTL: time.Hour})
+	if err := bfs.MkdirAll("dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeBillyFile(t, bfs, "dir/a.txt", []byte("a"))
+
+	readDirNames := func() []string {
+		t.Helper()
+		infos, err := bfs.ReadDir("dir")
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	size := func(name string) int64 {
+		t.Helper()
+		info, err := bfs.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		return info.Size()
+	}
+
+	if names := readDirNames(); len(names) != 1 {
+		t.Fatalf("unexpected entries %v", names)
+	}
+	size("dir/a.txt")
+
+	// File.Write
+	f, err := bfs.OpenFile("dir/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte("bc"))
+	if got := size("dir/a.txt"); got != 3 {
+		t.Errorf("after Write: expected size 3, got %d", got)
+	}
+	// File.Truncate
+	f.Truncate(1)
+	if got := size("dir/a.txt"); got != 1 {
+		t.Errorf("after Truncate: expected size 1, got %d", got)
+	}
+	f.Close()
+
+	// Create
+	writeBillyFile(t, bfs, "dir/b.txt", nil)
+	if names := readDirNames(); len(names) != 2 {
+		t.Errorf("after Create: unexpected entries %v", names)
+	}
+
+	// Rename
+	if err := bfs.Rename("dir/b.txt", "dir/c.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if names := readDirNames(); len(names) != 2 || names[1] != "c.txt" {
+		t.Errorf("after Rename: unexpected entries %v", names)
+	}
+	if _, err := bfs.Stat("dir/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("after Rename: expected old name to be gone, got %v", err)
+	}
+
+	// Remove
+	if err := bfs.Remove("dir/c.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if names := readDirNames(); len(names) != 1 {
+		t.Errorf("after Remove: unexpected entries %v", names)
+	}
+
+	// Chmod and Chtimes
+	if err := bfs.Chmod("dir/a.txt", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if info, _ := bfs.Stat("dir/a.txt"); info.Mode().Perm() != 0600 {
+		t.Errorf("after Chmod: expected mode 0600, got %v", info.Mode())
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := bfs.Chtimes("dir/a.txt", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if info, _ := bfs.Stat("dir/a.txt"); !info.ModTime().Equal(mtime) {
+		t.Errorf("after Chtimes: expected mtime %v, got %v", mtime, info.ModTime())
+	}
+
+	// Symlink, and Stat through it after the target changes
+	if err := bfs.Symlink("a.txt", "dir/link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if info, err := bfs.Lstat("dir/link"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("after Symlink: expected symlink, got %v, %v", info, err)
+	}
+	if got := size("dir/link"); got != 1 {
+		t.Errorf("expected link target size 1, got %d", got)
+	}
+	writeBillyFile(t, bfs, "dir/a.txt", []byte("four"))
+	if got := size("dir/link"); got != 4 {
+		t.Errorf("after target change: expected size 4, got %d", got)
+	}
+
+	// Mutations through a chrooted view share the cache
+	sub, err := bfs.Chroot("dir")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	if err := sub.Remove("link"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := bfs.Lstat("dir/link"); !os.IsNotExist(err) {
+		t.Errorf("after chrooted Remove: expected link to be gone, got %v", err)
+	}
+}
+
+// TestMetadataCacheBounds tests TTL expiry and LRU eviction
+func TestMetadataCacheBounds(t *testing.T) {
+	bfs, tmpDir := newCachedTestFS(t, billyfs.MetadataCacheOptions{
+		TTL:        50 * time.Millisecond,
+		MaxEntries: 4,
+	})
+	for _, name := range []string{"a", "b", "c"} {
+		writeBillyFile(t, bfs, name, nil)
+		if _, err := bfs.Stat(name); err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+	}
+	if stats := bfs.MetadataCacheStats(); stats.Evictions == 0 {
+		t.Errorf("expected evictions, got %+v", stats)
+	}
+
+	if _, err := bfs.Stat("c"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "c"), []byte("xyz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	info, err := bfs.Stat("c")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("expected expired entry to be refreshed, got size %d", info.Size())
+	}
+}
+
+// TestMetadataCacheDisabled tests that NewFS does not cache
+func TestMetadataCacheDisabled(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	writeBillyFile(t, bfs, "file.txt", nil)
+	bfs.Stat("file.txt")
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := bfs.Stat("file.txt"); info.Size() != 1 {
+		t.Errorf("expected uncached size 1, got %d", info.Size())
+	}
+	if stats := bfs.MetadataCacheStats(); stats != (billyfs.CacheStats{}) {
+		t.Errorf("expected zero stats, got %+v", stats)
+	}
+}
+
+// TestMetadataCacheSymlinks tests that changes made through a symbolic
+// link invalidate the cached metadata of its target
+func TestMetadataCacheSymlinks(t *testing.T) {
+	bfs, _ := newCachedTestFS(t, billyfs.MetadataCacheOptions{TTL: time.Hour})
+	writeBillyFile(t, bfs, "target", []byte("a"))
+	if err := bfs.Symlink("target", "link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	stat := func() os.FileInfo {
+		t.Helper()
+		info, err := bfs.Stat("target")
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		return info
+	}
+
+	// Chmod
+	stat()
+	if err := bfs.Chmod("link", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if info := stat(); info.Mode().Perm() != 0600 {
+		t.Errorf("after Chmod: expected mode 0600, got %v", info.Mode())
+	}
+
+	// Chown
+	if os.Getuid() == 0 {
+		if err := bfs.Chown("link", 1000, 1000); err != nil {
+			t.Fatalf("Chown failed: %v", err)
+		}
+		if uid, gid, _ := billyfs.Owner(stat()); uid != 1000 || gid != 1000 {
+			t.Errorf("after Chown: expected owner 1000:1000, got %d:%d", uid, gid)
+		}
+	}
+
+	// Chtimes
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := bfs.Chtimes("link", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if info := stat(); !info.ModTime().Equal(mtime) {
+		t.Errorf("after Chtimes: expected mtime %v, got %v", mtime, info.ModTime())
+	}
+
+	// File.Write and File.Close
+	f, err := bfs.OpenFile("link", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write([]byte("bc"))
+	if info := stat(); info.Size() != 3 {
+		t.Errorf("after Write: expected size 3, got %d", info.Size())
+	}
+	f.Write([]byte("d"))
+	f.Close()
+	if info := stat(); info.Size() != 4 {
+		t.Errorf("after Close: expected size 4, got %d", info.Size())
+	}
+
+	// File.Truncate
+	f, err = bfs.OpenFile("link", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	stat()
+	f.Truncate(2)
+	if info := stat(); info.Size() != 2 {
+		t.Errorf("after Truncate: expected size 2, got %d", info.Size())
+	}
+	f.Close()
+
+	// OpenFile with O_TRUNC
+	f, err = bfs.OpenFile("link", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if info := stat(); info.Size() != 0 {
+		t.Errorf("after OpenFile: expected size 0, got %d", info.Size())
+	}
+	f.Close()
+}
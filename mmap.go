@@ -0,0 +1,96 @@
+package billyfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Mmapper is implemented by billy files that can map their contents into
+// memory.
+type Mmapper interface {
+	// Mmap returns the contents of the file as a read-only slice.
+	Mmap() ([]byte, error)
+
+	// Munmap releases the slice returned by Mmap.
+	Munmap() error
+}
+
+// mapping is the state of the memory mapping of a File.
+type mapping struct {
+	mu     sync.Mutex
+	data   []byte
+	mapped bool
+	native bool
+}
+
+// Mmap returns the contents of the file as a read-only slice. Files on the
+// local filesystem are memory-mapped, so the slice reflects later writes
+// within its length; for other backends it is a copy of the contents at
+// the time of the call. Repeated calls return the same slice until
+// Munmap.
+//
+// The slice must not be modified, and must not be used after Munmap or
+// Close, which unmaps it: on the local filesystem doing so faults.
+func (f *File) Mmap() ([]byte, error) {
+	m := &f.mapping
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapped {
+		return m.data, nil
+	}
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size != int64(int(size)) {
+		return nil, &fs.PathError{Op: "mmap", Path: f.name, Err: errors.New("file too large")}
+	}
+
+	var data []byte
+	err = f.native(os.O_RDONLY, func(fd uintptr) error {
+		var err error
+		data, err = mmap(fd, int(size))
+		return err
+	})
+	native := err == nil
+	if errors.Is(err, errors.ErrUnsupported) {
+		data = make([]byte, size)
+		var n int
+		n, err = f.readAt(data, 0)
+		if err == io.EOF {
+			data, err = data[:n], nil
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "mmap", Path: f.name, Err: err}
+	}
+	m.data, m.mapped, m.native = data, true, native
+	return data, nil
+}
+
+// Munmap releases the slice returned by Mmap. It does nothing if the file
+// is not mapped.
+func (f *File) Munmap() error {
+	m := &f.mapping
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.mapped {
+		return nil
+	}
+	var err error
+	if m.native {
+		err = munmap(m.data)
+	}
+	m.data, m.mapped, m.native = nil, false, false
+	if err != nil {
+		return &fs.PathError{Op: "munmap", Path: f.name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package billyfs
+
+import "errors"
+
+// Memory mapping is only implemented on Unix. Elsewhere Mmap reads the
+// file into memory.
+
+func mmap(fd uintptr, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// mmapFile opens name on bfs and maps it
+func mmapFile(t *testing.T, bfs *billyfs.Filesystem, name string) (*billyfs.File, []byte) {
+	t.Helper()
+	bf, err := bfs.Open(name)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	f := bf.(*billyfs.File)
+	data, err := f.Mmap()
+	if err != nil {
+		t.Fatalf("Mmap failed: %v", err)
+	}
+	return f, data
+}
+
+// TestMmapNative tests memory mapping on the local filesystem
+func TestMmapNative(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	data := testContent(100000)
+	writeBillyFile(t, bfs, "pack.bin", data)
+
+	f, mapped := mmapFile(t, bfs, "pack.bin")
+	var _ billyfs.Mmapper = f
+	if !bytes.Equal(mapped, data) {
+		t.Error("mapped content mismatch")
+	}
+	again, err := f.Mmap()
+	if err != nil || &again[0] != &mapped[0] {
+		t.Errorf("expected repeated Mmap to return the same slice, %v", err)
+	}
+	if err := f.Munmap(); err != nil {
+		t.Errorf("Munmap failed: %v", err)
+	}
+	if err := f.Munmap(); err != nil {
+		t.Errorf("expected repeated Munmap to succeed, got %v", err)
+	}
+
+	// Close releases a mapping that is still held.
+	if _, err := f.Mmap(); err != nil {
+		t.Fatalf("Mmap failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	writeBillyFile(t, bfs, "empty", nil)
+	f, mapped = mmapFile(t, bfs, "empty")
+	if len(mapped) != 0 {
+		t.Errorf("expected an empty mapping, got %d bytes", len(mapped))
+	}
+	f.Close()
+}
+
+// TestMmapMemory tests the in-memory view used by other backends
+func TestMmapMemory(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &countingFS{SymlinkFileSystem: fs}
+	bfs, err := billyfs.NewFS(counting, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	data := testContent(100000)
+	writeBillyFile(t, bfs, "pack.bin", data)
+
+	f, mapped := mmapFile(t, bfs, "pack.bin")
+	defer f.Close()
+	if !bytes.Equal(mapped, data) {
+		t.Error("mapped content mismatch")
+	}
+	reads := counting.reads.Load()
+	for i := 0; i < 3; i++ {
+		if _, err := f.Mmap(); err != nil {
+			t.Fatalf("Mmap failed: %v", err)
+		}
+	}
+	if counting.reads.Load() != reads {
+		t.Error("expected repeated Mmap to reuse the view")
+	}
+	if err := f.Munmap(); err != nil {
+		t.Errorf("Munmap failed: %v", err)
+	}
+}
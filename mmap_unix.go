@@ -0,0 +1,21 @@
+//go:build unix
+
+package billyfs
+
+import "syscall"
+
+// mmap maps size bytes of the file open as fd read-only. An empty file is
+// not mapped.
+func mmap(fd uintptr, size int) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+	return syscall.Mmap(int(fd), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,15 @@
+package billyfs
+
+import (
+	"github.com/absfs/basefs"
+	"github.com/absfs/osfs"
+)
+
+// nativePath returns the operating system path of name if f is backed by
+// the local filesystem.
+func (f *Filesystem) nativePath(name string) (string, bool) {
+	if _, ok := basefs.Unwrap(f.fs).(*osfs.FileSystem); !ok {
+		return "", false
+	}
+	return osfs.ToNative(f.absPath(name)), true
+}
@@ -0,0 +1,485 @@
+package billyfs
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// PolicyOp describes a set of operations granted or denied by a
+// PolicyRule.
+type PolicyOp uint32
+
+// Operations checked by a Policy. Each method of a policy view requires
+// one or more of them on the paths it touches.
+const (
+	// PolicyRead allows Open, Stat, Lstat, ReadDir and Readlink, and
+	// opening files read-only with OpenFile.
+	PolicyRead PolicyOp = 1 << iota
+	// PolicyWrite allows opening files for writing, including with Create
+	// and TempFile.
+	PolicyWrite
+	// PolicyCreate allows creating files, directories and symbolic links,
+	// and renaming entries to the path.
+	PolicyCreate
+	// PolicyDelete allows Remove and renaming entries away from the path.
+	PolicyDelete
+	// PolicyChange allows Chmod, Chown, Lchown and Chtimes.
+	PolicyChange
+
+	// PolicyAll is every operation.
+	PolicyAll = PolicyRead | PolicyWrite | PolicyCreate | PolicyDelete | PolicyChange
+)
+
+var policyOpNames = []struct {
+	op   PolicyOp
+	name string
+}{
+	{PolicyRead, "READ"},
+	{PolicyWrite, "WRITE"},
+	{PolicyCreate, "CREATE"},
+	{PolicyDelete, "DELETE"},
+	{PolicyChange, "CHANGE"},
+}
+
+// String returns the names of the operations in op separated by "|".
+func (op PolicyOp) String() string {
+	var names []string
+	for _, n := range policyOpNames {
+		if op&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, "|")
+}
+
+// PolicyRule grants or denies operations on the paths matching one of its
+// patterns to the principals it lists.
+type PolicyRule struct {
+	// Principals lists the principals the rule applies to. An empty list
+	// applies the rule to every principal.
+	Principals []string
+
+	// Paths lists the patterns of the paths the rule applies to, relative
+	// to the root of the Filesystem the policy view was created on, with
+	// the syntax of Glob: "refs/**" matches refs and everything below it.
+	Paths []string
+
+	Ops PolicyOp
+
+	// Deny denies Ops instead of granting them.
+	Deny bool
+}
+
+// PolicyDenial records an operation denied by a Policy.
+type PolicyDenial struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	// Op is the name of the denied method, such as "open" or "rename".
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Missing lists the operations the principal lacks on Path.
+	Missing string `json:"missing"`
+}
+
+// Policy decides which operations principals may perform on the paths of a
+// Filesystem. An operation is allowed on a path when a rule for the
+// principal matching the path grants it and no such rule denies it;
+// everything else is denied. Rules are fixed when the Policy is created.
+//
+// Denials are written to the audit log of the Policy as JSON objects, one
+// per line, in the form of PolicyDenial.
+type Policy struct {
+	rules []policyRule
+
+	mu  sync.Mutex
+	log *json.Encoder
+}
+
+// policyRule is a PolicyRule with its patterns split into elements.
+type policyRule struct {
+	PolicyRule
+	patterns [][]string
+}
+
+// NewPolicy returns a Policy enforcing rules and writing denials to
+// auditLog, which may be nil. The only possible error is
+// path.ErrBadPattern.
+func NewPolicy(rules []PolicyRule, auditLog io.Writer) (*Policy, error) {
+	p := &Policy{}
+	if auditLog != nil {
+		p.log = json.NewEncoder(auditLog)
+	}
+	for _, rule := range rules {
+		r := policyRule{PolicyRule: rule}
+		for _, pattern := range rule.Paths {
+			for _, expanded := range expandBraces(pattern) {
+				var segs []string
+				for _, seg := range strings.Split(expanded, "/") {
+					if seg == "" {
+						continue
+					}
+					if _, err := path.Match(seg, ""); err != nil {
+						return nil, err
+					}
+					segs = append(segs, seg)
+				}
+				r.patterns = append(r.patterns, segs)
+			}
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// Allowed reports whether principal may perform all operations in ops on
+// name, a path relative to the root of the Filesystem.
+func (p *Policy) Allowed(principal, name string, ops PolicyOp) bool {
+	return p.missing(principal, name, ops) == 0
+}
+
+// missing returns the operations in ops that principal may not perform on
+// name.
+func (p *Policy) missing(principal, name string, ops PolicyOp) PolicyOp {
+	var granted, denied PolicyOp
+	parts := policyParts(name)
+	for _, r := range p.rules {
+		if !r.appliesTo(principal) || !r.matches(parts) {
+			continue
+		}
+		if r.Deny {
+			denied |= r.Ops
+		} else {
+			granted |= r.Ops
+		}
+	}
+	return ops &^ (granted &^ denied)
+}
+
+func (r *policyRule) appliesTo(principal string) bool {
+	if len(r.Principals) == 0 {
+		return true
+	}
+	for _, p := range r.Principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matches(parts []string) bool {
+	for _, segs := range r.patterns {
+		if matchSegments(segs, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyParts returns the path elements of name, cleaned as if rooted.
+func policyParts(name string) []string {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// audit writes a denial to the audit log.
+func (p *Policy) audit(d PolicyDenial) {
+	if p.log == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.log.Encode(d)
+}
+
+// WithPolicy returns a view of f on behalf of principal whose methods check
+// p before calling f, failing with a *fs.PathError, or an *os.LinkError
+// for Rename and Symlink, wrapping fs.ErrPermission when an operation is
+// denied. Rename requires PolicyDelete on the old path and PolicyCreate on
+// the new one, and PolicyDelete as well if the new path exists; Symlink
+// requires PolicyCreate on the link and PolicyRead and PolicyWrite on its
+// target, resolved within the Filesystem. MkdirAll only checks the
+// directory it is given, not the parents it creates.
+//
+// Rules are matched against paths with the symbolic links in them
+// resolved, as the operation would, so links cannot open up paths the
+// principal may not use. Since the links are resolved before calling f,
+// a link changed in between by another user of the Filesystem can still
+// redirect the operation.
+//
+// Files opened read-only through the view only expose the methods of
+// billy.File, so their extensions cannot modify them.
+func (f *Filesystem) WithPolicy(p *Policy, principal string) billy.Filesystem {
+	return &policyFS{fs: f, root: f, policy: p, principal: principal, prefix: "/"}
+}
+
+// policyFS is the billy.Filesystem returned by Filesystem.WithPolicy.
+// root is the Filesystem the view was created on and prefix the path of
+// the root of fs within it.
+type policyFS struct {
+	fs        *Filesystem
+	root      *Filesystem
+	policy    *Policy
+	principal string
+	prefix    string
+}
+
+// resolve returns the path of name within root with the symbolic links in
+// it resolved, except in its last element unless follow is true. Links are
+// resolved from root, since they may lead out of a chrooted view.
+func (c *policyFS) resolve(name string, follow bool) string {
+	// Paths are cleaned lexically before reaching the backend.
+	name = path.Join(c.prefix, path.Clean("/"+name))
+	if follow {
+		return c.resolveRoot(name)
+	}
+	dir, base := path.Split(name)
+	return path.Join(c.resolveRoot(dir), base)
+}
+
+// resolveRoot resolves the links in p, a path within root. It returns p
+// cleaned if they cannot be resolved, in which case the operation fails
+// as well.
+func (c *policyFS) resolveRoot(p string) string {
+	if resolved, err := c.root.evalSymlinks(p, true); err == nil {
+		return resolved
+	}
+	return path.Clean("/" + p)
+}
+
+// check returns a *fs.PathError for op on name if the principal may not
+// perform ops on it, following a symbolic link in its last element.
+func (c *policyFS) check(op, name string, ops PolicyOp) error {
+	return c.checkPath(op, name, c.resolve(name, true), ops)
+}
+
+// checkLink is like check but does not follow a symbolic link in the last
+// element of name.
+func (c *policyFS) checkLink(op, name string, ops PolicyOp) error {
+	return c.checkPath(op, name, c.resolve(name, false), ops)
+}
+
+// checkPath checks ops on resolved, the resolved path of name within root.
+func (c *policyFS) checkPath(op, name, resolved string, ops PolicyOp) error {
+	rel := strings.TrimPrefix(resolved, "/")
+	missing := c.policy.missing(c.principal, rel, ops)
+	if missing == 0 {
+		return nil
+	}
+	c.policy.audit(PolicyDenial{
+		Time:      time.Now(),
+		Principal: c.principal,
+		Op:        op,
+		Path:      rel,
+		Missing:   missing.String(),
+	})
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+}
+
+// openOps returns the operations needed to open a file with flag.
+func openOps(flag int) PolicyOp {
+	ops := PolicyRead
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0 {
+		ops = PolicyWrite
+		if flag&os.O_WRONLY == 0 {
+			ops |= PolicyRead
+		}
+	}
+	if flag&os.O_CREATE != 0 {
+		ops |= PolicyCreate
+	}
+	return ops
+}
+
+// readOnlyFile hides the extensions of a File opened read-only through a
+// policy view.
+type readOnlyFile struct {
+	billy.File
+}
+
+// go-billy Basic interface functions
+
+func (c *policyFS) Create(filename string) (billy.File, error) {
+	if err := c.check("open", filename, PolicyCreate|PolicyWrite|PolicyRead); err != nil {
+		return nil, err
+	}
+	return c.fs.Create(filename)
+}
+
+func (c *policyFS) Open(filename string) (billy.File, error) {
+	return c.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (c *policyFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	ops := openOps(flag)
+	if err := c.check("open", filename, ops); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.OpenFile(filename, flag, perm)
+	if err != nil || ops&PolicyWrite != 0 {
+		return file, err
+	}
+	return readOnlyFile{file}, nil
+}
+
+func (c *policyFS) Stat(filename string) (os.FileInfo, error) {
+	if err := c.check("stat", filename, PolicyRead); err != nil {
+		return nil, err
+	}
+	return c.fs.Stat(filename)
+}
+
+func (c *policyFS) Rename(oldpath, newpath string) error {
+	newOps := PolicyCreate
+	if _, err := c.fs.Lstat(newpath); err == nil {
+		newOps |= PolicyDelete
+	}
+	if c.checkLink("rename", oldpath, PolicyDelete) != nil || c.checkLink("rename", newpath, newOps) != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrPermission}
+	}
+	return c.fs.Rename(oldpath, newpath)
+}
+
+func (c *policyFS) Remove(filename string) error {
+	if err := c.checkLink("remove", filename, PolicyDelete); err != nil {
+		return err
+	}
+	return c.fs.Remove(filename)
+}
+
+func (c *policyFS) Join(elem ...string) string {
+	return c.fs.Join(elem...)
+}
+
+// go-billy TempFile interface functions
+
+// TempFile checks PolicyCreate and PolicyWrite on the temporary directory
+// of the Filesystem, where the file is created.
+func (c *policyFS) TempFile(dir, prefix string) (billy.File, error) {
+	if err := c.check("tempfile", c.fs.fs.TempDir(), PolicyCreate|PolicyWrite|PolicyRead); err != nil {
+		return nil, err
+	}
+	return c.fs.TempFile(dir, prefix)
+}
+
+// go-billy Dir interface functions
+
+func (c *policyFS) ReadDir(path string) ([]os.FileInfo, error) {
+	if err := c.check("readdir", path, PolicyRead); err != nil {
+		return nil, err
+	}
+	return c.fs.ReadDir(path)
+}
+
+func (c *policyFS) MkdirAll(filename string, perm os.FileMode) error {
+	if err := c.check("mkdir", filename, PolicyCreate); err != nil {
+		return err
+	}
+	return c.fs.MkdirAll(filename, perm)
+}
+
+// go-billy Symlink interface functions
+
+func (c *policyFS) Lstat(filename string) (os.FileInfo, error) {
+	if err := c.checkLink("lstat", filename, PolicyRead); err != nil {
+		return nil, err
+	}
+	return c.fs.Lstat(filename)
+}
+
+func (c *policyFS) Symlink(target, link string) error {
+	// Absolute targets are relative to the root of the view.
+	resolved := c.prefix + "/" + target
+	if !path.IsAbs(target) {
+		resolved = path.Dir(c.resolve(link, false)) + "/" + target
+	}
+	if c.checkPath("symlink", target, c.resolveRoot(resolved), PolicyRead|PolicyWrite) != nil ||
+		c.checkLink("symlink", link, PolicyCreate) != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: link, Err: fs.ErrPermission}
+	}
+	return c.fs.Symlink(target, link)
+}
+
+func (c *policyFS) Readlink(link string) (string, error) {
+	if err := c.checkLink("readlink", link, PolicyRead); err != nil {
+		return "", err
+	}
+	return c.fs.Readlink(link)
+}
+
+// go-billy Chroot interface functions
+
+// Chroot returns a view of the chrooted filesystem for the same principal.
+// Rules keep matching paths relative to the root of the original view,
+// from the directory path resolves to. Chroot requires PolicyRead on it.
+func (c *policyFS) Chroot(path string) (billy.Filesystem, error) {
+	resolved := c.resolve(path, true)
+	if err := c.checkPath("chroot", path, resolved, PolicyRead); err != nil {
+		return nil, err
+	}
+	sub, err := c.fs.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &policyFS{
+		fs:        sub.(*Filesystem),
+		root:      c.root,
+		policy:    c.policy,
+		principal: c.principal,
+		prefix:    resolved,
+	}, nil
+}
+
+func (c *policyFS) Root() string {
+	return c.fs.Root()
+}
+
+// go-billy Capabilities interface
+
+func (c *policyFS) Capabilities() billy.Capability {
+	return c.fs.Capabilities()
+}
+
+// go-billy Change interface functions
+
+func (c *policyFS) Chmod(name string, mode os.FileMode) error {
+	if err := c.check("chmod", name, PolicyChange); err != nil {
+		return err
+	}
+	return c.fs.Chmod(name, mode)
+}
+
+func (c *policyFS) Lchown(name string, uid, gid int) error {
+	if err := c.checkLink("lchown", name, PolicyChange); err != nil {
+		return err
+	}
+	return c.fs.Lchown(name, uid, gid)
+}
+
+func (c *policyFS) Chown(name string, uid, gid int) error {
+	if err := c.check("chown", name, PolicyChange); err != nil {
+		return err
+	}
+	return c.fs.Chown(name, uid, gid)
+}
+
+func (c *policyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := c.check("chtimes", name, PolicyChange); err != nil {
+		return err
+	}
+	return c.fs.Chtimes(name, atime, mtime)
+}
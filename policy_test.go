@@ -0,0 +1,239 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// newPolicyTestFS returns a repository with a worktree file and views for a
+// writer limited to refs/ and objects/ and a read-only reader, with the
+// audit log of the policy
+func newPolicyTestFS(t *testing.T) (writer, reader billy.Filesystem, log *bytes.Buffer) {
+	t.Helper()
+	bfs, _ := newTestFS(t)
+	setupGlobTree(t, bfs, "README", "refs/heads/main", "objects/pack/p.pack")
+
+	log = &bytes.Buffer{}
+	policy, err := billyfs.NewPolicy([]billyfs.PolicyRule{
+		{Paths: []string{"**"}, Ops: billyfs.PolicyRead},
+		{Principals: []string{"writer"}, Paths: []string{"{refs,objects}/**"}, Ops: billyfs.PolicyAll},
+		{Principals: []string{"writer"}, Paths: []string{"objects/pack/*.pack"}, Ops: billyfs.PolicyDelete, Deny: true},
+	}, log)
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %v", err)
+	}
+	return bfs.WithPolicy(policy, "writer"), bfs.WithPolicy(policy, "reader"), log
+}
+
+func assertDenied(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected %s to be denied, got %v", what, err)
+	}
+}
+
+// TestPolicy tests enforcing rules for each principal
+func TestPolicy(t *testing.T) {
+	writer, reader, log := newPolicyTestFS(t)
+
+	// Both principals can read everywhere.
+	for _, view := range []billy.Filesystem{writer, reader} {
+		if _, err := view.Stat("README"); err != nil {
+			t.Errorf("Stat failed: %v", err)
+		}
+		file, err := view.Open("refs/heads/main")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if _, ok := file.(*billyfs.File); ok {
+			t.Error("expected read-only file to hide its extensions")
+		}
+		file.Close()
+	}
+
+	// The writer writes only under refs/ and objects/.
+	file, err := writer.Create("refs/heads/topic")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Close()
+	if err := writer.MkdirAll("objects/info", 0755); err != nil {
+		t.Errorf("MkdirAll failed: %v", err)
+	}
+	_, err = writer.OpenFile("README", os.O_WRONLY|os.O_TRUNC, 0)
+	assertDenied(t, "writing the worktree", err)
+	assertDenied(t, "chmod in the worktree", writer.(billy.Change).Chmod("README", 0600))
+
+	// Deny rules override grants.
+	assertDenied(t, "removing a pack", writer.Remove("objects/pack/p.pack"))
+
+	// The reader writes nothing.
+	_, err = reader.Create("refs/heads/other")
+	assertDenied(t, "creating a ref", err)
+	assertDenied(t, "removing a ref", reader.Remove("refs/heads/main"))
+
+	// Chroot views keep matching paths from the original root.
+	refs, err := writer.Chroot("refs")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	if err := refs.Remove("heads/topic"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	refs.Remove("../README")
+	if _, err := writer.Stat("README"); err != nil {
+		t.Errorf("expected path to stay within the chroot: %v", err)
+	}
+
+	var denials []billyfs.PolicyDenial
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var d billyfs.PolicyDenial
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("bad audit log line %q: %v", line, err)
+		}
+		denials = append(denials, d)
+	}
+	if len(denials) != 5 {
+		t.Fatalf("expected 5 denials, got %d:\n%s", len(denials), log)
+	}
+	if d := denials[0]; d.Principal != "writer" || d.Op != "open" || d.Path != "README" || d.Missing != "WRITE" {
+		t.Errorf("unexpected denial %+v", d)
+	}
+	if d := denials[4]; d.Principal != "reader" || d.Op != "remove" || d.Missing != "DELETE" {
+		t.Errorf("unexpected denial %+v", d)
+	}
+}
+
+// TestPolicyLinks tests checking both paths of Rename and Symlink
+func TestPolicyLinks(t *testing.T) {
+	writer, _, log := newPolicyTestFS(t)
+
+	var linkErr *os.LinkError
+	err := writer.Rename("README", "refs/README")
+	if !errors.As(err, &linkErr) || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected rename from the worktree to be denied, got %v", err)
+	}
+	assertDenied(t, "renaming into the worktree", writer.Rename("refs/heads/main", "main"))
+	if err := writer.Rename("refs/heads/main", "refs/heads/master"); err != nil {
+		t.Errorf("Rename failed: %v", err)
+	}
+
+	// Replacing an entry removes it.
+	writeBillyFile(t, writer, "objects/new.pack", []byte("pack"))
+	assertDenied(t, "renaming over a pack", writer.Rename("objects/new.pack", "objects/pack/p.pack"))
+	if err := writer.Rename("objects/new.pack", "objects/pack/new.pack"); err != nil {
+		t.Errorf("Rename failed: %v", err)
+	}
+
+	// Links may not point at paths the writer cannot write.
+	assertDenied(t, "linking to the worktree", writer.Symlink("../../README", "refs/heads/readme"))
+	assertDenied(t, "linking with an absolute target", writer.Symlink("/README", "refs/heads/readme"))
+	if err := writer.Symlink("master", "refs/heads/alias"); err != nil {
+		t.Errorf("Symlink failed: %v", err)
+	}
+	if _, err := writer.Lstat("refs/heads/readme"); !os.IsNotExist(err) {
+		t.Errorf("expected denied link not to exist, got %v", err)
+	}
+	if n := strings.Count(log.String(), "\n"); n != 5 {
+		t.Errorf("expected 5 denials, got %d:\n%s", n, log)
+	}
+}
+
+// TestPolicySymlinks tests matching rules against paths with symbolic
+// links resolved
+func TestPolicySymlinks(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	setupGlobTree(t, bfs, "refs/heads/main")
+	writeBillyFile(t, bfs, "README", []byte("readme"))
+	if err := bfs.Symlink("../README", "refs/readme"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := bfs.Symlink("..", "refs/up"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := bfs.Symlink("heads", "refs/alias"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	policy, err := billyfs.NewPolicy([]billyfs.PolicyRule{
+		{Paths: []string{"**"}, Ops: billyfs.PolicyRead},
+		{Principals: []string{"writer"}, Paths: []string{"refs/**"}, Ops: billyfs.PolicyAll},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %v", err)
+	}
+	writer := bfs.WithPolicy(policy, "writer")
+
+	// Links inside refs/ do not give access to the worktree.
+	_, err = writer.OpenFile("refs/readme", os.O_WRONLY|os.O_TRUNC, 0)
+	assertDenied(t, "writing through a link", err)
+	_, err = writer.Create("refs/up/new")
+	assertDenied(t, "creating through a linked directory", err)
+	_, err = writer.Create("refs/alias/../../new")
+	assertDenied(t, "creating above a linked directory", err)
+	assertDenied(t, "chmod through a link", writer.(billy.Change).Chmod("refs/readme", 0600))
+	if data := readBillyFile(t, bfs, "README"); string(data) != "readme" {
+		t.Errorf("expected README to be unchanged, got %q", data)
+	}
+
+	// Links to allowed paths and the links themselves can be used.
+	writeBillyFile(t, writer, "refs/alias/topic", []byte("abc"))
+	if err := writer.Remove("refs/readme"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	if _, err := bfs.Stat("README"); err != nil {
+		t.Errorf("expected the target of the removed link to remain: %v", err)
+	}
+}
+
+// TestPolicyBadPattern tests rejecting malformed patterns
+func TestPolicyBadPattern(t *testing.T) {
+	_, err := billyfs.NewPolicy([]billyfs.PolicyRule{{Paths: []string{"refs/["}}}, nil)
+	if err == nil {
+		t.Error("expected bad pattern to be rejected")
+	}
+}
+
+// TestPolicyChrootSymlink tests that chrooting through a symbolic link
+// keeps the rules of its target
+func TestPolicyChrootSymlink(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	setupGlobTree(t, bfs, "secret/key", "secret/sub/key", "public/file")
+	if err := bfs.Symlink("secret", "pub"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	policy, err := billyfs.NewPolicy([]billyfs.PolicyRule{
+		{Paths: []string{"**"}, Ops: billyfs.PolicyRead},
+		{Paths: []string{"secret/**"}, Ops: billyfs.PolicyRead, Deny: true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPolicy failed: %v", err)
+	}
+	view := bfs.WithPolicy(policy, "reader")
+
+	_, err = view.Open("pub/key")
+	assertDenied(t, "opening through a link", err)
+	_, err = view.Chroot("pub")
+	assertDenied(t, "chrooting to a denied directory", err)
+
+	// Allowed links are followed with the rules of their target.
+	if err := bfs.Symlink("../secret/sub", "public/sub"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	public, err := view.Chroot("public")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	if _, err := public.Open("file"); err != nil {
+		t.Errorf("Open failed: %v", err)
+	}
+	_, err = public.Chroot("sub")
+	assertDenied(t, "chrooting through a nested link", err)
+}
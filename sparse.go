@@ -0,0 +1,430 @@
+package billyfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Whence values for File.Seek that move to the next data region or hole
+// at or after the offset, as lseek(2) does on Linux.
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// ErrNoData is returned by Seek with SeekData or SeekHole when the offset
+// is at or beyond the end of the file, or when SeekData finds no data
+// after it.
+var ErrNoData = errors.New("billyfs: no data at or after offset")
+
+// Sparse files are handled natively when the file is on the local
+// filesystem of a platform supporting fallocate(2) and SEEK_DATA. For
+// other backends holes are emulated: a punched range is overwritten with
+// zeros and recorded in an extent map shared by the Filesystem and those
+// derived from it with Chroot, which SeekData, SeekHole and
+// AllocatedBlocks consult. Files are tracked from their first Fallocate
+// past the end or PunchHole; untracked files are entirely data.
+
+// Fallocate allocates storage for length bytes starting at off, extending
+// the file if the range ends past its end.
+func (f *File) Fallocate(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return &fs.PathError{Op: "fallocate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+	err := f.native(os.O_WRONLY, func(fd uintptr) error {
+		return fallocate(fd, off, length)
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		err = f.emulateFallocate(off, length)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "fallocate", Path: f.name, Err: err}
+	}
+	f.wrote()
+	return nil
+}
+
+// PunchHole deallocates the storage of length bytes starting at off. The
+// range reads back as zeros and the size of the file is unchanged.
+func (f *File) PunchHole(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return &fs.PathError{Op: "punchhole", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+	err := f.native(os.O_WRONLY, func(fd uintptr) error {
+		return punchHole(fd, off, length)
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		err = f.emulatePunchHole(off, length)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "punchhole", Path: f.name, Err: err}
+	}
+	f.wrote()
+	return nil
+}
+
+// Stat returns a FileInfo describing the file. Pass it to AllocatedBlocks
+// to learn the storage allocated to the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	info, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.statInfo(f.fs.sparseInfo(f.name, info)), nil
+}
+
+// native runs fn with an operating system descriptor of the file. It
+// returns errors.ErrUnsupported if the file is not on the local
+// filesystem, and fn does on platforms without the operation. Since the
+// file may be opened again with flag, it returns os.ErrPermission if flag
+// asks for writing and the handle was not opened for it.
+func (f *File) native(flag int, fn func(fd uintptr) error) error {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return os.ErrPermission
+	}
+	if fd, ok := f.f.(fdFile); ok {
+		return fn(fd.Fd())
+	}
+	file, err := f.openNative(flag)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return fn(file.Fd())
+}
+
+// openNative opens the file again on the local filesystem with flag. It
+// returns errors.ErrUnsupported if the file is not on the local
+// filesystem.
+func (f *File) openNative(flag int) (*os.File, error) {
+	p, ok := f.fs.nativePath(f.name)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return os.OpenFile(p, flag, 0)
+}
+
+func (f *File) emulateFallocate(off, length int64) error {
+	info, err := f.f.Stat()
+	if err != nil {
+		return err
+	}
+	p := f.fs.absPath(f.name)
+	if end := off + length; end > info.Size() {
+		f.fs.sparse.track(p, info.Size())
+		if err := f.f.Truncate(end); err != nil {
+			return err
+		}
+	}
+	f.fs.sparse.setData(p, off, off+length)
+	return nil
+}
+
+func (f *File) emulatePunchHole(off, length int64) error {
+	info, err := f.f.Stat()
+	if err != nil {
+		return err
+	}
+	end := min(off+length, info.Size())
+	if off >= end {
+		return nil
+	}
+	zeros := make([]byte, min(end-off, 32*1024))
+	for at := off; at < end; {
+		n, err := f.f.WriteAt(zeros[:min(end-at, int64(len(zeros)))], at)
+		if err != nil {
+			return err
+		}
+		at += int64(n)
+	}
+	p := f.fs.absPath(f.name)
+	f.fs.sparse.track(p, info.Size())
+	f.fs.sparse.setHole(p, off, end)
+	return nil
+}
+
+// seekSparse implements Seek with SeekData and SeekHole.
+func (f *File) seekSparse(offset int64, whence int) (int64, error) {
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	var pos int64
+	err := errors.ErrUnsupported
+	if _, ok := f.fs.sparse.extents(f.fs.absPath(f.name)); !ok {
+		err = f.native(os.O_RDONLY, func(fd uintptr) error {
+			var err error
+			pos, err = seekData(fd, offset, whence)
+			return err
+		})
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		pos, err = f.emulateSeek(offset, whence)
+	}
+	if err != nil {
+		if isNoData(err) {
+			err = ErrNoData
+		}
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: err}
+	}
+	return f.f.Seek(pos, io.SeekStart)
+}
+
+func (f *File) emulateSeek(offset int64, whence int) (int64, error) {
+	info, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if offset >= size {
+		return 0, ErrNoData
+	}
+	exts, ok := f.fs.sparse.extents(f.fs.absPath(f.name))
+	if !ok {
+		exts = []extent{{0, size}}
+	}
+	if whence == SeekData {
+		for _, e := range exts {
+			if e.end > offset && e.off < size {
+				return max(offset, e.off), nil
+			}
+		}
+		return 0, ErrNoData
+	}
+	pos := offset
+	for _, e := range exts {
+		if e.off <= pos && pos < e.end {
+			pos = e.end
+		}
+	}
+	return min(pos, size), nil
+}
+
+// wroteAt records a change of n bytes written at off, or ending at the
+// offset of the handle if off is negative.
+func (f *File) wroteAt(off int64, n int) {
+	if p := f.fs.absPath(f.name); f.fs.sparse.tracked(p) {
+		if off < 0 {
+			if pos, err := f.f.Seek(0, io.SeekCurrent); err == nil {
+				off = pos - int64(n)
+			}
+		}
+		if off >= 0 {
+			f.fs.sparse.setData(p, off, off+int64(n))
+		}
+	}
+	f.wrote()
+}
+
+// AllocatedBlocks returns the number of 512-byte blocks of storage
+// allocated to the file described by info, as reported by Stat, Lstat or
+// File.Stat. It reports false if the backend does not provide it. Backends
+// other than the local filesystem can provide it by returning a Sys value
+// with a Blocks() int64 method.
+func AllocatedBlocks(info os.FileInfo) (int64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	for {
+		w, ok := info.(interface{ unwrap() os.FileInfo })
+		if !ok {
+			break
+		}
+		info = w.unwrap()
+	}
+	if s, ok := info.(*sparseFileInfo); ok {
+		return s.blocks, true
+	}
+	switch sys := info.Sys().(type) {
+	case interface{ Blocks() int64 }:
+		return sys.Blocks(), true
+	default:
+		return sysAllocatedBlocks(sys)
+	}
+}
+
+// sparseFileInfo is the FileInfo of a file with emulated holes.
+type sparseFileInfo struct {
+	os.FileInfo
+	blocks int64
+}
+
+// sparseInfo returns info with the allocated blocks of name if it is a
+// file with emulated holes.
+func (f *Filesystem) sparseInfo(name string, info os.FileInfo) os.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	exts, ok := f.sparse.extents(f.absPath(name))
+	if !ok {
+		return info
+	}
+	var n int64
+	for _, e := range exts {
+		n += max(0, min(e.end, info.Size())-e.off)
+	}
+	return &sparseFileInfo{FileInfo: info, blocks: (n + 511) / 512}
+}
+
+// extent is a range of offsets [off, end) holding data.
+type extent struct {
+	off, end int64
+}
+
+// sparseStore holds the sorted, disjoint data extents of files with
+// emulated holes, keyed by absolute paths in the namespace of the
+// underlying absfs filesystem. A nil store tracks nothing.
+type sparseStore struct {
+	mu    sync.Mutex
+	files map[string][]extent
+}
+
+func newSparseStore() *sparseStore {
+	return &sparseStore{files: make(map[string][]extent)}
+}
+
+func (s *sparseStore) tracked(p string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[p]
+	return ok
+}
+
+// extents returns a copy of the data extents of p.
+func (s *sparseStore) extents(p string) ([]extent, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exts, ok := s.files[p]
+	return append([]extent(nil), exts...), ok
+}
+
+// track starts tracking p, a file of the given size that is entirely data.
+func (s *sparseStore) track(p string, size int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[p]; ok {
+		return
+	}
+	s.files[p] = []extent{}
+	if size > 0 {
+		s.files[p] = []extent{{0, size}}
+	}
+}
+
+// setData marks [off, end) of a tracked file as data.
+func (s *sparseStore) setData(p string, off, end int64) {
+	s.update(p, func(exts []extent) []extent {
+		exts = punchExtents(exts, off, end)
+		i := sort.Search(len(exts), func(i int) bool { return exts[i].off >= off })
+		exts = append(exts[:i], append([]extent{{off, end}}, exts[i:]...)...)
+		return mergeExtents(exts)
+	})
+}
+
+// setHole marks [off, end) of a tracked file as a hole.
+func (s *sparseStore) setHole(p string, off, end int64) {
+	s.update(p, func(exts []extent) []extent {
+		return punchExtents(exts, off, end)
+	})
+}
+
+// truncate drops the extents of a tracked file past size. Extending a
+// file leaves a hole.
+func (s *sparseStore) truncate(p string, size int64) {
+	s.update(p, func(exts []extent) []extent {
+		return punchExtents(exts, size, math.MaxInt64)
+	})
+}
+
+func (s *sparseStore) update(p string, fn func([]extent) []extent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exts, ok := s.files[p]
+	if !ok {
+		return
+	}
+	s.files[p] = fn(exts)
+}
+
+// rename moves the extents of oldpath and its descendants to newpath.
+func (s *sparseStore) rename(oldpath, newpath string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	renameTree(s.files, oldpath, newpath)
+}
+
+// drop stops tracking p and its descendants.
+func (s *sparseStore) drop(p string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropTree(s.files, p)
+}
+
+// punchExtents removes [off, end) from exts, splitting the extents that
+// straddle it.
+func punchExtents(exts []extent, off, end int64) []extent {
+	out := make([]extent, 0, len(exts)+1)
+	for _, e := range exts {
+		if e.end <= off || e.off >= end {
+			out = append(out, e)
+			continue
+		}
+		if e.off < off {
+			out = append(out, extent{e.off, off})
+		}
+		if e.end > end {
+			out = append(out, extent{end, e.end})
+		}
+	}
+	return out
+}
+
+// mergeExtents joins adjacent extents of a sorted, disjoint list.
+func mergeExtents(exts []extent) []extent {
+	out := exts[:0]
+	for _, e := range exts {
+		if e.off >= e.end {
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1].end == e.off {
+			out[n-1].end = e.end
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
@@ -0,0 +1,29 @@
+package billyfs
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+func fallocate(fd uintptr, off, length int64) error {
+	return syscall.Fallocate(int(fd), 0, off, length)
+}
+
+func punchHole(fd uintptr, off, length int64) error {
+	return syscall.Fallocate(int(fd), fallocPunchHole|fallocKeepSize, off, length)
+}
+
+func seekData(fd uintptr, offset int64, whence int) (int64, error) {
+	return syscall.Seek(int(fd), offset, whence)
+}
+
+// isNoData reports whether err means that SEEK_DATA or SEEK_HOLE found
+// nothing at or after the offset.
+func isNoData(err error) bool {
+	return errors.Is(err, syscall.ENXIO)
+}
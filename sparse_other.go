@@ -0,0 +1,24 @@
+//go:build !linux
+
+package billyfs
+
+import "errors"
+
+// Native sparse file operations are only implemented on Linux. Elsewhere
+// they report errors.ErrUnsupported and holes are emulated.
+
+func fallocate(fd uintptr, off, length int64) error {
+	return errors.ErrUnsupported
+}
+
+func punchHole(fd uintptr, off, length int64) error {
+	return errors.ErrUnsupported
+}
+
+func seekData(fd uintptr, offset int64, whence int) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func isNoData(err error) bool {
+	return false
+}
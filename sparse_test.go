@@ -0,0 +1,208 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// seekTo seeks f with whence and fails the test on error
+func seekTo(t *testing.T, f *billyfs.File, offset int64, whence int) int64 {
+	t.Helper()
+	pos, err := f.Seek(offset, whence)
+	if err != nil {
+		t.Fatalf("Seek(%d, %d) failed: %v", offset, whence, err)
+	}
+	return pos
+}
+
+// TestSparseNative tests hole punching on the local filesystem
+func TestSparseNative(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	const block = 64 * 1024
+	data := bytes.Repeat([]byte{'x'}, 3*block)
+	writeBillyFile(t, bfs, "pack.bin", data)
+
+	bf, err := bfs.OpenFile("pack.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer bf.Close()
+	f := bf.(*billyfs.File)
+	if err := f.PunchHole(block, block); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) || strings.Contains(err.Error(), "not supported") {
+			t.Skipf("hole punching not supported: %v", err)
+		}
+		t.Fatalf("PunchHole failed: %v", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != 3*block {
+		t.Errorf("expected size to be kept, got %d", info.Size())
+	}
+	if blocks, ok := billyfs.AllocatedBlocks(info); !ok || blocks*512 > 2*block {
+		t.Errorf("expected at most two blocks allocated, got %d, %v", blocks, ok)
+	}
+	p := make([]byte, block)
+	if _, err := f.ReadAt(p, block); err != nil || !bytes.Equal(p, make([]byte, block)) {
+		t.Errorf("expected the hole to read as zeros, %v", err)
+	}
+	if pos := seekTo(t, f, 0, billyfs.SeekHole); pos != block {
+		t.Skipf("filesystem does not report holes, SeekHole returned %d", pos)
+	}
+	if pos := seekTo(t, f, block, billyfs.SeekData); pos != 2*block {
+		t.Errorf("expected data at %d, got %d", 2*block, pos)
+	}
+	if _, err := f.Seek(3*block, billyfs.SeekData); !errors.Is(err, billyfs.ErrNoData) {
+		t.Errorf("expected ErrNoData at the end, got %v", err)
+	}
+
+	if err := f.Fallocate(3*block, block); err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+	if info, _ := bfs.Stat("pack.bin"); info.Size() != 4*block {
+		t.Errorf("expected Fallocate to extend the file, got %d", info.Size())
+	}
+}
+
+// TestSparseEmulated tests the extent map used by backends without native
+// sparse files
+func TestSparseEmulated(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	bfs, err := billyfs.NewFS(&countingFS{SymlinkFileSystem: fs}, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	data := testContent(3000)
+	writeBillyFile(t, bfs, "lfs.bin", data)
+
+	bf, err := bfs.OpenFile("lfs.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f := bf.(*billyfs.File)
+
+	// Untracked files are data up to the implicit hole at the end.
+	if pos := seekTo(t, f, 0, billyfs.SeekHole); pos != 3000 {
+		t.Errorf("expected the only hole at the end, got %d", pos)
+	}
+
+	if err := f.PunchHole(1000, 1000); err != nil {
+		t.Fatalf("PunchHole failed: %v", err)
+	}
+	got := make([]byte, 3000)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	want := append(append(append([]byte(nil), data[:1000]...), make([]byte, 1000)...), data[2000:]...)
+	if !bytes.Equal(got, want) {
+		t.Error("expected the punched range to read as zeros")
+	}
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{0, billyfs.SeekHole, 1000},
+		{0, billyfs.SeekData, 0},
+		{1000, billyfs.SeekData, 2000},
+		{1500, billyfs.SeekHole, 1500},
+		{2500, billyfs.SeekHole, 3000},
+	} {
+		if pos := seekTo(t, f, tc.offset, tc.whence); pos != tc.want {
+			t.Errorf("Seek(%d, %d): expected %d, got %d", tc.offset, tc.whence, tc.want, pos)
+		}
+	}
+	if _, err := f.Seek(3000, billyfs.SeekData); !errors.Is(err, billyfs.ErrNoData) {
+		t.Errorf("expected ErrNoData at the end, got %v", err)
+	}
+	info, _ := f.Stat()
+	if blocks, ok := billyfs.AllocatedBlocks(info); !ok || blocks != 4 {
+		t.Errorf("expected 4 allocated blocks, got %d, %v", blocks, ok)
+	}
+
+	// Writes fill holes, Fallocate allocates past the end and extending
+	// Truncate leaves a hole.
+	f.Seek(1500, io.SeekStart)
+	f.Write([]byte("abc"))
+	if pos := seekTo(t, f, 1000, billyfs.SeekData); pos != 1500 {
+		t.Errorf("expected written data at 1500, got %d", pos)
+	}
+	if err := f.Fallocate(3000, 1000); err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+	if err := f.Truncate(5000); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if pos := seekTo(t, f, 2000, billyfs.SeekHole); pos != 4000 {
+		t.Errorf("expected a hole at 4000, got %d", pos)
+	}
+	if _, err := f.Seek(4000, billyfs.SeekData); !errors.Is(err, billyfs.ErrNoData) {
+		t.Errorf("expected no data after 4000, got %v", err)
+	}
+	f.Close()
+
+	// Extents follow renames and are dropped when the file is truncated.
+	if err := bfs.Rename("lfs.bin", "moved.bin"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	info, _ = bfs.Stat("moved.bin")
+	if blocks, _ := billyfs.AllocatedBlocks(info); blocks != 6 {
+		t.Errorf("expected 6 allocated blocks after Rename, got %d", blocks)
+	}
+	writeBillyFile(t, bfs, "moved.bin", []byte("fresh"))
+	bf, err = bfs.Open("moved.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bf.Close()
+	if pos := seekTo(t, bf.(*billyfs.File), 0, billyfs.SeekHole); pos != 5 {
+		t.Errorf("expected a recreated file to be all data, got hole at %d", pos)
+	}
+}
+
+// TestSparseReadOnly tests that read-only handles cannot punch holes or
+// allocate storage
+func TestSparseReadOnly(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	local, _ := newTestFS(t)
+	emulated, err := billyfs.NewFS(&countingFS{SymlinkFileSystem: fs}, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	data := testContent(3000)
+	for _, bfs := range []*billyfs.Filesystem{local, emulated} {
+		writeBillyFile(t, bfs, "file.bin", data)
+		bf, err := bfs.Open("file.bin")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		f := bf.(*billyfs.File)
+		var perr *os.PathError
+		if err := f.PunchHole(1000, 1000); !errors.As(err, &perr) || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("PunchHole: expected a permission error, got %v", err)
+		}
+		if err := f.Fallocate(3000, 1000); !errors.As(err, &perr) || !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Fallocate: expected a permission error, got %v", err)
+		}
+		f.Close()
+		if got := readTestFile(t, bfs, "file.bin"); got != string(data) {
+			t.Error("expected the file to be unchanged")
+		}
+	}
+}
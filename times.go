@@ -0,0 +1,74 @@
+package billyfs
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrSourceDateEpoch is returned by NewFSWithOptions in reproducible mode
+// when the SOURCE_DATE_EPOCH environment variable is not set to a number
+// of seconds since the Unix epoch.
+var ErrSourceDateEpoch = errors.New("billyfs: SOURCE_DATE_EPOCH must be set to a Unix timestamp")
+
+// sourceDateEpoch returns the time set by the SOURCE_DATE_EPOCH environment
+// variable, as defined by reproducible-builds.org.
+func sourceDateEpoch() (time.Time, error) {
+	secs, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, ErrSourceDateEpoch
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// truncTime returns t truncated to the time precision of f.
+func (f *Filesystem) truncTime(t time.Time) time.Time {
+	if f.precision <= 0 {
+		return t
+	}
+	return t.Truncate(f.precision)
+}
+
+// stamp sets the access and modification times of name to SOURCE_DATE_EPOCH
+// in reproducible mode.
+func (f *Filesystem) stamp(name string) error {
+	if f.epoch.IsZero() {
+		return nil
+	}
+	if err := f.fs.Chtimes(name, f.epoch, f.epoch); err != nil {
+		return err
+	}
+	f.invalidateTarget(name)
+	return nil
+}
+
+// timeFileInfo is the FileInfo of a file whose modification time is
+// truncated to the time precision of a Filesystem.
+type timeFileInfo struct {
+	os.FileInfo
+	mtime time.Time
+}
+
+func (i *timeFileInfo) ModTime() time.Time {
+	return i.mtime
+}
+
+func (i *timeFileInfo) unwrap() os.FileInfo {
+	return i.FileInfo
+}
+
+// timeInfo returns info with its modification time truncated to the time
+// precision of f.
+func (f *Filesystem) timeInfo(info os.FileInfo) os.FileInfo {
+	if f.precision <= 0 || info == nil {
+		return info
+	}
+	return &timeFileInfo{FileInfo: info, mtime: f.truncTime(info.ModTime())}
+}
+
+// statInfo returns info as reported to users of f, with its modification
+// time and the ids of its owner translated.
+func (f *Filesystem) statInfo(info os.FileInfo) os.FileInfo {
+	return f.idInfo(f.timeInfo(info))
+}
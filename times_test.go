@@ -0,0 +1,220 @@
+package billyfs_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// roundingTimeFS rounds the times passed to Chtimes to whole seconds, as
+// backends storing coarser times do
+type roundingTimeFS struct {
+	absfs.SymlinkFileSystem
+}
+
+func (r *roundingTimeFS) Chtimes(name string, atime, mtime time.Time) error {
+	return r.SymlinkFileSystem.Chtimes(name, atime.Round(time.Second), mtime.Round(time.Second))
+}
+
+// indexEntry is the stat data a Git index keeps to detect changed files
+// without reading them
+type indexEntry struct {
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// buildIndex records the stat data of the files in the root directory as
+// reported by Stat
+func buildIndex(t *testing.T, bfs *billyfs.Filesystem, names ...string) map[string]indexEntry {
+	t.Helper()
+	idx := make(map[string]indexEntry)
+	for _, name := range names {
+		info, err := bfs.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		idx[name] = indexEntry{info.Size(), info.Mode(), info.ModTime()}
+	}
+	return idx
+}
+
+// modifiedFiles compares the root directory as listed by ReadDir with idx,
+// as git status does, and returns the files that look modified
+func modifiedFiles(t *testing.T, bfs *billyfs.Filesystem, idx map[string]indexEntry) []string {
+	t.Helper()
+	infos, err := bfs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var modified []string
+	for _, info := range infos {
+		e, ok := idx[info.Name()]
+		if ok && (e.size != info.Size() || e.mode != info.Mode() || !e.mtime.Equal(info.ModTime())) {
+			modified = append(modified, info.Name())
+		}
+	}
+	return modified
+}
+
+func newTimesTestFS(t *testing.T, fs absfs.SymlinkFileSystem, opts billyfs.Options) *billyfs.Filesystem {
+	t.Helper()
+	bfs, err := billyfs.NewFSWithOptions(fs, t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	return bfs
+}
+
+// TestTimePrecision tests that times set on a backend with a coarser
+// precision read back as set
+func TestTimePrecision(t *testing.T) {
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 700000000, time.UTC)
+
+	// Without a precision, the time the index records differs from the
+	// one stored.
+	bfs := newTimesTestFS(t, &roundingTimeFS{backend}, billyfs.Options{})
+	writeBillyFile(t, bfs, "file", []byte("data"))
+	bfs.Chtimes("file", mtime, mtime)
+	info, _ := bfs.Stat("file")
+	idx := map[string]indexEntry{"file": {info.Size(), info.Mode(), mtime}}
+	if modified := modifiedFiles(t, bfs, idx); len(modified) != 1 {
+		t.Fatal("expected the backend to round the time")
+	}
+
+	bfs = newTimesTestFS(t, &roundingTimeFS{backend}, billyfs.Options{TimePrecision: time.Second})
+	writeBillyFile(t, bfs, "file", []byte("data"))
+	writeBillyFile(t, bfs, "written", []byte("data"))
+	if err := bfs.Chtimes("file", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	want := mtime.Truncate(time.Second)
+	info, _ = bfs.Stat("file")
+	if !info.ModTime().Equal(want) {
+		t.Errorf("expected %v, got %v", want, info.ModTime())
+	}
+	// Times set by writes are truncated as well.
+	info, _ = bfs.Lstat("written")
+	if info.ModTime().Nanosecond() != 0 {
+		t.Errorf("expected truncated time, got %v", info.ModTime())
+	}
+	file, _ := bfs.Open("written")
+	if info, _ = file.(*billyfs.File).Stat(); info.ModTime().Nanosecond() != 0 {
+		t.Errorf("expected truncated time, got %v", info.ModTime())
+	}
+	file.Close()
+
+	idx = buildIndex(t, bfs, "file", "written")
+	if modified := modifiedFiles(t, bfs, idx); len(modified) != 0 {
+		t.Errorf("unexpected modified files %v", modified)
+	}
+	bfs.Chtimes("file", mtime, mtime)
+	if modified := modifiedFiles(t, bfs, idx); len(modified) != 0 {
+		t.Errorf("unexpected modified files after Chtimes %v", modified)
+	}
+
+	writeBillyFile(t, bfs, "written", []byte("more data"))
+	if modified := modifiedFiles(t, bfs, idx); len(modified) != 1 || modified[0] != "written" {
+		t.Errorf("expected only written to be modified, got %v", modified)
+	}
+}
+
+// TestReproducible tests that created files get the time of
+// SOURCE_DATE_EPOCH
+func TestReproducible(t *testing.T) {
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	epoch := time.Unix(1700000000, 0)
+
+	build := func() *billyfs.Filesystem {
+		bfs := newTimesTestFS(t, backend, billyfs.Options{Reproducible: true})
+		writeBillyFile(t, bfs, "HEAD", []byte("ref: refs/heads/main\n"))
+		file, err := bfs.OpenFile("config", os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		file.Close()
+		if err := bfs.MkdirAll("objects/pack", 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := bfs.AtomicWriteFile("packed-refs", []byte("# pack-refs\n"), 0644, billyfs.AtomicOptions{}); err != nil {
+			t.Fatalf("AtomicWriteFile failed: %v", err)
+		}
+		return bfs
+	}
+
+	first := build()
+	for _, name := range []string{"HEAD", "config", "objects/pack", "packed-refs"} {
+		if info, _ := first.Stat(name); !info.ModTime().Equal(epoch) {
+			t.Errorf("%s: expected %v, got %v", name, epoch, info.ModTime())
+		}
+	}
+
+	// A later build gives the same index, and the files written since it
+	// was recorded do not look modified.
+	time.Sleep(10 * time.Millisecond)
+	second := build()
+	idx := buildIndex(t, first, "HEAD", "config", "packed-refs")
+	if again := buildIndex(t, second, "HEAD", "config", "packed-refs"); len(again) != len(idx) {
+		t.Fatalf("unexpected index %v", again)
+	} else {
+		for name, e := range idx {
+			if again[name] != e {
+				t.Errorf("%s: expected %v, got %v", name, e, again[name])
+			}
+		}
+	}
+	writeBillyFile(t, first, "HEAD", []byte("ref: refs/heads/feature\n"))
+	if modified := modifiedFiles(t, first, idx); len(modified) != 1 || modified[0] != "HEAD" {
+		t.Errorf("expected only HEAD to be modified, got %v", modified)
+	}
+	if info, _ := first.Stat("HEAD"); !info.ModTime().Equal(epoch) {
+		t.Errorf("expected rewritten file to get %v, got %v", epoch, info.ModTime())
+	}
+
+	// Files created by transactions get the time as well.
+	tx, err := first.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	file, err := tx.Create("ORIG_HEAD")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("0000000000000000000000000000000000000000\n"))
+	file.Close()
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if info, _ := first.Stat("ORIG_HEAD"); !info.ModTime().Equal(epoch) {
+		t.Errorf("expected file created by a transaction to get %v, got %v", epoch, info.ModTime())
+	}
+
+	// Rewrites keeping the size and the time are missed by the index, as
+	// the documentation of Reproducible warns.
+	idx = buildIndex(t, second, "HEAD")
+	writeBillyFile(t, second, "HEAD", []byte("ref: refs/heads/next\n"))
+	if modified := modifiedFiles(t, second, idx); len(modified) != 0 {
+		t.Errorf("expected the rewrite to go unnoticed, got %v", modified)
+	}
+
+	for _, value := range []string{"", "yesterday", "-1"} {
+		t.Setenv("SOURCE_DATE_EPOCH", value)
+		_, err := billyfs.NewFSWithOptions(backend, t.TempDir(), billyfs.Options{Reproducible: true})
+		if !errors.Is(err, billyfs.ErrSourceDateEpoch) {
+			t.Errorf("SOURCE_DATE_EPOCH=%q: expected ErrSourceDateEpoch, got %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package billyfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// SyncAction is a change made by Sync to the destination tree.
+type SyncAction int
+
+// Changes made by Sync.
+const (
+	// SyncCopy copies the contents, mode and modification time of a file.
+	SyncCopy SyncAction = iota
+	// SyncMkdir creates a directory.
+	SyncMkdir
+	// SyncSymlink creates a symbolic link, replacing one with another
+	// target.
+	SyncSymlink
+	// SyncDelete removes an entry, with its descendants.
+	SyncDelete
+	// SyncAttrs updates the mode and modification time of an entry.
+	SyncAttrs
+)
+
+var syncActionNames = [...]string{"copy", "mkdir", "symlink", "delete", "attrs"}
+
+// String returns the name of the action.
+func (a SyncAction) String() string {
+	if a < 0 || int(a) >= len(syncActionNames) {
+		return "unknown"
+	}
+	return syncActionNames[a]
+}
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// Checksum compares files of the same size by their SHA-256 hash
+	// instead of their modification time.
+	Checksum bool
+
+	// Delete removes the entries of the destination that are not in the
+	// source. Entries whose type differs are replaced regardless.
+	Delete bool
+
+	// DryRun reports the changes Sync would make without making them.
+	DryRun bool
+
+	// Progress, if not nil, is called after each change, or before it
+	// with DryRun.
+	Progress func(SyncProgress)
+}
+
+// SyncProgress describes a change made by Sync.
+type SyncProgress struct {
+	Path   string
+	Action SyncAction
+	// Bytes is the number of bytes copied for the change.
+	Bytes int64
+	// Done is the number of changes made so far, including this one, out
+	// of Total.
+	Done, Total int
+}
+
+// SyncStats summarizes the changes made by Sync.
+type SyncStats struct {
+	Copied   int
+	Dirs     int
+	Symlinks int
+	Deleted  int
+	Attrs    int
+	Bytes    int64
+}
+
+// Sync makes the tree of dst a copy of the tree of src, changing only the
+// entries that differ as reported by Diff: files differing in size or
+// modification time, or in contents with Checksum, are copied, and
+// missing directories and symbolic links are created. With Checksum,
+// files with the same contents but another modification time only get the
+// time of the source. Modes and modification times are preserved when dst
+// implements billy.Change, as Filesystem does, and symbolic links when
+// both implement billy.Symlink; the links themselves keep the mode and
+// time they are created with, since billy.Change follows them. Read-only
+// files of dst are made writable to be replaced. File contents are copied
+// with io.Copy, so copies between Filesystems on the local filesystem are
+// made by the kernel.
+func Sync(dst, src billy.Filesystem, opts SyncOptions) (SyncStats, error) {
+	d := &differ{from: dst, to: src, opts: DiffOptions{Hash: opts.Checksum}, stale: true}
+	entries, err := d.run()
+	if err != nil {
+		return SyncStats{}, err
+	}
+	s := &syncer{dst: dst, src: src, opts: opts, dirs: make(map[string]bool)}
+	s.plan(entries)
+
+	for i, op := range s.ops {
+		p := SyncProgress{Path: op.path, Action: op.action, Done: i + 1, Total: len(s.ops)}
+		if op.action == SyncCopy {
+			p.Bytes = op.info.Size()
+		}
+		if !opts.DryRun {
+			n, err := s.apply(op)
+			if err != nil {
+				return s.stats, err
+			}
+			p.Bytes = n
+		}
+		s.count(p)
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	if opts.DryRun {
+		return s.stats, nil
+	}
+	return s.stats, s.fixDirTimes()
+}
+
+// syncer holds the state of a Sync call.
+type syncer struct {
+	dst, src billy.Filesystem
+	opts     SyncOptions
+	ops      []syncOp
+	stats    SyncStats
+
+	// dirs are the directories of dst whose modification time must be
+	// restored once their entries are changed.
+	dirs map[string]bool
+}
+
+// syncOp is a change planned by Sync. info describes the entry in the
+// source, or is nil for a deletion.
+type syncOp struct {
+	path   string
+	action SyncAction
+	info   os.FileInfo
+}
+
+// plan turns the differences from dst to src into changes.
+func (s *syncer) plan(entries []DiffEntry) {
+	deleted := ""
+	for _, e := range entries {
+		if deleted != "" && isWithin(deleted, e.Path) {
+			continue
+		}
+		switch {
+		case e.Kind&DiffRemoved != 0:
+			if s.opts.Delete {
+				s.add(e.Path, SyncDelete, nil)
+				deleted = e.Path
+			}
+		case e.Kind&DiffTypeChanged != 0:
+			s.add(e.Path, SyncDelete, nil)
+			if e.From.IsDir() {
+				deleted = e.Path
+			}
+			s.add(e.Path, createAction(e.To), e.To)
+		case e.Kind&(DiffAdded|DiffModified) != 0:
+			s.add(e.Path, createAction(e.To), e.To)
+		default:
+			s.add(e.Path, SyncAttrs, e.To)
+		}
+	}
+}
+
+func (s *syncer) add(name string, action SyncAction, info os.FileInfo) {
+	s.ops = append(s.ops, syncOp{path: name, action: action, info: info})
+}
+
+// createAction returns the change creating an entry described by info.
+func createAction(info os.FileInfo) SyncAction {
+	switch {
+	case info.IsDir():
+		return SyncMkdir
+	case info.Mode()&os.ModeSymlink != 0:
+		return SyncSymlink
+	}
+	return SyncCopy
+}
+
+// apply makes a change and returns the number of bytes copied.
+func (s *syncer) apply(op syncOp) (int64, error) {
+	s.dirs[path.Dir(op.path)] = true
+	switch op.action {
+	case SyncDelete:
+		return 0, removeAll(s.dst, op.path)
+	case SyncMkdir:
+		s.dirs[op.path] = true
+		if err := s.dst.MkdirAll(op.path, op.info.Mode().Perm()); err != nil {
+			return 0, err
+		}
+		return 0, s.chmod(op.path, op.info)
+	case SyncSymlink:
+		return 0, s.symlink(op.path)
+	case SyncCopy:
+		n, err := s.copy(op.path, op.info)
+		if err != nil {
+			return n, err
+		}
+		return n, s.attrs(op.path, op.info)
+	}
+	if op.info.IsDir() {
+		s.dirs[op.path] = true
+		return 0, s.chmod(op.path, op.info)
+	}
+	return 0, s.attrs(op.path, op.info)
+}
+
+// copy copies the contents of the file name.
+func (s *syncer) copy(name string, info os.FileInfo) (int64, error) {
+	in, err := s.src.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	// attrs restores the mode of the source afterwards.
+	if old, err := lstat(s.dst, name); err == nil && old.Mode().IsRegular() && old.Mode().Perm()&0200 == 0 {
+		if change, ok := s.dst.(billy.Change); ok {
+			if err := change.Chmod(name, old.Mode().Perm()|0200); err != nil {
+				return 0, err
+			}
+		}
+	}
+	out, err := s.dst.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// symlink creates the symbolic link name with the target it has in the
+// source, replacing any existing link.
+func (s *syncer) symlink(name string) error {
+	srcLinks, ok1 := s.src.(billy.Symlink)
+	dstLinks, ok2 := s.dst.(billy.Symlink)
+	if !ok1 || !ok2 {
+		return &os.LinkError{Op: "symlink", Old: name, New: name, Err: billy.ErrNotSupported}
+	}
+	target, err := srcLinks.Readlink(name)
+	if err != nil {
+		return err
+	}
+	if _, err := dstLinks.Lstat(name); err == nil {
+		if err := s.dst.Remove(name); err != nil {
+			return err
+		}
+	}
+	return dstLinks.Symlink(target, name)
+}
+
+// attrs sets the mode and modification time of name to those of info,
+// unless it is a symbolic link.
+func (s *syncer) attrs(name string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := s.chmod(name, info); err != nil {
+		return err
+	}
+	if change, ok := s.dst.(billy.Change); ok {
+		return change.Chtimes(name, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+func (s *syncer) chmod(name string, info os.FileInfo) error {
+	if change, ok := s.dst.(billy.Change); ok && info.Mode()&os.ModeSymlink == 0 {
+		return change.Chmod(name, info.Mode().Perm())
+	}
+	return nil
+}
+
+// fixDirTimes restores the modification times of the directories whose
+// entries were changed, deepest first.
+func (s *syncer) fixDirTimes() error {
+	change, ok := s.dst.(billy.Change)
+	if !ok {
+		return nil
+	}
+	dirs := make([]string, 0, len(s.dirs))
+	for dir := range s.dirs {
+		if dir != "." {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		info, err := s.src.Stat(dir)
+		if err != nil {
+			continue
+		}
+		if err := change.Chtimes(dir, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncer) count(p SyncProgress) {
+	switch p.Action {
+	case SyncCopy:
+		s.stats.Copied++
+	case SyncMkdir:
+		s.stats.Dirs++
+	case SyncSymlink:
+		s.stats.Symlinks++
+	case SyncDelete:
+		s.stats.Deleted++
+	case SyncAttrs:
+		s.stats.Attrs++
+	}
+	s.stats.Bytes += p.Bytes
+}
+
+// removeAll removes name and its descendants from fs.
+func removeAll(fs billy.Filesystem, name string) error {
+	info, err := lstat(fs, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			if err := removeAll(fs, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(name)
+}
+
+// lstat returns the FileInfo of name without following a symbolic link
+// if fs supports them.
+func lstat(fs billy.Filesystem, name string) (os.FileInfo, error) {
+	if links, ok := fs.(billy.Symlink); ok {
+		return links.Lstat(name)
+	}
+	return fs.Stat(name)
+}
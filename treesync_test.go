@@ -0,0 +1,215 @@
+package billyfs_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// setupSyncTrees creates a source tree on the local filesystem and an empty
+// destination on another backend
+func setupSyncTrees(t *testing.T) (dst, src *billyfs.Filesystem) {
+	t.Helper()
+	src, _ = newTestFS(t)
+	setupGlobTree(t, src, "HEAD", "objects/pack/p.pack", "objects/info/alternates", "hooks/pre-commit")
+	writeBillyFile(t, src, "objects/pack/p.pack", testContent(10000))
+	src.Chmod("hooks/pre-commit", 0755)
+	src.Symlink("objects/pack/p.pack", "current")
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"HEAD", "objects/pack/p.pack", "hooks/pre-commit", "hooks"} {
+		src.Chtimes(name, mtime, mtime)
+	}
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	return newCountingTestFS(t, &countingFS{SymlinkFileSystem: fs}), src
+}
+
+// assertSynced checks that dst has the same tree as src
+func assertSynced(t *testing.T, dst, src *billyfs.Filesystem) {
+	t.Helper()
+	entries, err := billyfs.Diff(dst, src, billyfs.DiffOptions{Hash: true})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("trees differ after Sync: %v", diffPaths(entries))
+	}
+}
+
+// TestSync tests copying a tree and incremental updates
+func TestSync(t *testing.T) {
+	dst, src := setupSyncTrees(t)
+
+	var progress []billyfs.SyncProgress
+	stats, err := billyfs.Sync(dst, src, billyfs.SyncOptions{
+		Progress: func(p billyfs.SyncProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	assertSynced(t, dst, src)
+	if stats.Copied != 4 || stats.Dirs != 4 || stats.Symlinks != 1 || stats.Bytes != 10000 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if last := progress[len(progress)-1]; last.Done != last.Total || last.Total != 9 {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+	info, _ := dst.Stat("hooks/pre-commit")
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode to be preserved, got %v", info.Mode())
+	}
+	info, _ = dst.Stat("hooks")
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Errorf("expected directory time to be preserved, got %v", info.ModTime())
+	}
+	if target, _ := dst.Readlink("current"); target != "objects/pack/p.pack" {
+		t.Errorf("expected symlink to be preserved, got %q", target)
+	}
+
+	// Nothing changes on a second run.
+	stats, err = billyfs.Sync(dst, src, billyfs.SyncOptions{})
+	if err != nil || stats != (billyfs.SyncStats{}) {
+		t.Errorf("expected no changes, got %+v, %v", stats, err)
+	}
+
+	// Only the changed file is copied; extraneous files are kept unless
+	// Delete is set.
+	writeBillyFile(t, src, "HEAD", []byte("ref: refs/heads/main\n"))
+	writeBillyFile(t, dst, "stale", []byte("x"))
+	stats, err = billyfs.Sync(dst, src, billyfs.SyncOptions{})
+	if err != nil || stats.Copied != 1 || stats.Deleted != 0 {
+		t.Errorf("unexpected stats %+v, %v", stats, err)
+	}
+	if _, err := dst.Stat("stale"); err != nil {
+		t.Errorf("expected extraneous file to be kept: %v", err)
+	}
+	if _, err := billyfs.Sync(dst, src, billyfs.SyncOptions{Delete: true}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	assertSynced(t, dst, src)
+}
+
+// TestSyncDryRunAndReplace tests dry runs and replacing entries of another
+// type
+func TestSyncDryRunAndReplace(t *testing.T) {
+	dst, src := setupSyncTrees(t)
+	setupGlobTree(t, dst, "HEAD/nested/file", "extra/file")
+
+	var actions []string
+	stats, err := billyfs.Sync(dst, src, billyfs.SyncOptions{
+		DryRun:   true,
+		Delete:   true,
+		Progress: func(p billyfs.SyncProgress) { actions = append(actions, p.Action.String()+" "+p.Path) },
+	})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if actions[0] != "delete HEAD" || actions[1] != "copy HEAD" || stats.Deleted != 2 {
+		t.Errorf("unexpected dry run %v, %+v", actions, stats)
+	}
+	if _, err := dst.Stat("HEAD/nested/file"); err != nil {
+		t.Errorf("expected dry run to change nothing: %v", err)
+	}
+
+	if _, err := billyfs.Sync(dst, src, billyfs.SyncOptions{Checksum: true, Delete: true}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	assertSynced(t, dst, src)
+	if _, err := dst.Stat("extra"); !os.IsNotExist(err) {
+		t.Errorf("expected extra to be deleted, got %v", err)
+	}
+}
+
+// linkModeFS reports symbolic links with mode 0755, as on systems where
+// links have permissions
+type linkModeFS struct {
+	*billyfs.Filesystem
+}
+
+type linkModeInfo struct {
+	os.FileInfo
+}
+
+func (i linkModeInfo) Mode() os.FileMode {
+	return os.ModeSymlink | 0755
+}
+
+func (l linkModeFS) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := l.Filesystem.ReadDir(name)
+	infos = append([]os.FileInfo(nil), infos...)
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			infos[i] = linkModeInfo{info}
+		}
+	}
+	return infos, err
+}
+
+// TestSyncLinksAndReadOnly tests that updating symbolic links leaves their
+// targets alone and that read-only files are replaced
+func TestSyncLinksAndReadOnly(t *testing.T) {
+	dst, src := setupSyncTrees(t)
+	src.Chmod("HEAD", 0444)
+	if _, err := billyfs.Sync(dst, src, billyfs.SyncOptions{}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// The link differs in mode only, which is not copied.
+	stats, err := billyfs.Sync(dst, linkModeFS{src}, billyfs.SyncOptions{})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Attrs != 1 {
+		t.Errorf("expected the attributes of the link to differ, got %+v", stats)
+	}
+	want, _ := src.Stat("objects/pack/p.pack")
+	if info, _ := dst.Stat("objects/pack/p.pack"); !info.ModTime().Equal(want.ModTime()) {
+		t.Errorf("expected the target of the link to keep %v, got %v", want.ModTime(), info.ModTime())
+	}
+
+	src.Chmod("HEAD", 0644)
+	writeBillyFile(t, src, "HEAD", []byte("ref: refs/heads/main\n"))
+	src.Chmod("HEAD", 0444)
+	if _, err := billyfs.Sync(dst, src, billyfs.SyncOptions{}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	assertSynced(t, dst, src)
+	if info, _ := dst.Stat("HEAD"); info.Mode().Perm() != 0444 {
+		t.Errorf("expected mode 0444, got %v", info.Mode())
+	}
+}
+
+// TestSyncChecksumTimes tests that with Checksum, files with the same
+// contents get the modification time of the source without being copied
+func TestSyncChecksumTimes(t *testing.T) {
+	dst, src := setupSyncTrees(t)
+	if _, err := billyfs.Sync(dst, src, billyfs.SyncOptions{Checksum: true}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	mtime := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := src.Chtimes("HEAD", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	stats, err := billyfs.Sync(dst, src, billyfs.SyncOptions{Checksum: true})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Copied != 0 || stats.Attrs != 1 {
+		t.Errorf("expected only the time to be updated, got %+v", stats)
+	}
+	if info, _ := dst.Stat("HEAD"); !info.ModTime().Equal(mtime) {
+		t.Errorf("expected %v, got %v", mtime, info.ModTime())
+	}
+
+	stats, err = billyfs.Sync(dst, src, billyfs.SyncOptions{Checksum: true})
+	if err != nil || stats != (billyfs.SyncStats{}) {
+		t.Errorf("expected no changes, got %+v, %v", stats, err)
+	}
+}
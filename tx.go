@@ -0,0 +1,702 @@
+package billyfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/absfs/absfs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+// TxJournalDir is the directory, relative to the root of a Filesystem, in
+// which transactions stage their data and keep their journals. ReadDir,
+// Walk and Glob omit directories with this name, also below the root since
+// it is the root of the Filesystems derived with Chroot.
+const TxJournalDir = ".billyfs-tx"
+
+var (
+	// ErrTxDone is returned by the methods of a Tx that was already
+	// committed or rolled back.
+	ErrTxDone = errors.New("billyfs: transaction already committed or rolled back")
+
+	// ErrTxJournal is returned when a transaction journal is damaged. NewFS
+	// leaves damaged journals in place instead of failing.
+	ErrTxJournal = errors.New("billyfs: damaged transaction journal")
+
+	errTxIsDir    = errors.New("is a directory")
+	errTxNotEmpty = errors.New("directory not empty")
+)
+
+// Tx is a set of changes to a Filesystem that are applied together by
+// Commit or discarded by Rollback. Until Commit the changes are only
+// recorded, and the contents of files created with Create are written to
+// the journal directory of the transaction.
+//
+// Commit keeps the previous state of every path it replaces or removes in
+// the journal until all changes are applied. If a change fails, the changes
+// already applied are reverted. If the process stops during Commit, the
+// next NewFS on the same directory reverts them. The name of the journal
+// directory records the host and process owning the transaction, and NewFS
+// only recovers or removes the journals of processes of the same host that
+// are no longer running, and those of transactions of its own process that
+// have returned from Commit or Rollback.
+type Tx struct {
+	fs  *Filesystem
+	dir string
+
+	mu    sync.Mutex
+	ops   []txOp
+	files []*txFile
+	done  bool
+}
+
+type txOp struct {
+	Kind   string      `json:"kind"`
+	Name   string      `json:"name"`
+	Target string      `json:"target,omitempty"`
+	Staged string      `json:"staged,omitempty"`
+	Perm   os.FileMode `json:"perm,omitempty"`
+}
+
+const (
+	txCreate   = "create"
+	txRename   = "rename"
+	txRemove   = "remove"
+	txMkdirAll = "mkdirall"
+	txSymlink  = "symlink"
+)
+
+// txLogEntry is a line of the journal log written during Commit. A step
+// entry is written before op Step is applied, a mkdir entry before Dir is
+// created and a commit entry once all operations were applied.
+type txLogEntry struct {
+	Kind string `json:"kind"`
+	Step int    `json:"step"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+// liveTxs holds the names of the journal directories of the transactions
+// of this process that have not returned from Commit or Rollback.
+var liveTxs sync.Map
+
+// txHost returns the host name recorded in the names of journal
+// directories.
+func txHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return strings.ReplaceAll(host, "/", "_")
+}
+
+// txOwner returns the prefix of the journal directory names of the
+// transactions of this process: the host name and process id.
+func txOwner() string {
+	return txHost() + "-" + strconv.Itoa(os.Getpid()) + "-"
+}
+
+// txOwnerLive reports whether the transaction with the journal directory
+// named name may still be in progress. Journals of other hosts are assumed
+// to be, and journals without an owner, written by earlier versions, are
+// not.
+func txOwnerLive(name string) bool {
+	i := strings.LastIndex(name, "-")
+	j := strings.LastIndex(name[:max(i, 0)], "-")
+	if i < 0 || j < 0 {
+		return false
+	}
+	pid, err := strconv.Atoi(name[j+1 : i])
+	if err != nil {
+		return false
+	}
+	if name[:j] != txHost() {
+		return true
+	}
+	if pid == os.Getpid() {
+		_, ok := liveTxs.Load(name)
+		return ok
+	}
+	return processAlive(pid)
+}
+
+// isTxJournal reports whether entry is a transaction journal directory.
+func isTxJournal(entry fs.DirEntry) bool {
+	return entry.Name() == TxJournalDir && entry.IsDir()
+}
+
+// Begin starts a transaction on f.
+func (f *Filesystem) Begin() (*Tx, error) {
+	initRNG()
+	if err := f.fs.MkdirAll(TxJournalDir, 0700); err != nil {
+		return nil, err
+	}
+	owner := txOwner()
+	for {
+		name := owner + randSeq(12)
+		dir := path.Join(TxJournalDir, name)
+		liveTxs.Store(name, true)
+		err := f.fs.Mkdir(dir, 0700)
+		if os.IsExist(err) {
+			liveTxs.Delete(name)
+			continue
+		}
+		if os.IsNotExist(err) {
+			// NewFS removed the empty journal directory.
+			liveTxs.Delete(name)
+			if err := f.fs.MkdirAll(TxJournalDir, 0700); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			liveTxs.Delete(name)
+			return nil, err
+		}
+		if err := f.fs.Mkdir(path.Join(dir, "data"), 0700); err != nil {
+			f.fs.RemoveAll(dir)
+			liveTxs.Delete(name)
+			return nil, err
+		}
+		return &Tx{fs: f, dir: dir}, nil
+	}
+}
+
+// begin checks that an operation named op on name can be added to t.
+func (t *Tx) begin(op, name string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	p := path.Clean("/" + name)
+	if journal := "/" + TxJournalDir; p == journal || isWithin(journal, p) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// Create records the creation of filename, truncating it if it exists. The
+// contents written to the returned File are staged until Commit, which
+// closes the File if it is still open.
+func (t *Tx) Create(filename string) (billy.File, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.begin("open", filename); err != nil {
+		return nil, err
+	}
+	staged := path.Join(t.dir, "data", strconv.Itoa(len(t.ops)))
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	file, err := t.fs.fs.OpenFile(staged, flag, t.fs.mode(0666))
+	if err != nil {
+		return nil, err
+	}
+	// Writes to the staged file are not reported to Watchers nor cached.
+	// Its times are set as for other files and kept by the rename.
+	staging := &Filesystem{
+		fs:              t.fs.fs,
+		writeBufferSize: t.fs.writeBufferSize,
+		precision:       t.fs.precision,
+		epoch:           t.fs.epoch,
+	}
+	tf := &txFile{File: staging.newFile(file, staged, flag), name: filename}
+	t.files = append(t.files, tf)
+	t.ops = append(t.ops, txOp{Kind: txCreate, Name: filename, Staged: staged})
+	return tf, nil
+}
+
+// Rename records the rename of oldpath to newpath.
+func (t *Tx) Rename(oldpath, newpath string) error {
+	return t.record("rename", txOp{Kind: txRename, Name: oldpath, Target: newpath})
+}
+
+// Remove records the removal of the named file or empty directory.
+func (t *Tx) Remove(filename string) error {
+	return t.record("remove", txOp{Kind: txRemove, Name: filename})
+}
+
+// MkdirAll records the creation of a directory and its missing parents
+// with mode perm (before umask).
+func (t *Tx) MkdirAll(filename string, perm os.FileMode) error {
+	return t.record("mkdir", txOp{Kind: txMkdirAll, Name: filename, Perm: t.fs.mode(perm)})
+}
+
+// Symlink records the creation of link as a symbolic link to target.
+func (t *Tx) Symlink(target, link string) error {
+	return t.record("symlink", txOp{Kind: txSymlink, Name: link, Target: target})
+}
+
+func (t *Tx) record(op string, o txOp) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.begin(op, o.Name); err != nil {
+		return err
+	}
+	if o.Kind == txRename {
+		if err := t.begin(op, o.Target); err != nil {
+			return err
+		}
+	}
+	t.ops = append(t.ops, o)
+	return nil
+}
+
+// Commit applies the recorded operations in order. If one fails, the
+// operations already applied are reverted and its error is returned.
+func (t *Tx) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	defer liveTxs.Delete(path.Base(t.dir))
+
+	for _, tf := range t.files {
+		if err := tf.finish(); err != nil {
+			t.cleanup()
+			return err
+		}
+	}
+	j := &txJournal{fs: t.fs.fs, dir: t.dir, ops: t.ops}
+	if err := j.start(); err != nil {
+		t.cleanup()
+		return err
+	}
+	err := j.run()
+	j.log.Close()
+	t.invalidate()
+	if err == nil {
+		t.notify()
+	}
+	if _, ok := err.(*txUndoError); !ok {
+		// The journal of a transaction that could not be reverted is
+		// kept for recovery by the next NewFS.
+		t.cleanup()
+	}
+	return err
+}
+
+// cleanup removes the journal directory of t.
+func (t *Tx) cleanup() {
+	t.fs.fs.RemoveAll(t.dir)
+	t.fs.fs.Remove(TxJournalDir)
+}
+
+// Rollback discards the recorded operations and the staged data.
+func (t *Tx) Rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	defer liveTxs.Delete(path.Base(t.dir))
+	for _, tf := range t.files {
+		if !tf.closed {
+			tf.closed = true
+			tf.File.Close()
+		}
+	}
+	t.cleanup()
+	return nil
+}
+
+// invalidate drops cached data of the paths touched by t.
+func (t *Tx) invalidate() {
+	for _, op := range t.ops {
+		t.fs.invalidate(op.Name, true)
+		if op.Kind == txMkdirAll {
+			t.fs.invalidateAll(op.Name)
+		}
+		if op.Kind == txRename {
+			t.fs.invalidate(op.Target, true)
+		}
+	}
+}
+
+// notify reports the committed operations to the Watchers of the
+// Filesystem.
+func (t *Tx) notify() {
+	for _, op := range t.ops {
+		switch op.Kind {
+		case txCreate, txMkdirAll, txSymlink:
+			t.fs.notify(OpCreate, op.Name)
+		case txRemove:
+			t.fs.notify(OpRemove, op.Name)
+		case txRename:
+			t.fs.notifyRename(op.Name, op.Target)
+		}
+	}
+}
+
+// txFile is a File created in a transaction. Its contents are written to a
+// staged file in the journal directory.
+type txFile struct {
+	*File
+	name   string
+	closed bool
+}
+
+// Name returns the name the file will have once the transaction commits.
+func (f *txFile) Name() string {
+	return f.name
+}
+
+func (f *txFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return f.File.Close()
+}
+
+// finish makes the staged contents durable before Commit applies them.
+func (f *txFile) finish() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// txJournal applies and reverts the operations of a transaction using the
+// files in its journal directory: ops.json lists the operations, log
+// records progress and backup holds the replaced and removed paths.
+type txJournal struct {
+	fs      absfs.SymlinkFileSystem
+	dir     string
+	ops     []txOp
+	log     absfs.File
+	entries []txLogEntry
+}
+
+// start writes the list of operations and opens the log.
+func (j *txJournal) start() error {
+	data, err := json.Marshal(j.ops)
+	if err != nil {
+		return err
+	}
+	if err := j.writeFile("ops.json.tmp", data); err != nil {
+		return err
+	}
+	if err := j.fs.Rename(path.Join(j.dir, "ops.json.tmp"), path.Join(j.dir, "ops.json")); err != nil {
+		return err
+	}
+	if err := j.fs.Mkdir(path.Join(j.dir, "backup"), 0700); err != nil {
+		return err
+	}
+	j.log, err = j.fs.OpenFile(path.Join(j.dir, "log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	return err
+}
+
+func (j *txJournal) writeFile(name string, data []byte) error {
+	file, err := j.fs.Create(path.Join(j.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// run applies all operations and records the commit. If an operation
+// fails, the applied ones are reverted.
+func (j *txJournal) run() error {
+	err := j.commit()
+	if err == nil {
+		return nil
+	}
+	if uerr := j.undo(); uerr != nil {
+		return &txUndoError{err: err, undo: uerr}
+	}
+	return err
+}
+
+func (j *txJournal) commit() error {
+	for i := range j.ops {
+		if err := j.apply(i); err != nil {
+			return err
+		}
+	}
+	return j.write(txLogEntry{Kind: "commit"})
+}
+
+// txUndoError reports a failed Commit whose changes could not be reverted.
+type txUndoError struct {
+	err, undo error
+}
+
+func (e *txUndoError) Error() string {
+	return e.err.Error() + " (reverting: " + e.undo.Error() + ")"
+}
+
+func (e *txUndoError) Unwrap() error {
+	return e.err
+}
+
+// write appends e to the log and syncs it.
+func (j *txJournal) write(e txLogEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := j.log.Sync(); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+func (j *txJournal) backup(i int) string {
+	return path.Join(j.dir, "backup", strconv.Itoa(i))
+}
+
+func (j *txJournal) exists(name string) bool {
+	_, err := j.fs.Lstat(name)
+	return err == nil
+}
+
+// apply validates and applies operation i. Every change to the tree is
+// preceded by a log entry that allows undo to revert it.
+func (j *txJournal) apply(i int) error {
+	op := j.ops[i]
+	step := txLogEntry{Kind: "step", Step: i}
+	switch op.Kind {
+	case txCreate:
+		info, statErr := j.fs.Lstat(op.Name)
+		if statErr == nil && info.IsDir() {
+			return &fs.PathError{Op: "open", Path: op.Name, Err: errTxIsDir}
+		}
+		if err := j.write(step); err != nil {
+			return err
+		}
+		if statErr == nil {
+			if err := j.fs.Rename(op.Name, j.backup(i)); err != nil {
+				return err
+			}
+		}
+		return j.fs.Rename(op.Staged, op.Name)
+
+	case txRemove:
+		info, err := j.fs.Lstat(op.Name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			entries, err := j.fs.ReadDir(op.Name)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return &fs.PathError{Op: "remove", Path: op.Name, Err: errTxNotEmpty}
+			}
+		}
+		if err := j.write(step); err != nil {
+			return err
+		}
+		return j.fs.Rename(op.Name, j.backup(i))
+
+	case txRename:
+		if _, err := j.fs.Lstat(op.Name); err != nil {
+			return err
+		}
+		info, statErr := j.fs.Lstat(op.Target)
+		if statErr == nil && info.IsDir() {
+			return &fs.PathError{Op: "rename", Path: op.Target, Err: fs.ErrExist}
+		}
+		if err := j.write(step); err != nil {
+			return err
+		}
+		if statErr == nil {
+			if err := j.fs.Rename(op.Target, j.backup(i)); err != nil {
+				return err
+			}
+		}
+		return j.fs.Rename(op.Name, op.Target)
+
+	case txMkdirAll:
+		if err := j.write(step); err != nil {
+			return err
+		}
+		p := ""
+		for _, elem := range strings.Split(path.Clean("/"+op.Name), "/")[1:] {
+			p = path.Join(p, elem)
+			info, err := j.fs.Stat(p)
+			if err == nil {
+				if !info.IsDir() {
+					return &fs.PathError{Op: "mkdir", Path: p, Err: fs.ErrExist}
+				}
+				continue
+			}
+			if err := j.write(txLogEntry{Kind: "mkdir", Step: i, Dir: p}); err != nil {
+				return err
+			}
+			if err := j.fs.Mkdir(p, op.Perm); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case txSymlink:
+		if j.exists(op.Name) {
+			return &fs.PathError{Op: "symlink", Path: op.Name, Err: fs.ErrExist}
+		}
+		if err := j.write(step); err != nil {
+			return err
+		}
+		return j.fs.Symlink(op.Target, op.Name)
+	}
+	return ErrTxJournal
+}
+
+// undo reverts the operations recorded in the log, latest first. Every
+// step is checked against the tree, so undo can resume after a crash at
+// any point of apply or of an earlier undo.
+func (j *txJournal) undo() error {
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	for k := len(j.entries) - 1; k >= 0; k-- {
+		e := j.entries[k]
+		if e.Kind == "mkdir" {
+			if j.exists(e.Dir) {
+				keep(j.fs.Remove(e.Dir))
+			}
+			continue
+		}
+		if e.Kind != "step" || e.Step < 0 || e.Step >= len(j.ops) {
+			continue
+		}
+		op, backup := j.ops[e.Step], j.backup(e.Step)
+		switch op.Kind {
+		case txCreate:
+			switch {
+			case j.exists(backup):
+				keep(j.fs.Rename(backup, op.Name))
+			case !j.exists(op.Staged) && j.exists(op.Name):
+				keep(j.fs.Remove(op.Name))
+			}
+		case txRemove:
+			if j.exists(backup) {
+				keep(j.fs.Rename(backup, op.Name))
+			}
+		case txRename:
+			if !j.exists(op.Name) && j.exists(op.Target) {
+				keep(j.fs.Rename(op.Target, op.Name))
+			}
+			if j.exists(backup) {
+				keep(j.fs.Rename(backup, op.Target))
+			}
+		case txSymlink:
+			if info, err := j.fs.Lstat(op.Name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				keep(j.fs.Remove(op.Name))
+			}
+		}
+	}
+	return first
+}
+
+// recoverTransactions reverts the transactions interrupted in the journal
+// directory of f and removes the journals of transactions abandoned before
+// Commit, skipping the journals of transactions that may be in progress.
+// Damaged journals are left in place. Only errors reverting or removing a
+// journal are returned; a journal directory that cannot be read, as in a
+// tree the process may only read, holds nothing it could recover.
+func (f *Filesystem) recoverTransactions() error {
+	if info, err := f.fs.Lstat(TxJournalDir); err != nil || !info.IsDir() {
+		return nil
+	}
+	entries, err := f.fs.ReadDir(TxJournalDir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if txOwnerLive(entry.Name()) {
+			continue
+		}
+		dir := path.Join(TxJournalDir, entry.Name())
+		err := f.recoverTransaction(dir)
+		if err == ErrTxJournal {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := f.fs.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	// Fails unless all journals are gone.
+	f.fs.Remove(TxJournalDir)
+	return nil
+}
+
+// recoverTransaction reverts the transaction with the journal dir if its
+// Commit was interrupted.
+func (f *Filesystem) recoverTransaction(dir string) error {
+	logData, err := f.readFile(path.Join(dir, "log"))
+	if os.IsNotExist(err) {
+		// Commit did not start changing the tree.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	opsData, err := f.readFile(path.Join(dir, "ops.json"))
+	if os.IsNotExist(err) {
+		return ErrTxJournal
+	}
+	if err != nil {
+		return err
+	}
+	j := &txJournal{fs: f.fs, dir: dir}
+	if err := json.Unmarshal(opsData, &j.ops); err != nil {
+		return ErrTxJournal
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(logData))
+	for scanner.Scan() {
+		var e txLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A torn last line was never synced, so nothing it
+			// announced was applied.
+			break
+		}
+		if e.Kind == "commit" {
+			return nil
+		}
+		j.entries = append(j.entries, e)
+	}
+	return j.undo()
+}
+
+func (f *Filesystem) readFile(name string) ([]byte, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
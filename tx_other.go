@@ -0,0 +1,15 @@
+//go:build !unix
+
+package billyfs
+
+import "os"
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,368 @@
+package billyfs_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// snapshotTree describes the tree below dir as a map from paths to file
+// contents, "dir" or "-> target", ignoring the transaction journal
+func snapshotTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		switch {
+		case rel == ".":
+		case rel == billyfs.TxJournalDir:
+			return filepath.SkipDir
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + target
+		case info.IsDir():
+			tree[rel] = "dir"
+		default:
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// setupTxTree creates the tree the transaction tests start from
+func setupTxTree(t *testing.T, dir string) {
+	t.Helper()
+	for name, data := range map[string]string{"a": "old a", "b": "old b", "x": "old x"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var (
+	txOldTree = map[string]string{"a": "old a", "b": "old b", "x": "old x"}
+	txNewTree = map[string]string{
+		"a":    "new a",
+		"c":    "old b",
+		"n":    "dir",
+		"n/m":  "dir",
+		"n/f":  "new f",
+		"link": "-> a",
+	}
+)
+
+// runTx records the transaction of the transaction tests and commits it
+func runTx(bfs *billyfs.Filesystem) error {
+	tx, err := bfs.Begin()
+	if err != nil {
+		return err
+	}
+	f, err := tx.Create("a")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := f.Write([]byte("new a")); err != nil {
+		tx.Rollback()
+		return err
+	}
+	f.Close()
+	tx.Rename("b", "c")
+	tx.Remove("x")
+	tx.MkdirAll("n/m", 0755)
+	f, err = tx.Create("n/f")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := f.Write([]byte("new f")); err != nil {
+		tx.Rollback()
+		return err
+	}
+	tx.Symlink("a", "link")
+	return tx.Commit()
+}
+
+// TestTxCommit tests that committed operations are applied together
+func TestTxCommit(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	setupTxTree(t, tmpDir)
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	if err := runTx(bfs); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := snapshotTree(t, tmpDir); !reflect.DeepEqual(got, txNewTree) {
+		t.Errorf("unexpected tree after Commit: %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, billyfs.TxJournalDir)); !os.IsNotExist(err) {
+		t.Errorf("expected journal to be removed, got %v", err)
+	}
+
+	ev := <-w.Events()
+	if ev.Name != "a" || !ev.Op.Has(billyfs.OpCreate) {
+		t.Errorf("expected first event to be the creation of a, got %+v", ev)
+	}
+}
+
+// TestTxRollback tests that rolled back operations leave no trace
+func TestTxRollback(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	setupTxTree(t, tmpDir)
+
+	tx, err := bfs.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	f, err := tx.Create("a")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write([]byte("new a"))
+	tx.Remove("x")
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if got := snapshotTree(t, tmpDir); !reflect.DeepEqual(got, txOldTree) {
+		t.Errorf("unexpected tree after Rollback: %v", got)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 3 {
+		t.Errorf("expected journal to be removed, got %v", entries)
+	}
+	if err := tx.Commit(); !errors.Is(err, billyfs.ErrTxDone) {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+	if err := tx.Remove("a"); !errors.Is(err, billyfs.ErrTxDone) {
+		t.Errorf("expected ErrTxDone, got %v", err)
+	}
+}
+
+// TestTxFailure tests that a failing operation reverts the applied ones
+func TestTxFailure(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	setupTxTree(t, tmpDir)
+
+	tx, err := bfs.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	f, _ := tx.Create("a")
+	f.Write([]byte("new a"))
+	tx.Rename("b", "c")
+	tx.Remove("x")
+	tx.MkdirAll("n/m", 0755)
+	tx.Remove("missing")
+	if err := tx.Commit(); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+	if got := snapshotTree(t, tmpDir); !reflect.DeepEqual(got, txOldTree) {
+		t.Errorf("unexpected tree after failed Commit: %v", got)
+	}
+
+	if _, err := tx.Create(billyfs.TxJournalDir + "/evil"); err == nil {
+		t.Error("expected operations on the journal to be rejected")
+	}
+}
+
+// TestTxCrashRecovery simulates a crash after every backend operation of
+// a transaction and checks that NewFS recovers either the old or the new
+// tree
+func TestTxCrashRecovery(t *testing.T) {
+	for limit := 0; ; limit++ {
+		tmpDir := t.TempDir()
+		setupTxTree(t, tmpDir)
+		bfs, _ := newFaultTestFS(t, tmpDir, limit)
+		err := runTx(bfs)
+		if err != nil && !isCrash(err) {
+			t.Fatalf("limit %d: unexpected error %v", limit, err)
+		}
+
+		// Restart on the same directory.
+		fs, ferr := osfs.NewFS()
+		if ferr != nil {
+			t.Fatal(ferr)
+		}
+		if _, ferr := billyfs.NewFS(fs, tmpDir); ferr != nil {
+			t.Fatalf("limit %d: recovery failed: %v", limit, ferr)
+		}
+		got := snapshotTree(t, tmpDir)
+		switch {
+		case reflect.DeepEqual(got, txNewTree):
+		case reflect.DeepEqual(got, txOldTree):
+			if err == nil {
+				t.Errorf("limit %d: commit succeeded but tree is unchanged", limit)
+			}
+		default:
+			t.Errorf("limit %d: inconsistent tree %v", limit, got)
+		}
+		if _, serr := os.Stat(filepath.Join(tmpDir, billyfs.TxJournalDir)); !os.IsNotExist(serr) {
+			t.Errorf("limit %d: expected journal to be removed, got %v", limit, serr)
+		}
+		if err == nil {
+			if limit < 10 {
+				t.Errorf("expected more backend operations, got %d", limit)
+			}
+			return
+		}
+		if limit > 1000 {
+			t.Fatalf("no successful commit after %d operations", limit)
+		}
+	}
+}
+
+// TestTxJournalHidden tests that staged data does not show as changes
+func TestTxJournalHidden(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	tx, err := bfs.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer tx.Rollback()
+	f, _ := tx.Create("file.txt")
+	if !strings.HasSuffix(f.Name(), "file.txt") {
+		t.Errorf("expected destination name, got %q", f.Name())
+	}
+	if _, err := bfs.Stat("file.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected staged file to be invisible before Commit, got %v", err)
+	}
+}
+
+// TestTxConcurrentOpen tests that opening the directory of a transaction in
+// progress leaves its journal alone
+func TestTxConcurrentOpen(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	tx, err := bfs.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	f, err := tx.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write([]byte("staged"))
+	f.Close()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := billyfs.NewFS(fs, tmpDir); err != nil {
+		t.Fatalf("NewFS failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, "file.txt"))
+	if err != nil || string(data) != "staged" {
+		t.Errorf("expected committed file, got %q, %v", data, err)
+	}
+}
+
+// TestTxDamagedJournal tests that a damaged journal does not prevent
+// opening the directory
+func TestTxDamagedJournal(t *testing.T) {
+	tmpDir := t.TempDir()
+	journal := filepath.Join(tmpDir, billyfs.TxJournalDir, "damaged")
+	if err := os.MkdirAll(journal, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(journal, "log"), []byte("commit\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(journal, "ops.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := billyfs.NewFS(fs, tmpDir); err != nil {
+		t.Fatalf("NewFS failed: %v", err)
+	}
+	if _, err := os.Stat(journal); err != nil {
+		t.Errorf("expected damaged journal to be kept, got %v", err)
+	}
+}
+
+// TestTxJournalUnlisted tests that the journal of a transaction in
+// progress is not listed
+func TestTxJournalUnlisted(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	setupTxTree(t, tmpDir)
+	tx, err := bfs.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := os.Stat(filepath.Join(tmpDir, billyfs.TxJournalDir)); err != nil {
+		t.Fatalf("expected journal directory, got %v", err)
+	}
+
+	infos, err := bfs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, info := range infos {
+		if info.Name() == billyfs.TxJournalDir {
+			t.Error("ReadDir listed the journal directory")
+		}
+	}
+	err = bfs.Walk("/", func(p string, info os.FileInfo, err error) error {
+		if strings.Contains(p, billyfs.TxJournalDir) {
+			t.Errorf("Walk visited %s", p)
+		}
+		return err
+	}, billyfs.WalkOptions{})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	matches, err := bfs.Glob("*")
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	if want := []string{"a", "b", "x"}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("expected Glob matches %v, got %v", want, matches)
+	}
+}
+
+// TestTxJournalNotDir tests that a file in place of the journal directory
+// does not prevent opening the directory
+func TestTxJournalNotDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, billyfs.TxJournalDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := billyfs.NewFS(fs, tmpDir); err != nil {
+		t.Fatalf("NewFS failed: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package billyfs
+
+import "syscall"
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
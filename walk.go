@@ -0,0 +1,284 @@
+package billyfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// WalkOptions configures WalkDir and Walk.
+type WalkOptions struct {
+	// FollowSymlinks descends into symbolic links to directories. A link
+	// leading to a directory being walked, which would make the walk loop,
+	// is reported but not descended into.
+	FollowSymlinks bool
+
+	// Workers, if greater than one, reads up to Workers directories ahead
+	// of the walk concurrently, among the subdirectories of the
+	// directories walked. The walk function is still called from a
+	// single goroutine, in the same order as without workers.
+	Workers int
+
+	// Ignore, if not nil, skips the files it ignores. Ignored directories
+	// are not read.
+	Ignore *IgnoreMatcher
+}
+
+// WalkDir walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root, with the semantics of
+// fs.WalkDir: files are walked in lexical order, fn may return
+// fs.SkipDir to skip a directory or the rest of the directory holding a
+// file, and fs.SkipAll to stop the walk. Directory entries carry the type
+// bits reported by the backend, so no file is stat'ed unless fn calls
+// Info or FollowSymlinks requires it.
+func (f *Filesystem) WalkDir(root string, fn fs.WalkDirFunc, opts WalkOptions) error {
+	w := &walker{fs: f, fn: fn, opts: opts}
+	if opts.Workers > 1 {
+		w.start(opts.Workers)
+		defer w.stop()
+	}
+
+	info, err := f.Lstat(root)
+	if err == nil && opts.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		info, err = f.Stat(root)
+	}
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = w.walk(root, f.absPath(root), fs.FileInfoToDirEntry(info), info)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// Walk walks the file tree rooted at root like WalkDir, calling fn with
+// the FileInfo of each file or directory.
+func (f *Filesystem) Walk(root string, fn filepath.WalkFunc, opts WalkOptions) error {
+	return f.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		var info os.FileInfo
+		if d != nil {
+			var ierr error
+			if info, ierr = d.Info(); err == nil {
+				err = ierr
+			}
+		}
+		return fn(name, info, err)
+	}, opts)
+}
+
+// walker holds the state of a WalkDir call.
+type walker struct {
+	fs   *Filesystem
+	fn   fs.WalkDirFunc
+	opts WalkOptions
+
+	// ancestors are the directories on the path being walked, used to
+	// detect symlink loops: their FileInfo and absolute path.
+	ancestors []walkAncestor
+
+	// jobs queues directories to read ahead; pending maps their names to
+	// the channel receiving the result. Both are nil without workers.
+	jobs    chan walkJob
+	pending map[string]chan walkResult
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type walkAncestor struct {
+	info os.FileInfo
+	abs  string
+}
+
+type walkJob struct {
+	name   string
+	result chan walkResult
+}
+
+type walkResult struct {
+	entries []fs.DirEntry
+	err     error
+}
+
+// start starts the workers reading directories ahead of the walk.
+func (w *walker) start(workers int) {
+	w.jobs = make(chan walkJob, 4*workers)
+	w.pending = make(map[string]chan walkResult)
+	w.done = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				select {
+				case <-w.done:
+				default:
+					entries, err := w.fs.readDirEntries(job.name)
+					job.result <- walkResult{entries, err}
+				}
+			}
+		}()
+	}
+}
+
+// stop discards the directories read ahead and waits for the workers.
+func (w *walker) stop() {
+	close(w.done)
+	close(w.jobs)
+	w.wg.Wait()
+}
+
+// walk visits name, described by d, and its descendants. abs is the
+// absolute path name resolves to and info its FileInfo, if known.
+func (w *walker) walk(name, abs string, d fs.DirEntry, info os.FileInfo) error {
+	if err := w.fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			w.discard(name)
+			err = nil
+		}
+		return err
+	}
+	if w.opts.FollowSymlinks {
+		if info == nil {
+			info, _ = d.Info()
+		}
+		w.ancestors = append(w.ancestors, walkAncestor{info, abs})
+		defer func() { w.ancestors = w.ancestors[:len(w.ancestors)-1] }()
+	}
+
+	entries, err := w.readDir(name)
+	if err != nil {
+		if err = w.fn(name, d, err); err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+	if m := w.opts.Ignore; m != nil {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !m.skip(path.Join(name, entry.Name()), entry.IsDir()) {
+				kept = append(kept, entry)
+			}
+		}
+		entries = kept
+	}
+	w.readAhead(name, entries)
+
+	for i, entry := range entries {
+		child := path.Join(name, entry.Name())
+		childAbs := path.Join(abs, entry.Name())
+		var childInfo os.FileInfo
+		if w.opts.FollowSymlinks && entry.Type()&fs.ModeSymlink != 0 {
+			entry, childAbs, childInfo = w.follow(child, childAbs, entry)
+		}
+		if err := w.walk(child, childAbs, entry, childInfo); err != nil {
+			if err == fs.SkipDir {
+				for _, rest := range entries[i+1:] {
+					w.discard(path.Join(name, rest.Name()))
+				}
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// follow returns the entry, absolute path and FileInfo of the target of
+// the symbolic link name, at abs. The link itself is returned if it is
+// broken or leads to a directory being walked.
+func (w *walker) follow(name, abs string, entry fs.DirEntry) (fs.DirEntry, string, os.FileInfo) {
+	info, err := w.fs.Stat(name)
+	if err != nil {
+		return entry, abs, nil
+	}
+	target, err := w.fs.fs.Readlink(name)
+	if err != nil {
+		return entry, abs, nil
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(abs), target)
+	}
+	if info.IsDir() {
+		for _, a := range w.ancestors {
+			if os.SameFile(a.info, info) || a.abs == target {
+				return entry, abs, nil
+			}
+		}
+	}
+	return fs.FileInfoToDirEntry(info), target, info
+}
+
+// readDir returns the entries of the directory name, read ahead if it was
+// queued.
+func (w *walker) readDir(name string) ([]fs.DirEntry, error) {
+	if result, ok := w.pending[name]; ok {
+		delete(w.pending, name)
+		r := <-result
+		return r.entries, r.err
+	}
+	return w.fs.readDirEntries(name)
+}
+
+// discard drops the directory name read ahead, which the walk skips. The
+// result channel is buffered, so the worker reading it does not block.
+func (w *walker) discard(name string) {
+	delete(w.pending, name)
+}
+
+// readAhead queues the subdirectories of dir for the workers, as long as
+// fewer than Workers directories are read ahead.
+func (w *walker) readAhead(dir string, entries []fs.DirEntry) {
+	if w.jobs == nil {
+		return
+	}
+	for _, entry := range entries {
+		if len(w.pending) >= w.opts.Workers {
+			return
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		name := path.Join(dir, entry.Name())
+		result := make(chan walkResult, 1)
+		w.pending[name] = result
+		w.jobs <- walkJob{name, result}
+	}
+}
+
+// readDirEntries returns the entries of the directory name from the
+// underlying absfs, sorted by name and without transaction journals.
+func (f *Filesystem) readDirEntries(name string) ([]fs.DirEntry, error) {
+	entries, err := f.fs.ReadDir(name)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !isTxJournal(entry) {
+			kept = append(kept, &statDirEntry{DirEntry: entry, f: f, name: path.Join(name, entry.Name())})
+		}
+	}
+	return kept, err
+}
+
+// statDirEntry reports from Info the FileInfo Lstat would.
+type statDirEntry struct {
+	fs.DirEntry
+	f    *Filesystem
+	name string
+}
+
+func (e *statDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return e.f.statInfo(e.f.sparseInfo(e.name, info)), nil
+}
@@ -0,0 +1,260 @@
+package billyfs_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// statCountingFS wraps an absfs filesystem and counts Stat and Lstat calls
+type statCountingFS struct {
+	absfs.SymlinkFileSystem
+	stats atomic.Int64
+}
+
+func (c *statCountingFS) Stat(name string) (os.FileInfo, error) {
+	c.stats.Add(1)
+	return c.SymlinkFileSystem.Stat(name)
+}
+
+func (c *statCountingFS) Lstat(name string) (os.FileInfo, error) {
+	c.stats.Add(1)
+	return c.SymlinkFileSystem.Lstat(name)
+}
+
+// setupWalkTree creates a small repository-like tree
+func setupWalkTree(t *testing.T) (*billyfs.Filesystem, *statCountingFS) {
+	t.Helper()
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &statCountingFS{SymlinkFileSystem: fs}
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"a/b", "a/c", "d", "e/f/g"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a/b/1", "a/b/2", "a/c/3", "a/4", "d/5", "e/f/g/6", "z"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bfs, err := billyfs.NewFS(counting, tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	counting.stats.Store(0)
+	return bfs, counting
+}
+
+// walkPaths walks root and returns the visited paths
+func walkPaths(t *testing.T, bfs *billyfs.Filesystem, root string, opts billyfs.WalkOptions, skip map[string]error) []string {
+	t.Helper()
+	var paths []string
+	err := bfs.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			t.Errorf("unexpected error at %s: %v", name, err)
+			return err
+		}
+		paths = append(paths, name)
+		return skip[name]
+	}, opts)
+	if err != nil {
+		t.Fatalf("WalkDir failed: %v", err)
+	}
+	return paths
+}
+
+// TestWalkDir tests the order of the walk, skipping and that no file is
+// stat'ed, with and without workers
+func TestWalkDir(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		bfs, counting := setupWalkTree(t)
+		opts := billyfs.WalkOptions{Workers: workers}
+
+		got := walkPaths(t, bfs, "/", opts, nil)
+		want := []string{"/", "/a", "/a/4", "/a/b", "/a/b/1", "/a/b/2", "/a/c", "/a/c/3",
+			"/d", "/d/5", "/e", "/e/f", "/e/f/g", "/e/f/g/6", "/z"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: unexpected walk %v", workers, got)
+		}
+		if n := counting.stats.Load(); n != 1 {
+			t.Errorf("workers %d: expected only the root to be stat'ed, got %d", workers, n)
+		}
+
+		got = walkPaths(t, bfs, "/", opts, map[string]error{
+			"/a/b":   fs.SkipDir,
+			"/a/c/3": fs.SkipDir,
+			"/e/f":   fs.SkipAll,
+		})
+		want = []string{"/", "/a", "/a/4", "/a/b", "/a/c", "/a/c/3", "/d", "/d/5", "/e", "/e/f"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: unexpected walk with skips %v", workers, got)
+		}
+
+		got = walkPaths(t, bfs, "a/c", opts, nil)
+		if want := []string{"a/c", "a/c/3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: unexpected walk of a subtree %v", workers, got)
+		}
+	}
+}
+
+// TestWalkDirSymlinks tests following symbolic links with loop detection
+func TestWalkDirSymlinks(t *testing.T) {
+	bfs, _ := setupWalkTree(t)
+	if err := bfs.Symlink("../d", "a/link"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := bfs.Symlink("..", "a/c/loop"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	got := walkPaths(t, bfs, "a", billyfs.WalkOptions{}, nil)
+	want := []string{"a", "a/4", "a/b", "a/b/1", "a/b/2", "a/c", "a/c/3", "a/c/loop", "a/link"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected walk without following %v", got)
+	}
+
+	var loopType fs.FileMode
+	err := bfs.WalkDir("a", func(name string, d fs.DirEntry, err error) error {
+		if name == "a/c/loop" {
+			loopType = d.Type()
+		}
+		return err
+	}, billyfs.WalkOptions{FollowSymlinks: true})
+	if err != nil {
+		t.Fatalf("WalkDir failed: %v", err)
+	}
+	if loopType&fs.ModeSymlink == 0 {
+		t.Errorf("expected the loop to be reported as a link, got %v", loopType)
+	}
+	got = walkPaths(t, bfs, "a", billyfs.WalkOptions{FollowSymlinks: true, Workers: 2}, nil)
+	want = []string{"a", "a/4", "a/b", "a/b/1", "a/b/2", "a/c", "a/c/3", "a/c/loop", "a/link", "a/link/5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected walk following links %v", got)
+	}
+}
+
+// TestWalk tests Walk and its FileInfo
+func TestWalk(t *testing.T) {
+	bfs, _ := setupWalkTree(t)
+	sizes := map[string]bool{}
+	err := bfs.Walk("d", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		sizes[name] = info.IsDir()
+		return nil
+	}, billyfs.WalkOptions{})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if want := map[string]bool{"d": true, "d/5": false}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("unexpected walk %v", sizes)
+	}
+
+	var errs int
+	bfs.Walk("missing", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs++
+		}
+		return nil
+	}, billyfs.WalkOptions{})
+	if errs != 1 {
+		t.Errorf("expected the missing root to be reported, got %d errors", errs)
+	}
+}
+
+// TestWalkInfo tests that the FileInfo of walked entries is the one Lstat
+// reports
+func TestWalkInfo(t *testing.T) {
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	ranges := []billyfs.IDRange{{ContainerID: 1000, HostID: os.Getuid(), Count: 1}}
+	bfs, err := billyfs.NewFSWithOptions(backend, t.TempDir(), billyfs.Options{
+		IDMap:         &billyfs.IDMap{UIDs: ranges},
+		TimePrecision: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	setupGlobTree(t, bfs, "a/b", "c")
+
+	var walked int
+	err = bfs.Walk("/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked++
+		want, err := bfs.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Equal(want.ModTime()) || info.ModTime().Minute() != 0 {
+			t.Errorf("%s: expected time %v, got %v", name, want.ModTime(), info.ModTime())
+		}
+		uid, _, ok := billyfs.Owner(info)
+		if wantUID, _, _ := billyfs.Owner(want); ok && uid != wantUID {
+			t.Errorf("%s: expected owner %d, got %d", name, wantUID, uid)
+		}
+		return nil
+	}, billyfs.WalkOptions{})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if walked != 4 {
+		t.Errorf("expected 4 entries, got %d", walked)
+	}
+}
+
+// readDirCountingFS wraps an absfs filesystem and counts ReadDir calls
+type readDirCountingFS struct {
+	absfs.SymlinkFileSystem
+	reads atomic.Int64
+}
+
+func (c *readDirCountingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.reads.Add(1)
+	return c.SymlinkFileSystem.ReadDir(name)
+}
+
+// TestWalkDirReadAhead tests that workers read at most Workers
+// directories ahead of the walk
+func TestWalkDirReadAhead(t *testing.T) {
+	backend, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &readDirCountingFS{SymlinkFileSystem: backend}
+	tmpDir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		if err := os.MkdirAll(filepath.Join(tmpDir, string(rune('a'+i)), "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bfs, err := billyfs.NewFS(counting, tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	counting.reads.Store(0)
+
+	got := walkPaths(t, bfs, "/", billyfs.WalkOptions{Workers: 2}, map[string]error{"/a": fs.SkipAll})
+	if want := []string{"/", "/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected walk %v", got)
+	}
+	if n := counting.reads.Load(); n > 3 {
+		t.Errorf("expected the root and at most 2 directories to be read, got %d", n)
+	}
+}
@@ -0,0 +1,493 @@
+package billyfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op describes a set of file operations reported by a Watcher.
+type Op uint32
+
+// Operations reported in Event.Op. Several operations may be combined when
+// a Watcher debounces events for the same path.
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{OpCreate, "CREATE"},
+	{OpWrite, "WRITE"},
+	{OpRemove, "REMOVE"},
+	{OpRename, "RENAME"},
+	{OpChmod, "CHMOD"},
+}
+
+// String returns the names of the operations in op separated by "|".
+func (op Op) String() string {
+	var names []string
+	for _, n := range opNames {
+		if op&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, "|")
+}
+
+// Has reports whether op includes all operations in other.
+func (op Op) Has(other Op) bool {
+	return op&other == other
+}
+
+// Event describes a change to a path under a watched directory.
+type Event struct {
+	// Name is the path of the changed file, relative to the root of the
+	// Filesystem the watch was registered on.
+	Name string
+
+	// OldName is the previous path of a renamed file. It is only set when Op
+	// includes OpRename.
+	OldName string
+
+	// Op is the set of operations observed on Name.
+	Op Op
+}
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	// Recursive reports changes anywhere below the watched directory
+	// instead of only its direct children.
+	Recursive bool
+
+	// Debounce coalesces events for the same path that arrive within the
+	// given window into a single event whose Op is the union of the
+	// observed operations. Zero delivers every event as it happens.
+	Debounce time.Duration
+
+	// PollInterval enables a scanner that compares the size, modification
+	// time and mode of every watched path at the given interval. It detects
+	// changes made without going through billyfs, such as other processes
+	// writing to an OS backed filesystem. Zero disables polling.
+	PollInterval time.Duration
+}
+
+// ErrWatcherClosed is returned when a closed Watcher is closed again.
+var ErrWatcherClosed = errors.New("billyfs: watcher closed")
+
+// Watcher delivers change notifications for a path on a Filesystem. Events
+// caused by mutating methods of the Filesystem, of filesystems obtained from
+// it with Chroot, and of the Files they open are delivered immediately;
+// other changes are only seen when polling is enabled.
+type Watcher struct {
+	fs   *Filesystem
+	root string
+	opts WatchOptions
+
+	mu    sync.Mutex
+	queue []rawEvent
+	wake  chan struct{}
+
+	events chan Event
+	errors chan error
+	done   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+
+	snapshot map[string]pollState
+}
+
+// Watch starts watching name, which may be a directory or a single file,
+// and returns a Watcher that reports changes to it. The caller must Close
+// the Watcher when it is no longer needed.
+func (f *Filesystem) Watch(name string, opts WatchOptions) (*Watcher, error) {
+	if _, err := f.fs.Lstat(name); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		fs:     f,
+		root:   f.absPath(name),
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		events: make(chan Event),
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	if opts.PollInterval > 0 {
+		snap, err := w.scan()
+		if err != nil {
+			return nil, err
+		}
+		w.snapshot = snap
+	}
+	if f.hub != nil {
+		f.hub.add(w)
+	}
+	go w.run()
+	return w, nil
+}
+
+// Events returns the channel on which change events are delivered. The
+// channel is closed when the Watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Errors returns the channel on which polling errors are delivered. Errors
+// are dropped when the previous error has not been received yet.
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stops the Watcher and closes its Events channel.
+func (w *Watcher) Close() error {
+	err := ErrWatcherClosed
+	w.once.Do(func() {
+		if w.fs.hub != nil {
+			w.fs.hub.remove(w)
+		}
+		close(w.done)
+		<-w.exited
+		err = nil
+	})
+	return err
+}
+
+// rawEvent is an event as published by a Filesystem, with paths expressed
+// in the namespace of the underlying absfs filesystem.
+type rawEvent struct {
+	path    string
+	oldPath string
+	op      Op
+}
+
+func (w *Watcher) enqueue(ev rawEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) run() {
+	defer close(w.exited)
+	defer close(w.events)
+
+	var pollC <-chan time.Time
+	if w.opts.PollInterval > 0 {
+		ticker := time.NewTicker(w.opts.PollInterval)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
+
+	var (
+		pending map[string]*Event
+		order   []string
+		timer   *time.Timer
+		timerC  <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	handle := func(ev Event) bool {
+		if w.opts.Debounce <= 0 {
+			return w.send(ev)
+		}
+		if pending == nil {
+			pending = make(map[string]*Event)
+		}
+		if p, ok := pending[ev.Name]; ok {
+			p.Op |= ev.Op
+			if ev.OldName != "" {
+				p.OldName = ev.OldName
+			}
+		} else {
+			e := ev
+			pending[ev.Name] = &e
+			order = append(order, ev.Name)
+		}
+		if timerC == nil {
+			timer = time.NewTimer(w.opts.Debounce)
+			timerC = timer.C
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case <-w.wake:
+			w.mu.Lock()
+			queue := w.queue
+			w.queue = nil
+			w.mu.Unlock()
+			for _, raw := range queue {
+				ev, ok := w.translate(raw)
+				if ok && !handle(ev) {
+					return
+				}
+			}
+
+		case <-timerC:
+			timerC = nil
+			for _, name := range order {
+				if !w.send(*pending[name]) {
+					return
+				}
+			}
+			pending, order = nil, nil
+
+		case <-pollC:
+			evs, err := w.poll()
+			if err != nil {
+				select {
+				case w.errors <- err:
+				default:
+				}
+			}
+			for _, ev := range evs {
+				if !handle(ev) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// send delivers ev and reports false if the Watcher was closed meanwhile.
+func (w *Watcher) send(ev Event) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// translate converts a published event into an Event for this Watcher and
+// reports whether it concerns a watched path. A rename across the boundary
+// of the watched tree is reported as a create or remove.
+func (w *Watcher) translate(raw rawEvent) (Event, bool) {
+	in := w.watches(raw.path)
+	if raw.op != OpRename {
+		return Event{Name: w.fs.relPath(raw.path), Op: raw.op}, in
+	}
+
+	oldIn := w.watches(raw.oldPath)
+	switch {
+	case in && oldIn:
+		return Event{
+			Name:    w.fs.relPath(raw.path),
+			OldName: w.fs.relPath(raw.oldPath),
+			Op:      OpRename,
+		}, true
+	case in:
+		return Event{Name: w.fs.relPath(raw.path), Op: OpCreate}, true
+	case oldIn:
+		return Event{Name: w.fs.relPath(raw.oldPath), Op: OpRemove}, true
+	}
+	return Event{}, false
+}
+
+// watches reports whether p lies within the watched tree.
+func (w *Watcher) watches(p string) bool {
+	if p == w.root {
+		return true
+	}
+	if w.opts.Recursive {
+		return isWithin(w.root, p)
+	}
+	return path.Dir(p) == w.root
+}
+
+// pollState is the state of a path recorded by the polling scanner.
+type pollState struct {
+	size  int64
+	mtime time.Time
+	mode  os.FileMode
+}
+
+// poll scans the watched tree and returns the differences to the previous
+// scan. Size and time changes of directories are not reported since the
+// changes to their entries are.
+func (w *Watcher) poll() ([]Event, error) {
+	snap, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	var evs []Event
+	for name, cur := range snap {
+		prev, ok := w.snapshot[name]
+		switch {
+		case !ok:
+			evs = append(evs, Event{Name: name, Op: OpCreate})
+		case cur.mode.Type() != prev.mode.Type():
+			evs = append(evs, Event{Name: name, Op: OpRemove | OpCreate})
+		case !cur.mode.IsDir() && (cur.size != prev.size || !cur.mtime.Equal(prev.mtime)):
+			op := OpWrite
+			if cur.mode != prev.mode {
+				op |= OpChmod
+			}
+			evs = append(evs, Event{Name: name, Op: op})
+		case cur.mode != prev.mode:
+			evs = append(evs, Event{Name: name, Op: OpChmod})
+		}
+	}
+	for name := range w.snapshot {
+		if _, ok := snap[name]; !ok {
+			evs = append(evs, Event{Name: name, Op: OpRemove})
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Name < evs[j].Name })
+	w.snapshot = snap
+	return evs, nil
+}
+
+// scan records the state of every watched path. A missing root yields an
+// empty snapshot so that its disappearance is reported as removals.
+func (w *Watcher) scan() (map[string]pollState, error) {
+	snap := make(map[string]pollState)
+	root := w.fs.relPath(w.root)
+	info, err := w.fs.fs.Lstat(root)
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap[root] = newPollState(info)
+	if !info.IsDir() {
+		return snap, nil
+	}
+
+	dirs := []string{root}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		entries, err := w.fs.fs.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			name := path.Join(dir, entry.Name())
+			snap[name] = newPollState(info)
+			if w.opts.Recursive && info.IsDir() {
+				dirs = append(dirs, name)
+			}
+		}
+	}
+	return snap, nil
+}
+
+func newPollState(info os.FileInfo) pollState {
+	return pollState{size: info.Size(), mtime: info.ModTime(), mode: info.Mode()}
+}
+
+// watchHub fans events published by a Filesystem, and the filesystems
+// derived from it with Chroot, out to the registered Watchers.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]struct{})}
+}
+
+func (h *watchHub) add(w *Watcher) {
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *watchHub) remove(w *Watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+}
+
+func (h *watchHub) publish(ev rawEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.enqueue(ev)
+	}
+}
+
+// notify publishes op on name to the Watchers of f.
+func (f *Filesystem) notify(op Op, name string) {
+	if f == nil || f.hub == nil {
+		return
+	}
+	f.hub.publish(rawEvent{path: f.absPath(name), op: op})
+}
+
+// notifyRename publishes the rename of oldpath to newpath to the Watchers
+// of f.
+func (f *Filesystem) notifyRename(oldpath, newpath string) {
+	if f == nil || f.hub == nil {
+		return
+	}
+	f.hub.publish(rawEvent{
+		path:    f.absPath(newpath),
+		oldPath: f.absPath(oldpath),
+		op:      OpRename,
+	})
+}
+
+// absPath returns name as a cleaned path in the namespace of the underlying
+// absfs filesystem.
+func (f *Filesystem) absPath(name string) string {
+	return path.Join(f.Root(), path.Clean("/"+name))
+}
+
+// relPath converts a path produced by absPath back into a path relative to
+// the root of f.
+func (f *Filesystem) relPath(p string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, f.Root()), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// isWithin reports whether p is a descendant of dir.
+func isWithin(dir, p string) bool {
+	if dir == "/" {
+		return p != "/" && strings.HasPrefix(p, "/")
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
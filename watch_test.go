@@ -0,0 +1,231 @@
+package billyfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/absfs/billyfs"
+)
+
+// nextEvent waits for the next event from w or fails the test
+func nextEvent(t *testing.T, w *billyfs.Watcher) billyfs.Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			t.Fatal("events channel closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return billyfs.Event{}
+}
+
+// TestWatchInProcess tests events generated by adapter methods
+func TestWatchInProcess(t *testing.T) {
+	bfs, _ := newTestFS(t)
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	f, err := bfs.Create("a.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "a.txt" || ev.Op != billyfs.OpCreate {
+		t.Errorf("expected CREATE a.txt, got %v %s", ev.Op, ev.Name)
+	}
+
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	f.Close()
+	if ev := nextEvent(t, w); ev.Name != "a.txt" || ev.Op != billyfs.OpWrite {
+		t.Errorf("expected WRITE a.txt, got %v %s", ev.Op, ev.Name)
+	}
+
+	if err := bfs.Chmod("a.txt", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if ev := nextEvent(t, w); ev.Op != billyfs.OpChmod {
+		t.Errorf("expected CHMOD, got %v", ev.Op)
+	}
+
+	if err := bfs.Rename("a.txt", "b.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	ev := nextEvent(t, w)
+	if ev.Op != billyfs.OpRename || ev.Name != "b.txt" || ev.OldName != "a.txt" {
+		t.Errorf("expected RENAME a.txt -> b.txt, got %v %s -> %s", ev.Op, ev.OldName, ev.Name)
+	}
+
+	if err := bfs.MkdirAll("dir/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "dir/sub" || ev.Op != billyfs.OpCreate {
+		t.Errorf("expected CREATE dir/sub, got %v %s", ev.Op, ev.Name)
+	}
+
+	if err := bfs.Remove("b.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "b.txt" || ev.Op != billyfs.OpRemove {
+		t.Errorf("expected REMOVE b.txt, got %v %s", ev.Op, ev.Name)
+	}
+}
+
+// TestWatchNonRecursive tests that only direct children are reported
+func TestWatchNonRecursive(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	if err := bfs.MkdirAll("dir/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	w, err := bfs.Watch("dir", billyfs.WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	for _, name := range []string{"dir/sub/deep.txt", "other.txt", "dir/top.txt"} {
+		f, err := bfs.Create(name)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		f.Close()
+	}
+
+	if ev := nextEvent(t, w); ev.Name != "dir/top.txt" {
+		t.Errorf("expected event for dir/top.txt, got %s", ev.Name)
+	}
+}
+
+// TestWatchChroot tests that events from chrooted filesystems are delivered
+func TestWatchChroot(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	if err := bfs.MkdirAll("sub", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	sub, err := bfs.Chroot("sub")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	f, err := sub.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+
+	if ev := nextEvent(t, w); ev.Name != "sub/file.txt" || ev.Op != billyfs.OpCreate {
+		t.Errorf("expected CREATE sub/file.txt, got %v %s", ev.Op, ev.Name)
+	}
+}
+
+// TestWatchDebounce tests that events for the same path are coalesced
+func TestWatchDebounce(t *testing.T) {
+	bfs, _ := newTestFS(t)
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{Debounce: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	f, err := bfs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write([]byte("x")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	f.Close()
+
+	ev := nextEvent(t, w)
+	if ev.Name != "file.txt" || ev.Op != billyfs.OpCreate|billyfs.OpWrite {
+		t.Errorf("expected CREATE|WRITE file.txt, got %v %s", ev.Op, ev.Name)
+	}
+	select {
+	case ev := <-w.Events():
+		t.Errorf("unexpected extra event %v %s", ev.Op, ev.Name)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+// TestWatchPolling tests detection of changes made outside billyfs
+func TestWatchPolling(t *testing.T) {
+	bfs, tmpDir := newTestFS(t)
+	if err := os.WriteFile(filepath.Join(tmpDir, "existing.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{
+		Recursive:    true,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Close()
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "external.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "external.txt" || ev.Op != billyfs.OpCreate {
+		t.Errorf("expected CREATE external.txt, got %v %s", ev.Op, ev.Name)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "existing.txt"), []byte("longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "existing.txt" || !ev.Op.Has(billyfs.OpWrite) {
+		t.Errorf("expected WRITE existing.txt, got %v %s", ev.Op, ev.Name)
+	}
+
+	if err := os.Remove(filepath.Join(tmpDir, "external.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w); ev.Name != "external.txt" || ev.Op != billyfs.OpRemove {
+		t.Errorf("expected REMOVE external.txt, got %v %s", ev.Op, ev.Name)
+	}
+}
+
+// TestWatcherClose tests closing a watcher
+func TestWatcherClose(t *testing.T) {
+	bfs, _ := newTestFS(t)
+
+	w, err := bfs.Watch("/", billyfs.WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("expected events channel to be closed")
+	}
+	if err := w.Close(); err != billyfs.ErrWatcherClosed {
+		t.Errorf("expected ErrWatcherClosed, got %v", err)
+	}
+
+	// Mutations after close must not block.
+	f, err := bfs.Create("after.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,171 @@
+package billyfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// writeBuffer holds the unflushed writes of a File opened with
+// Options.WriteBufferSize set. The buffered bytes form a single contiguous
+// range starting at off. While the buffer is not empty the offset of the
+// underlying file lags behind and pos is the offset of the handle.
+type writeBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+	off  int64
+	pos  int64
+
+	// err is the first error of a flush. It is returned by all later
+	// writes and by Close.
+	err error
+}
+
+// bufferable reports whether files opened with flag can use a write buffer.
+// Append-only handles write at an offset only known to the backend and are
+// not buffered.
+func bufferable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_APPEND == 0
+}
+
+// bufferedWrite writes p at off, or at the offset of the handle if off is
+// negative, through the write buffer.
+func (f *File) bufferedWrite(p []byte, off int64) (int, error) {
+	wb := f.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.err != nil {
+		return 0, wb.err
+	}
+	if len(wb.buf) == 0 {
+		pos, err := f.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		wb.pos = pos
+	}
+	at := off
+	if at < 0 {
+		at = wb.pos
+	}
+	end := wb.off + int64(len(wb.buf))
+	if len(wb.buf) > 0 && (at < wb.off || at > end) {
+		if err := f.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(wb.buf) == 0 {
+		if len(p) >= wb.size {
+			n, err := f.f.WriteAt(p, at)
+			if n > 0 {
+				f.wroteAt(at, n)
+			}
+			if off < 0 {
+				wb.pos = at + int64(n)
+				if _, serr := f.f.Seek(wb.pos, io.SeekStart); err == nil {
+					err = serr
+				}
+			}
+			return n, err
+		}
+		wb.off = at
+	}
+	start := int(at - wb.off)
+	if grow := start + len(p) - len(wb.buf); grow > 0 {
+		wb.buf = append(wb.buf, make([]byte, grow)...)
+	}
+	copy(wb.buf[start:], p)
+	if off < 0 {
+		wb.pos = at + int64(len(p))
+	}
+	if len(wb.buf) >= wb.size {
+		if err := f.flushLocked(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the buffered bytes to the underlying file.
+func (f *File) flush() error {
+	if f.wb == nil {
+		return nil
+	}
+	f.wb.mu.Lock()
+	defer f.wb.mu.Unlock()
+	return f.flushLocked()
+}
+
+func (f *File) flushLocked() error {
+	wb := f.wb
+	if wb.err != nil || len(wb.buf) == 0 {
+		return wb.err
+	}
+	n, err := f.f.WriteAt(wb.buf, wb.off)
+	if n > 0 {
+		f.wroteAt(wb.off, n)
+	}
+	if err == nil {
+		_, err = f.f.Seek(wb.pos, io.SeekStart)
+	}
+	wb.buf = wb.buf[:0]
+	if err != nil {
+		wb.err = err
+	}
+	return err
+}
+
+// bufferedSeek implements Seek without flushing relative moves.
+func (f *File) bufferedSeek(offset int64, whence int) (int64, error) {
+	wb := f.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if len(wb.buf) == 0 || whence == io.SeekEnd {
+		if err := f.flushLocked(); err != nil {
+			return 0, err
+		}
+		return f.f.Seek(offset, whence)
+	}
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += wb.pos
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.f.Name(), Err: fs.ErrInvalid}
+	}
+	if pos < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.f.Name(), Err: fs.ErrInvalid}
+	}
+	wb.pos = pos
+	return pos, nil
+}
+
+// bufferedReadAt reads from the underlying file and overlays the unflushed
+// bytes, extending the result past the end of the underlying file where the
+// buffer does.
+func (f *File) bufferedReadAt(p []byte, off int64) (int, error) {
+	wb := f.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	n, err := f.readAt(p, off)
+	if len(wb.buf) == 0 || (err != nil && err != io.EOF) {
+		return n, err
+	}
+	end := wb.off + int64(len(wb.buf))
+	if err == io.EOF && end > off+int64(n) {
+		m := int(min(end-off, int64(len(p))))
+		clear(p[n:m])
+		n = m
+		if n == len(p) {
+			err = nil
+		}
+	}
+	if lo, hi := max(wb.off, off), min(end, off+int64(n)); lo < hi {
+		copy(p[lo-off:hi-off], wb.buf[lo-wb.off:hi-wb.off])
+	}
+	return n, err
+}
@@ -0,0 +1,197 @@
+package billyfs_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// newWriteBufferTestFS creates a billyfs filesystem with write buffering
+// enabled over a counting backend
+func newWriteBufferTestFS(t *testing.T, size int) (*billyfs.Filesystem, *countingFS, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	counting := &countingFS{SymlinkFileSystem: fs}
+
+	bfs, err := billyfs.NewFSWithOptions(counting, tmpDir, billyfs.Options{WriteBufferSize: size})
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+
+	return bfs, counting, tmpDir
+}
+
+// TestWriteBufferCoalesces tests that small writes reach the backend in
+// buffer-sized chunks
+func TestWriteBufferCoalesces(t *testing.T) {
+	bfs, counting, tmpDir := newWriteBufferTestFS(t, 1024)
+
+	f, err := bfs.Create("index")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	var want []byte
+	for i := 0; i < 300; i++ {
+		p := []byte{byte(i), byte(i >> 8), 'x'}
+		if _, err := f.Write(p); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		want = append(want, p...)
+	}
+	if got := counting.writes.Load(); got != 0 {
+		t.Errorf("expected no backend writes before the buffer fills, got %d", got)
+	}
+	if _, err := f.Write(make([]byte, 200)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want = append(want, make([]byte, 200)...)
+	if got := counting.writes.Load(); got != 1 {
+		t.Errorf("expected one backend write when the buffer fills, got %d", got)
+	}
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	want = append(want, "tail"...)
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := counting.writes.Load(); got != 2 {
+		t.Errorf("expected the final chunk to be flushed on Close, got %d writes", got)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(tmpDir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, want) {
+		t.Error("content mismatch")
+	}
+}
+
+// TestWriteBufferCoherent tests that reads and seeks observe unflushed
+// writes
+func TestWriteBufferCoherent(t *testing.T) {
+	bfs, counting, tmpDir := newWriteBufferTestFS(t, 4096)
+	if err := os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := bfs.OpenFile("file.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	f.Write([]byte("ab"))
+	f.Write([]byte("cd"))
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 12 {
+		t.Errorf("expected offset 12, got %d", pos)
+	}
+	f.(io.WriterAt).WriteAt([]byte("XY"), 12)
+
+	p := make([]byte, 20)
+	n, err := f.ReadAt(p, 0)
+	if err != io.EOF || string(p[:n]) != "01234567abcdXY" {
+		t.Errorf("unexpected ReadAt result %q, %v", p[:n], err)
+	}
+	if got := counting.writes.Load(); got != 0 {
+		t.Errorf("expected no backend writes, got %d", got)
+	}
+
+	// Seeking back and overwriting inside the buffered range coalesces.
+	if _, err := f.Seek(-4, io.SeekCurrent); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	f.Write([]byte("AB"))
+	n, _ = f.ReadAt(p, 6)
+	if string(p[:n]) != "67ABcdXY" {
+		t.Errorf("unexpected ReadAt result %q", p[:n])
+	}
+
+	// Sequential reads flush and continue at the handle offset.
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(rest) != "cdXY" {
+		t.Errorf("unexpected Read result %q", rest)
+	}
+	if got := counting.writes.Load(); got != 1 {
+		t.Errorf("expected one backend write, got %d", got)
+	}
+
+	// Truncate flushes before changing the size.
+	f.Write([]byte("Z"))
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if end, _ := f.Seek(0, io.SeekEnd); end != 3 {
+		t.Errorf("expected size 3, got %d", end)
+	}
+}
+
+// TestWriteBufferDeferredError tests that flush failures surface from Close
+func TestWriteBufferDeferredError(t *testing.T) {
+	bfs, counting, _ := newWriteBufferTestFS(t, 4096)
+
+	f, err := bfs.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := f.Write([]byte("buffered")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	counting.failWrites.Store(true)
+	if err := f.Close(); !isInjected(err) {
+		t.Errorf("expected Close to return the deferred error, got %v", err)
+	}
+
+	counting.failWrites.Store(false)
+	f, err = bfs.Create("sync.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	f.Write([]byte("buffered"))
+	counting.failWrites.Store(true)
+	syncer := f.(interface{ Sync() error })
+	if err := syncer.Sync(); !isInjected(err) {
+		t.Errorf("expected Sync to fail, got %v", err)
+	}
+	counting.failWrites.Store(false)
+	if _, err := f.Write([]byte("more")); !isInjected(err) {
+		t.Errorf("expected later Write to report the error, got %v", err)
+	}
+	if err := f.Close(); !isInjected(err) {
+		t.Errorf("expected Close to report the error, got %v", err)
+	}
+}
+
+// TestWriteBufferAppend tests that append-only handles are not buffered
+func TestWriteBufferAppend(t *testing.T) {
+	bfs, counting, _ := newWriteBufferTestFS(t, 4096)
+	writeBillyFile(t, bfs, "log.txt", []byte("a"))
+	before := counting.writes.Load()
+
+	f, err := bfs.OpenFile("log.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	f.Write([]byte("b"))
+	if counting.writes.Load() != before+1 {
+		t.Error("expected append write to reach the backend immediately")
+	}
+}
@@ -0,0 +1,219 @@
+package billyfs
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// ErrNoXattr is returned when a requested extended attribute does not
+// exist.
+var ErrNoXattr = errors.New("billyfs: no such extended attribute")
+
+// Extended attributes are stored natively when the Filesystem is backed by
+// the local filesystem. For other backends they are kept in a sidecar store
+// in memory, shared by the Filesystem and those derived from it with
+// Chroot, which follows renames and removals made through them.
+
+// Getxattr returns the value of the extended attribute attr of the named
+// file.
+func (f *Filesystem) Getxattr(name, attr string) ([]byte, error) {
+	if p, ok := f.nativePath(name); ok {
+		data, err := getxattr(p, attr)
+		return data, xattrError("getxattr", name, err)
+	}
+	if _, err := f.fs.Stat(name); err != nil {
+		return nil, err
+	}
+	return f.xattrs.get(f.absPath(name), attr, name)
+}
+
+// Setxattr sets the extended attribute attr of the named file to data.
+func (f *Filesystem) Setxattr(name, attr string, data []byte) error {
+	if p, ok := f.nativePath(name); ok {
+		return xattrError("setxattr", name, setxattr(p, attr, data))
+	}
+	if _, err := f.fs.Stat(name); err != nil {
+		return err
+	}
+	f.xattrs.set(f.absPath(name), attr, data)
+	return nil
+}
+
+// Listxattr returns the sorted names of the extended attributes of the
+// named file.
+func (f *Filesystem) Listxattr(name string) ([]string, error) {
+	if p, ok := f.nativePath(name); ok {
+		attrs, err := listxattr(p)
+		sort.Strings(attrs)
+		return attrs, xattrError("listxattr", name, err)
+	}
+	if _, err := f.fs.Stat(name); err != nil {
+		return nil, err
+	}
+	return f.xattrs.list(f.absPath(name)), nil
+}
+
+// Removexattr removes the extended attribute attr of the named file.
+func (f *Filesystem) Removexattr(name, attr string) error {
+	if p, ok := f.nativePath(name); ok {
+		return xattrError("removexattr", name, removexattr(p, attr))
+	}
+	if _, err := f.fs.Stat(name); err != nil {
+		return err
+	}
+	return f.xattrs.remove(f.absPath(name), attr, name)
+}
+
+// fdFile is implemented by files that expose an operating system file
+// descriptor.
+type fdFile interface {
+	Fd() uintptr
+}
+
+// Getxattr returns the value of the extended attribute attr of the file.
+func (f *File) Getxattr(attr string) ([]byte, error) {
+	if fd, ok := f.f.(fdFile); ok {
+		data, err := fgetxattr(fd.Fd(), attr)
+		return data, xattrError("getxattr", f.name, err)
+	}
+	return f.fs.Getxattr(f.name, attr)
+}
+
+// Setxattr sets the extended attribute attr of the file to data.
+func (f *File) Setxattr(attr string, data []byte) error {
+	if fd, ok := f.f.(fdFile); ok {
+		return xattrError("setxattr", f.name, fsetxattr(fd.Fd(), attr, data))
+	}
+	return f.fs.Setxattr(f.name, attr, data)
+}
+
+// Listxattr returns the sorted names of the extended attributes of the
+// file.
+func (f *File) Listxattr() ([]string, error) {
+	if fd, ok := f.f.(fdFile); ok {
+		attrs, err := flistxattr(fd.Fd())
+		sort.Strings(attrs)
+		return attrs, xattrError("listxattr", f.name, err)
+	}
+	return f.fs.Listxattr(f.name)
+}
+
+// Removexattr removes the extended attribute attr of the file.
+func (f *File) Removexattr(attr string) error {
+	if fd, ok := f.f.(fdFile); ok {
+		return xattrError("removexattr", f.name, fremovexattr(fd.Fd(), attr))
+	}
+	return f.fs.Removexattr(f.name, attr)
+}
+
+// xattrError wraps an error of a native extended attribute call.
+func xattrError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if isNoXattr(err) {
+		err = ErrNoXattr
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// xattrStore is the sidecar store of extended attributes for backends
+// without native support, keyed by absolute paths in the namespace of the
+// underlying absfs filesystem.
+type xattrStore struct {
+	mu    sync.Mutex
+	attrs map[string]map[string][]byte
+}
+
+func newXattrStore() *xattrStore {
+	return &xattrStore{attrs: make(map[string]map[string][]byte)}
+}
+
+func (s *xattrStore) get(p, attr, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.attrs[p][attr]
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: ErrNoXattr}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *xattrStore) set(p, attr string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := s.attrs[p]
+	if attrs == nil {
+		attrs = make(map[string][]byte)
+		s.attrs[p] = attrs
+	}
+	attrs[attr] = append([]byte(nil), data...)
+}
+
+func (s *xattrStore) list(p string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.attrs[p]))
+	for attr := range s.attrs[p] {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *xattrStore) remove(p, attr, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attrs[p][attr]; !ok {
+		return &fs.PathError{Op: "removexattr", Path: name, Err: ErrNoXattr}
+	}
+	delete(s.attrs[p], attr)
+	if len(s.attrs[p]) == 0 {
+		delete(s.attrs, p)
+	}
+	return nil
+}
+
+// rename moves the attributes of oldpath and its descendants to newpath,
+// dropping those previously stored for newpath.
+func (s *xattrStore) rename(oldpath, newpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	renameTree(s.attrs, oldpath, newpath)
+}
+
+// drop forgets the attributes of p and its descendants.
+func (s *xattrStore) drop(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropTree(s.attrs, p)
+}
+
+// renameTree moves the entries of a map keyed by absolute paths for
+// oldpath and its descendants to newpath, dropping those previously stored
+// for newpath and its descendants.
+func renameTree[V any](m map[string]V, oldpath, newpath string) {
+	dropTree(m, newpath)
+	moved := make(map[string]V)
+	for p, v := range m {
+		if p == oldpath || isWithin(oldpath, p) {
+			delete(m, p)
+			moved[newpath+p[len(oldpath):]] = v
+		}
+	}
+	for p, v := range moved {
+		m[p] = v
+	}
+}
+
+// dropTree deletes the entries of a map keyed by absolute paths for p and
+// its descendants.
+func dropTree[V any](m map[string]V, p string) {
+	for q := range m {
+		if q == p || isWithin(p, q) {
+			delete(m, q)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package billyfs
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// getxattr returns the value of an extended attribute of the file at path,
+// growing the buffer if the attribute changes size between calls.
+func getxattr(path, attr string) ([]byte, error) {
+	return readXattr(func(buf []byte) (int, error) {
+		return syscall.Getxattr(path, attr, buf)
+	})
+}
+
+func setxattr(path, attr string, data []byte) error {
+	return syscall.Setxattr(path, attr, data, 0)
+}
+
+func listxattr(path string) ([]string, error) {
+	data, err := readXattr(func(buf []byte) (int, error) {
+		return syscall.Listxattr(path, buf)
+	})
+	return splitXattrNames(data), err
+}
+
+func removexattr(path, attr string) error {
+	return syscall.Removexattr(path, attr)
+}
+
+func fgetxattr(fd uintptr, attr string) ([]byte, error) {
+	return readXattr(func(buf []byte) (int, error) {
+		return unix.Fgetxattr(int(fd), attr, buf)
+	})
+}
+
+func fsetxattr(fd uintptr, attr string, data []byte) error {
+	return unix.Fsetxattr(int(fd), attr, data, 0)
+}
+
+func flistxattr(fd uintptr) ([]string, error) {
+	data, err := readXattr(func(buf []byte) (int, error) {
+		return unix.Flistxattr(int(fd), buf)
+	})
+	return splitXattrNames(data), err
+}
+
+func fremovexattr(fd uintptr, attr string) error {
+	return unix.Fremovexattr(int(fd), attr)
+}
+
+// readXattr queries the size of a value with an empty buffer, then reads
+// it, retrying if it grew in between.
+func readXattr(call func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := call(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// splitXattrNames splits a NUL-separated list of attribute names.
+func splitXattrNames(data []byte) []string {
+	names := []string{}
+	for _, name := range strings.Split(string(data), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isNoXattr reports whether err means that an attribute does not exist.
+func isNoXattr(err error) bool {
+	return errors.Is(err, syscall.ENODATA)
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+
+package billyfs
+
+import "errors"
+
+// Native extended attributes are only implemented on Linux. Elsewhere the
+// calls on the local filesystem report errors.ErrUnsupported.
+
+func getxattr(path, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setxattr(path, attr string, data []byte) error {
+	return errors.ErrUnsupported
+}
+
+func listxattr(path string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func removexattr(path, attr string) error {
+	return errors.ErrUnsupported
+}
+
+func fgetxattr(fd uintptr, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func fsetxattr(fd uintptr, attr string, data []byte) error {
+	return errors.ErrUnsupported
+}
+
+func flistxattr(fd uintptr) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func fremovexattr(fd uintptr, attr string) error {
+	return errors.ErrUnsupported
+}
+
+func isNoXattr(err error) bool {
+	return false
+}
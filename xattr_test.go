@@ -0,0 +1,114 @@
+package billyfs_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/absfs/billyfs"
+	"github.com/absfs/osfs"
+)
+
+// TestXattrNative tests extended attributes on the local filesystem
+func TestXattrNative(t *testing.T) {
+	bfs, _ := newTestFS(t)
+	writeBillyFile(t, bfs, "file.txt", []byte("data"))
+
+	err := bfs.Setxattr("file.txt", "user.origin", []byte("remote"))
+	if err != nil {
+		msg := err.Error()
+		if errors.Is(err, errors.ErrUnsupported) || strings.Contains(msg, "not supported") {
+			t.Skipf("extended attributes not supported: %v", err)
+		}
+		t.Fatalf("Setxattr failed: %v", err)
+	}
+	data, err := bfs.Getxattr("file.txt", "user.origin")
+	if err != nil || string(data) != "remote" {
+		t.Errorf("Getxattr: got %q, %v", data, err)
+	}
+	names, err := bfs.Listxattr("file.txt")
+	if err != nil || !reflect.DeepEqual(names, []string{"user.origin"}) {
+		t.Errorf("Listxattr: got %v, %v", names, err)
+	}
+	if err := bfs.Removexattr("file.txt", "user.origin"); err != nil {
+		t.Errorf("Removexattr failed: %v", err)
+	}
+	if _, err := bfs.Getxattr("file.txt", "user.origin"); !errors.Is(err, billyfs.ErrNoXattr) {
+		t.Errorf("expected ErrNoXattr, got %v", err)
+	}
+}
+
+// TestXattrSidecar tests the in-memory store used by backends without
+// native extended attributes
+func TestXattrSidecar(t *testing.T) {
+	fs, err := osfs.NewFS()
+	if err != nil {
+		t.Fatalf("failed to create osfs: %v", err)
+	}
+	bfs, err := billyfs.NewFS(&countingFS{SymlinkFileSystem: fs}, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create billyfs: %v", err)
+	}
+	if err := bfs.MkdirAll("dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeBillyFile(t, bfs, "dir/file.txt", []byte("data"))
+
+	for _, attr := range []string{"user.b", "user.a"} {
+		if err := bfs.Setxattr("dir/file.txt", attr, []byte(attr)); err != nil {
+			t.Fatalf("Setxattr failed: %v", err)
+		}
+	}
+	names, err := bfs.Listxattr("dir/file.txt")
+	if err != nil || !reflect.DeepEqual(names, []string{"user.a", "user.b"}) {
+		t.Errorf("Listxattr: got %v, %v", names, err)
+	}
+	if err := bfs.Removexattr("dir/file.txt", "user.b"); err != nil {
+		t.Errorf("Removexattr failed: %v", err)
+	}
+	if err := bfs.Removexattr("dir/file.txt", "user.b"); !errors.Is(err, billyfs.ErrNoXattr) {
+		t.Errorf("expected ErrNoXattr, got %v", err)
+	}
+	if _, err := bfs.Getxattr("missing.txt", "user.a"); err == nil {
+		t.Error("expected error for a missing file")
+	}
+
+	// File handles use the same store.
+	f, err := bfs.Open("dir/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	file := f.(*billyfs.File)
+	if err := file.Setxattr("user.c", []byte("c")); err != nil {
+		t.Errorf("File.Setxattr failed: %v", err)
+	}
+	if data, err := file.Getxattr("user.a"); err != nil || string(data) != "user.a" {
+		t.Errorf("File.Getxattr: got %q, %v", data, err)
+	}
+	f.Close()
+
+	// Attributes follow renames of the file and its parent, and are shared
+	// with chrooted filesystems.
+	if err := bfs.Rename("dir", "moved"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	sub, err := bfs.Chroot("moved")
+	if err != nil {
+		t.Fatalf("Chroot failed: %v", err)
+	}
+	names, err = sub.(*billyfs.Filesystem).Listxattr("file.txt")
+	if err != nil || !reflect.DeepEqual(names, []string{"user.a", "user.c"}) {
+		t.Errorf("after Rename: got %v, %v", names, err)
+	}
+
+	// Recreating a removed file does not resurrect its attributes.
+	if err := bfs.Remove("moved/file.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	writeBillyFile(t, bfs, "moved/file.txt", []byte("new"))
+	names, err = bfs.Listxattr("moved/file.txt")
+	if err != nil || len(names) != 0 {
+		t.Errorf("after Remove: got %v, %v", names, err)
+	}
+}